@@ -5,10 +5,16 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 var addClusterCmd = &cobra.Command{
@@ -23,8 +29,28 @@ flamingo add-cluster dev-1 \
   --server-name=dev-1.example.com \
   --server-addr=https://dev-1.example.com:6443 \
   --insecure
+
+# Add cluster prod-1 reached through an HTTPS proxy, trusting the CA bundle of the API server
+flamingo add-cluster prod-1 \
+  --proxy-url=https://proxy.example.com:3128 \
+  --ca-file=./prod-1-ca.pem
+
+# Add cluster dev-1 and also generate a kubeconfig secret in flux-system for Flux spec.kubeConfig.secretRef
+flamingo add-cluster dev-1 --flux-kubeconfig-namespace=flux-system
+
+# Add cluster dev-1 labelled for ApplicationSet generators, scoped to the dev project and two namespaces
+flamingo add-cluster dev-1 \
+  --label=env=dev \
+  --project=dev \
+  --namespaces=podinfo,podinfo-helm
+
+# Add every context of the kubeconfig file as a cluster
+flamingo add-cluster --all-contexts
+
+# Add every Cluster API cluster of the management cluster labelled with env=dev
+flamingo add-cluster --from-capi --selector=env=dev
 `,
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MaximumNArgs(1),
 	RunE: addClusterCmdRun,
 }
 
@@ -32,20 +58,83 @@ var addClusterFlags struct {
 	insecureSkipTLSVerify bool
 	serverName            string
 	serverAddress         string
+	externalAddress       string
+	proxyURL              string
+	caFile                string
 	export                bool
+	allContexts           bool
+	fromCAPI              bool
+	selector              string
+	labels                []string
+	namespaces            []string
+	clusterResources      bool
+	project               string
+	fluxKubeconfigNs      string
 }
 
 func init() {
 	addClusterCmd.Flags().BoolVar(&addClusterFlags.insecureSkipTLSVerify, "insecure", false, "If true, the server's certificate will not be checked for validity. This will make your HTTPS connections insecure")
 	addClusterCmd.Flags().StringVar(&addClusterFlags.serverName, "server-name", "", "If set, this overrides the hostname used to validate the server certificate")
 	addClusterCmd.Flags().StringVar(&addClusterFlags.serverAddress, "server-addr", "", "If set, this overrides the server address used to connect to the cluster")
+	addClusterCmd.Flags().StringVar(&addClusterFlags.externalAddress, "external-addr", "", "If set, this overrides the address used by the CLI to connect to the cluster, e.g. an ingress in front of the API server")
+	addClusterCmd.Flags().StringVar(&addClusterFlags.proxyURL, "proxy-url", "", "URL of the HTTP(S) or SOCKS5 proxy used by both Argo CD and the CLI to connect to the cluster")
+	addClusterCmd.Flags().StringVar(&addClusterFlags.caFile, "ca-file", "", "path to a PEM encoded CA bundle used to verify the server's certificate")
 	addClusterCmd.Flags().BoolVar(&addClusterFlags.export, "export", false, "export manifests instead of installing")
+	addClusterCmd.Flags().BoolVar(&addClusterFlags.allContexts, "all-contexts", false, "add every context of the kubeconfig file as a cluster")
+	addClusterCmd.Flags().BoolVar(&addClusterFlags.fromCAPI, "from-capi", false, "add every Cluster API cluster found on the current cluster")
+	addClusterCmd.Flags().StringVar(&addClusterFlags.selector, "selector", "", "label selector to filter Cluster API clusters, used with --from-capi")
+
+	addClusterCmd.Flags().StringArrayVar(&addClusterFlags.labels, "label", nil, "label to set on the cluster secret in the format key=value, can be repeated")
+	addClusterCmd.Flags().StringSliceVar(&addClusterFlags.namespaces, "namespaces", nil, "comma separated list of namespaces Argo CD is allowed to manage on the cluster")
+	addClusterCmd.Flags().BoolVar(&addClusterFlags.clusterResources, "cluster-resources", false, "allow Argo CD to manage cluster-scoped resources when --namespaces is set")
+	addClusterCmd.Flags().StringVar(&addClusterFlags.project, "project", "", "restrict the cluster to the given Argo CD project")
+
+	addClusterCmd.Flags().StringVar(&addClusterFlags.fluxKubeconfigNs, "flux-kubeconfig-namespace", "", "if set, also generate a Flux kubeconfig secret named <cluster>-kubeconfig in this namespace")
 
 	rootCmd.AddCommand(addClusterCmd)
 }
 
 func addClusterCmdRun(cmd *cobra.Command, args []string) error {
-	leafClusterContext := args[0]
+	if addClusterFlags.allContexts && addClusterFlags.fromCAPI {
+		return fmt.Errorf("--all-contexts and --from-capi are mutually exclusive")
+	}
+	bulk := addClusterFlags.allContexts || addClusterFlags.fromCAPI
+	if bulk && len(args) > 0 {
+		return fmt.Errorf("CONTEXT_NAME cannot be used with --all-contexts or --from-capi")
+	}
+	if !bulk && len(args) != 1 {
+		return fmt.Errorf("CONTEXT_NAME is required")
+	}
+	if bulk && (addClusterFlags.serverAddress != "" || addClusterFlags.serverName != "" || addClusterFlags.externalAddress != "") {
+		return fmt.Errorf("--server-addr, --server-name and --external-addr cannot be used with --all-contexts or --from-capi")
+	}
+	if addClusterFlags.caFile != "" && addClusterFlags.insecureSkipTLSVerify {
+		return fmt.Errorf("--ca-file cannot be used with --insecure")
+	}
+	if ns := addClusterFlags.fluxKubeconfigNs; ns != "" {
+		if e := validation.IsDNS1123Label(ns); len(e) > 0 {
+			return fmt.Errorf("flux kubeconfig namespace must be a valid DNS label: %q", ns)
+		}
+	}
+	if addClusterFlags.proxyURL != "" {
+		if _, err := utils.ParseProxyURL(addClusterFlags.proxyURL); err != nil {
+			return err
+		}
+	}
+	if addClusterFlags.selector != "" && !addClusterFlags.fromCAPI {
+		return fmt.Errorf("--selector can only be used with --from-capi")
+	}
+
+	if addClusterFlags.clusterResources && len(addClusterFlags.namespaces) == 0 {
+		return fmt.Errorf("--cluster-resources can only be used with --namespaces")
+	}
+	if _, err := parseClusterLabels(addClusterFlags.labels); err != nil {
+		return err
+	}
+
+	if addClusterFlags.fromCAPI {
+		return addClustersFromCAPI(cmd.Flags())
+	}
 
 	kubeconfig := ""
 	if *kubeconfigArgs.KubeConfig == "" {
@@ -59,81 +148,276 @@ func addClusterCmdRun(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	// Inline the certificates referenced by file, the cluster secret can only carry data
+	if err := clientcmdapi.FlattenConfig(config); err != nil {
+		return err
+	}
+
+	var contextNames []string
+	if addClusterFlags.allContexts {
+		for name := range config.Contexts {
+			contextNames = append(contextNames, name)
+		}
+		sort.Strings(contextNames)
+	} else {
+		contextNames = []string{args[0]}
+	}
+
+	var clusters []*utils.Cluster
+	for _, contextName := range contextNames {
+		leafCluster, err := clusterFromKubeconfig(config, contextName, contextName)
+		if err != nil {
+			if !addClusterFlags.allContexts {
+				return err
+			}
+			logger.Warningf("skipping context %s: %v", contextName, err)
+			continue
+		}
+		clusters = append(clusters, leafCluster)
+	}
+
+	return addClusters(cmd.Flags(), clusters)
+}
+
+// addClusters exports or registers the given clusters, the flags tell which settings of the registered clusters are overwritten.
+func addClusters(flags *pflag.FlagSet, clusters []*utils.Cluster) error {
+	labels, err := parseClusterLabels(addClusterFlags.labels)
+	if err != nil {
+		return err
+	}
+	var caData string
+	if addClusterFlags.caFile != "" {
+		ca, err := os.ReadFile(addClusterFlags.caFile)
+		if err != nil {
+			return fmt.Errorf("reading CA bundle failed: %w", err)
+		}
+		caData = base64.StdEncoding.EncodeToString(ca)
+	}
+	for _, leafCluster := range clusters {
+		if caData != "" {
+			leafCluster.Config.TLSClientConfig.CAData = caData
+		}
+		leafCluster.Config.ProxyURL = addClusterFlags.proxyURL
+		if leafCluster.Labels == nil && len(labels) > 0 {
+			leafCluster.Labels = map[string]string{}
+		}
+		for k, v := range labels {
+			leafCluster.Labels[k] = v
+		}
+		leafCluster.Namespaces = addClusterFlags.namespaces
+		leafCluster.ClusterResources = addClusterFlags.clusterResources
+		leafCluster.Project = addClusterFlags.project
+		if addClusterFlags.fluxKubeconfigNs != "" {
+			if leafCluster.Annotations == nil {
+				leafCluster.Annotations = map[string]string{}
+			}
+			leafCluster.Annotations[utils.FluxKubeconfigAnnotation] = addClusterFlags.fluxKubeconfigNs + "/" + utils.FluxKubeconfigSecretName(leafCluster.Name)
+			if leafCluster.Config.ExecProviderConfig != nil || leafCluster.Config.AWSAuthConfig != nil {
+				logger.Warningf("the Flux kubeconfig of cluster %s uses an exec credential plugin, which Flux only runs with --insecure-kubeconfig-exec", leafCluster.Name)
+			}
+		}
+	}
+
+	if addClusterFlags.export {
+		for _, leafCluster := range clusters {
+			secret, err := leafCluster.Secret(rootArgs.applicationNamespace)
+			if err != nil {
+				return err
+			}
+			result, err := utils.ToYAML(secret)
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(result))
+
+			if addClusterFlags.fluxKubeconfigNs != "" {
+				secret, err := leafCluster.FluxKubeconfigSecret(addClusterFlags.fluxKubeconfigNs)
+				if err != nil {
+					return err
+				}
+				result, err := utils.ToYAML(secret)
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(result))
+			}
+		}
+		return nil
+	}
+
+	cli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+	registry := utils.NewClusterRegistry(cli, rootArgs.applicationNamespace)
+	bulk := addClusterFlags.allContexts || addClusterFlags.fromCAPI
+	var failed []string
+	for _, leafCluster := range clusters {
+		if err := addCluster(flags, registry, leafCluster); err != nil {
+			if !bulk {
+				return err
+			}
+			// keep registering the other clusters
+			logger.Failuref("cluster %s not added: %v", leafCluster.Name, err)
+			failed = append(failed, leafCluster.Name)
+			continue
+		}
+		logger.Successf("cluster %s added", leafCluster.Name)
+		reportClusterAddresses(leafCluster)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("adding %d of %d clusters failed: %s", len(failed), len(clusters), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// addCluster registers a cluster, merged with its current registration, and its Flux kubeconfig secret.
+func addCluster(flags *pflag.FlagSet, registry *utils.ClusterRegistry, leafCluster *utils.Cluster) error {
+	if addClusterFlags.fluxKubeconfigNs != "" {
+		logger.Actionf("applying generated Flux kubeconfig secret %s in %s namespace", utils.FluxKubeconfigSecretName(leafCluster.Name), addClusterFlags.fluxKubeconfigNs)
+		if err := registry.AddFluxKubeconfig(ctx.Background(), leafCluster, addClusterFlags.fluxKubeconfigNs); err != nil {
+			return fmt.Errorf("apply failed: %w", err)
+		}
+	}
+	existing, err := registry.Get(ctx.Background(), leafCluster.Name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("reading cluster %s failed: %w", leafCluster.Name, err)
+	}
+	if existing != nil {
+		mergeRegisteredCluster(flags, leafCluster, existing)
+	}
+	logger.Actionf("applying generated cluster secret %s in %s namespace", utils.ClusterSecretName(leafCluster.Name), rootArgs.applicationNamespace)
+	if err := registry.Add(ctx.Background(), leafCluster); err != nil {
+		return fmt.Errorf("apply failed: %w", err)
+	}
+	return nil
+}
+
+// mergeRegisteredCluster keeps the settings of an already registered cluster which are not set by flags,
+// like the labels, namespaces and project changed with flamingo cluster label, so that re-running
+// add-cluster only refreshes the address and credentials of the cluster.
+func mergeRegisteredCluster(flags *pflag.FlagSet, leafCluster *utils.Cluster, existing *utils.Cluster) {
+	labels := map[string]string{}
+	for k, v := range existing.Labels {
+		labels[k] = v
+	}
+	for k, v := range leafCluster.Labels {
+		labels[k] = v
+	}
+	leafCluster.Labels = labels
+
+	annotations := map[string]string{}
+	for k, v := range existing.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range leafCluster.Annotations {
+		annotations[k] = v
+	}
+	// the cluster is being added, so it exists again
+	delete(annotations, capiDeletedAnnotation)
+	leafCluster.Annotations = annotations
 
-	// Specify the context name
-	contextName := leafClusterContext
+	if !flags.Changed("namespaces") {
+		leafCluster.Namespaces = existing.Namespaces
+	}
+	if !flags.Changed("cluster-resources") {
+		leafCluster.ClusterResources = existing.ClusterResources
+	}
+	if !flags.Changed("project") {
+		leafCluster.Project = existing.Project
+	}
+	if !flags.Changed("proxy-url") {
+		leafCluster.Config.ProxyURL = existing.Config.ProxyURL
+	}
+}
+
+// clusterFromKubeconfig builds a Flamingo cluster named name from the given context of a kubeconfig.
+func clusterFromKubeconfig(config *clientcmdapi.Config, contextName string, name string) (*utils.Cluster, error) {
+	// Context names like gke_project_zone_name or EKS ARNs are no valid object names
+	if err := utils.ValidateClusterName(name); err != nil {
+		return nil, fmt.Errorf("%w, rename the context with kubectl config rename-context", err)
+	}
 
 	// Get the context
 	context, exists := config.Contexts[contextName]
 	if !exists {
-		return fmt.Errorf("context not found")
+		return nil, fmt.Errorf("context %q not found", contextName)
 	}
 
 	// Get the cluster info
 	cluster, exists := config.Clusters[context.Cluster]
 	if !exists {
-		return fmt.Errorf("cluster not found")
+		return nil, fmt.Errorf("cluster %q not found", context.Cluster)
 	}
 
 	// Get the user info
 	user, exists := config.AuthInfos[context.AuthInfo]
 	if !exists {
-		return fmt.Errorf("user not found")
-	}
-
-	template := `apiVersion: v1
-kind: Secret
-metadata:
-  name: %s-cluster
-  namespace: argocd
-  labels:
-    argocd.argoproj.io/secret-type: cluster
-    flamingo/cluster: "true"
-  annotations: 
-    flamingo/external-address: "%s"
-    flamingo/internal-address: "%s"
-type: Opaque
-stringData:
-  name: %s
-  server: %s
-  config: |
-    {
-      "tlsClientConfig": {
-        "insecure": %v,
-        "certData": "%s",
-        "keyData": "%s",
-        "serverName": "%s"
-      }
-    }
-`
+		return nil, fmt.Errorf("user %q not found", context.AuthInfo)
+	}
+
 	serverAddress := addClusterFlags.serverAddress
 	if serverAddress == "" {
 		serverAddress = cluster.Server
 	}
+	externalAddress := addClusterFlags.externalAddress
+	if externalAddress == "" {
+		externalAddress = cluster.Server // known to the user via kubectl config view
+	}
 
-	result := fmt.Sprintf(template,
-		contextName,
-		cluster.Server, // external address (known to the user via kubectl config view)
-		serverAddress,  // internal address
-		contextName,
-		serverAddress,
-		addClusterFlags.insecureSkipTLSVerify,
-		base64.StdEncoding.EncodeToString(user.ClientCertificateData),
-		base64.StdEncoding.EncodeToString(user.ClientKeyData),
-		addClusterFlags.serverName,
-	)
+	leafCluster := &utils.Cluster{
+		Name:            name,
+		Server:          serverAddress,
+		ExternalAddress: externalAddress, // external address, used by the CLI
+		InternalAddress: serverAddress,   // internal address, used by Argo CD
+		Config: utils.SecretConfig{
+			Username:    user.Username,
+			Password:    user.Password,
+			BearerToken: user.Token,
+			TLSClientConfig: utils.TLSClientConfig{
+				Insecure:   addClusterFlags.insecureSkipTLSVerify,
+				CertData:   base64.StdEncoding.EncodeToString(user.ClientCertificateData),
+				KeyData:    base64.StdEncoding.EncodeToString(user.ClientKeyData),
+				ServerName: addClusterFlags.serverName,
+			},
+		},
+	}
 
-	if addClusterFlags.export {
-		fmt.Print(result)
-		return nil
-	} else {
-		logger.Actionf("applying generated cluster secret %s in %s namespace", contextName+"-cluster", rootArgs.applicationNamespace)
-		applyOutput, err := utils.Apply(ctx.Background(), kubeconfigArgs, kubeclientOptions, []byte(result))
-		if err != nil {
-			return fmt.Errorf("apply failed: %w", err)
+	// A root CA cannot be combined with the insecure flag
+	if !addClusterFlags.insecureSkipTLSVerify && len(cluster.CertificateAuthorityData) > 0 {
+		leafCluster.Config.TLSClientConfig.CAData = base64.StdEncoding.EncodeToString(cluster.CertificateAuthorityData)
+	}
+
+	if user.Exec != nil {
+		exec := &utils.ExecProviderConfig{
+			Command:     user.Exec.Command,
+			Args:        user.Exec.Args,
+			APIVersion:  user.Exec.APIVersion,
+			InstallHint: user.Exec.InstallHint,
+		}
+		for _, env := range user.Exec.Env {
+			if exec.Env == nil {
+				exec.Env = map[string]string{}
+			}
+			exec.Env[env.Name] = env.Value
 		}
-		fmt.Fprintln(os.Stderr, applyOutput)
+		leafCluster.Config.ExecProviderConfig = exec
 	}
 
-	return nil
+	if len(user.ClientCertificateData) == 0 && user.Token == "" && user.Username == "" && user.Exec == nil {
+		return nil, fmt.Errorf("user %q has no client certificate, token, basic auth or exec credentials", context.AuthInfo)
+	}
+
+	return leafCluster, nil
+}
+
+// reportClusterAddresses prints the address used by each connection path to the cluster.
+func reportClusterAddresses(leafCluster *utils.Cluster) {
+	via := ""
+	if leafCluster.Config.ProxyURL != "" {
+		via = " via proxy " + leafCluster.Config.ProxyURL
+	}
+	logger.Actionf("Argo CD connects to cluster %s at %s%s", leafCluster.Name, leafCluster.ArgoCDAddress(), via)
+	logger.Actionf("the CLI connects to cluster %s at %s%s", leafCluster.Name, leafCluster.CLIAddress(), via)
 }
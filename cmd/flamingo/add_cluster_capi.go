@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// clusterSourceLabel records how a cluster has been registered
+	clusterSourceLabel = "flamingo/cluster-source"
+	capiClusterSource  = "capi"
+
+	// capiClusterAnnotation points to the Cluster API object of a registered cluster
+	capiClusterAnnotation = "flamingo/capi-cluster"
+	// capiDeletedAnnotation flags a registered cluster whose Cluster API object is gone
+	capiDeletedAnnotation = "flamingo/capi-deleted"
+)
+
+var capiClusterGVK = schema.GroupVersionKind{
+	Group:   "cluster.x-k8s.io",
+	Version: "v1beta1",
+	Kind:    "Cluster",
+}
+
+// addClustersFromCAPI registers every Cluster API cluster of the management cluster
+// and flags the previously registered ones that do not exist anymore.
+func addClustersFromCAPI(flags *pflag.FlagSet) error {
+	mgmtCli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+
+	selector := labels.Everything()
+	if addClusterFlags.selector != "" {
+		selector, err = labels.Parse(addClusterFlags.selector)
+		if err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(capiClusterGVK)
+	if err := mgmtCli.List(context.Background(), list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return fmt.Errorf("listing Cluster API clusters failed: %w", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].GetNamespace()+"/"+list.Items[i].GetName() < list.Items[j].GetNamespace()+"/"+list.Items[j].GetName()
+	})
+
+	var clusters []*utils.Cluster
+	seen := map[string]string{}
+	for _, item := range list.Items {
+		ref := item.GetNamespace() + "/" + item.GetName()
+		if other, exists := seen[item.GetName()]; exists {
+			logger.Warningf("skipping Cluster API cluster %s: name already used by %s", ref, other)
+			continue
+		}
+
+		leafCluster, err := clusterFromCAPI(mgmtCli, &item)
+		if err != nil {
+			logger.Warningf("skipping Cluster API cluster %s: %v", ref, err)
+			continue
+		}
+		seen[item.GetName()] = ref
+		clusters = append(clusters, leafCluster)
+	}
+
+	if len(clusters) == 0 {
+		logger.Warningf("no Cluster API clusters found")
+	}
+
+	if err := addClusters(flags, clusters); err != nil {
+		return err
+	}
+	if addClusterFlags.export {
+		return nil
+	}
+
+	return flagDeletedCAPIClusters(mgmtCli)
+}
+
+// clusterFromCAPI builds a Flamingo cluster from a Cluster API cluster and its kubeconfig secret.
+func clusterFromCAPI(mgmtCli client.Client, item *unstructured.Unstructured) (*utils.Cluster, error) {
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: item.GetNamespace(), Name: item.GetName() + "-kubeconfig"}
+	if err := mgmtCli.Get(context.Background(), key, secret); err != nil {
+		return nil, err
+	}
+
+	config, err := clientcmd.Load(secret.Data["value"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig in secret %s: %w", key.Name, err)
+	}
+
+	leafCluster, err := clusterFromKubeconfig(config, config.CurrentContext, item.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	leafCluster.Labels = map[string]string{}
+	for k, v := range item.GetLabels() {
+		leafCluster.Labels[k] = v
+	}
+	leafCluster.Labels[clusterSourceLabel] = capiClusterSource
+	leafCluster.Annotations = map[string]string{
+		capiClusterAnnotation: item.GetNamespace() + "/" + item.GetName(),
+	}
+
+	return leafCluster, nil
+}
+
+// flagDeletedCAPIClusters annotates the registered Cluster API clusters whose Cluster object has been deleted.
+func flagDeletedCAPIClusters(mgmtCli client.Client) error {
+	registry := utils.NewClusterRegistry(mgmtCli, rootArgs.applicationNamespace)
+	registered, err := registry.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for i := range registered {
+		leafCluster := &registered[i]
+		if leafCluster.Labels[clusterSourceLabel] != capiClusterSource {
+			continue
+		}
+
+		ns, name, found := strings.Cut(leafCluster.Annotations[capiClusterAnnotation], "/")
+		if !found || name == "" {
+			logger.Warningf("cluster %s was added from Cluster API but has no %s annotation, it cannot be checked", leafCluster.Name, capiClusterAnnotation)
+			continue
+		}
+		item := &unstructured.Unstructured{}
+		item.SetGroupVersionKind(capiClusterGVK)
+		err := mgmtCli.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: name}, item)
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		logger.Warningf("cluster %s is registered but its Cluster API object %s/%s has been deleted", leafCluster.Name, ns, name)
+		if leafCluster.Annotations[capiDeletedAnnotation] == "true" {
+			continue
+		}
+		if leafCluster.Annotations == nil {
+			leafCluster.Annotations = map[string]string{}
+		}
+		leafCluster.Annotations[capiDeletedAnnotation] = "true"
+		if err := registry.Add(context.Background(), leafCluster); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestClusterFromKubeconfigName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "dev-1"},
+		{name: "kind-dev.local"},
+		{name: "gke_my-project_europe-west1_dev", wantErr: true},
+		{name: "arn:aws:eks:eu-west-1:123456789012:cluster/dev", wantErr: true},
+		{name: "Dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := clientcmdapi.NewConfig()
+			config.Clusters["dev"] = &clientcmdapi.Cluster{Server: "https://dev.example.com"}
+			config.AuthInfos["dev"] = &clientcmdapi.AuthInfo{Token: "token"}
+			config.Contexts[tt.name] = &clientcmdapi.Context{Cluster: "dev", AuthInfo: "dev"}
+
+			leafCluster, err := clusterFromKubeconfig(config, tt.name, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clusterFromKubeconfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && leafCluster.Name != tt.name {
+				t.Errorf("name = %s, want %s", leafCluster.Name, tt.name)
+			}
+		})
+	}
+}
+
+func TestMergeRegisteredCluster(t *testing.T) {
+	existing := &utils.Cluster{
+		Name:             "dev-1",
+		Server:           "https://old.example.com",
+		Namespaces:       []string{"podinfo"},
+		ClusterResources: true,
+		Project:          "dev",
+		Config:           utils.SecretConfig{ProxyURL: "https://proxy.example.com"},
+		Labels:           map[string]string{"env": "dev", "tier": "frontend"},
+		Annotations:      map[string]string{capiClusterAnnotation: "default/dev-1", capiDeletedAnnotation: "true"},
+	}
+
+	t.Run("keeps settings without flags", func(t *testing.T) {
+		flags := addClusterCmd.Flags()
+		leafCluster := &utils.Cluster{
+			Name:        "dev-1",
+			Server:      "https://new.example.com",
+			Labels:      map[string]string{"env": "staging", clusterSourceLabel: capiClusterSource},
+			Annotations: map[string]string{capiClusterAnnotation: "default/dev-1"},
+		}
+		mergeRegisteredCluster(flags, leafCluster, existing)
+
+		if leafCluster.Server != "https://new.example.com" {
+			t.Errorf("server = %s, want the refreshed server", leafCluster.Server)
+		}
+		wantLabels := map[string]string{"env": "staging", "tier": "frontend", clusterSourceLabel: capiClusterSource}
+		if !reflect.DeepEqual(leafCluster.Labels, wantLabels) {
+			t.Errorf("labels = %v, want %v", leafCluster.Labels, wantLabels)
+		}
+		if _, found := leafCluster.Annotations[capiDeletedAnnotation]; found {
+			t.Errorf("annotation %s kept on a cluster being added", capiDeletedAnnotation)
+		}
+		if !reflect.DeepEqual(leafCluster.Namespaces, existing.Namespaces) || !leafCluster.ClusterResources ||
+			leafCluster.Project != "dev" || leafCluster.Config.ProxyURL != "https://proxy.example.com" {
+			t.Errorf("settings not kept: %+v", leafCluster)
+		}
+	})
+
+	t.Run("overwrites settings set by flags", func(t *testing.T) {
+		flags := addClusterCmd.Flags()
+		defer func() {
+			flags.Lookup("project").Changed = false
+			addClusterFlags.project = ""
+		}()
+		if err := flags.Set("project", "prod"); err != nil {
+			t.Fatal(err)
+		}
+		leafCluster := &utils.Cluster{Name: "dev-1", Project: addClusterFlags.project}
+		mergeRegisteredCluster(flags, leafCluster, existing)
+
+		if leafCluster.Project != "prod" {
+			t.Errorf("project = %s, want prod", leafCluster.Project)
+		}
+		if !reflect.DeepEqual(leafCluster.Namespaces, existing.Namespaces) {
+			t.Errorf("namespaces = %v, want %v", leafCluster.Namespaces, existing.Namespaces)
+		}
+	})
+}
+
+func TestFlagDeletedCAPIClusters(t *testing.T) {
+	var secrets []client.Object
+	for _, leafCluster := range []*utils.Cluster{
+		{
+			Name:        "gone",
+			Server:      "https://gone.example.com",
+			Labels:      map[string]string{clusterSourceLabel: capiClusterSource},
+			Annotations: map[string]string{capiClusterAnnotation: "default/gone"},
+		},
+		{
+			// the annotations were removed by hand
+			Name:   "bare",
+			Server: "https://bare.example.com",
+			Labels: map[string]string{clusterSourceLabel: capiClusterSource},
+		},
+	} {
+		secret, err := leafCluster.Secret(rootArgs.applicationNamespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret.Data = map[string][]byte{}
+		for k, v := range secret.StringData {
+			secret.Data[k] = []byte(v)
+		}
+		secret.StringData = nil
+		secrets = append(secrets, secret)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(utils.NewScheme()).
+		WithRESTMapper(newTestRESTMapper(capiClusterGVK)).
+		WithObjects(secrets...).
+		Build()
+
+	if err := flagDeletedCAPIClusters(c); err != nil {
+		t.Fatal(err)
+	}
+	registry := utils.NewClusterRegistry(c, rootArgs.applicationNamespace)
+	for name, want := range map[string]string{"gone": "true", "bare": ""} {
+		leafCluster, err := registry.Get(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := leafCluster.Annotations[capiDeletedAnnotation]; got != want {
+			t.Errorf("cluster %s: %s = %q, want %q", name, capiDeletedAnnotation, got, want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Manage clusters registered to Flamingo",
+}
+
+func init() {
+	rootCmd.AddCommand(clusterCmd)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var clusterLabelCmd = &cobra.Command{
+	Use:   "label NAME KEY=VALUE ... [KEY-]",
+	Short: "Update the labels of a registered cluster",
+	Long: `
+# Label cluster dev-1 with env=dev
+flamingo cluster label dev-1 env=dev
+
+# Remove the env label from cluster dev-1
+flamingo cluster label dev-1 env-
+
+# Scope cluster dev-1 to the dev project and two namespaces
+flamingo cluster label dev-1 --project=dev --namespaces=podinfo,podinfo-helm
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: clusterLabelCmdRun,
+}
+
+var clusterLabelFlags struct {
+	namespaces       []string
+	clusterResources bool
+	project          string
+}
+
+func init() {
+	clusterLabelCmd.Flags().StringSliceVar(&clusterLabelFlags.namespaces, "namespaces", nil, "comma separated list of namespaces Argo CD is allowed to manage on the cluster")
+	clusterLabelCmd.Flags().BoolVar(&clusterLabelFlags.clusterResources, "cluster-resources", false, "allow Argo CD to manage cluster-scoped resources when namespaces are set")
+	clusterLabelCmd.Flags().StringVar(&clusterLabelFlags.project, "project", "", "restrict the cluster to the given Argo CD project")
+
+	clusterCmd.AddCommand(clusterLabelCmd)
+}
+
+func clusterLabelCmdRun(cmd *cobra.Command, args []string) error {
+	name := args[0]
+
+	cli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+	registry := utils.NewClusterRegistry(cli, rootArgs.applicationNamespace)
+	leafCluster, err := registry.Get(context.Background(), name)
+	if err != nil {
+		return err
+	}
+
+	if err := updateClusterLabels(leafCluster, args[1:]); err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed("namespaces") {
+		leafCluster.Namespaces = clusterLabelFlags.namespaces
+	}
+	if cmd.Flags().Changed("cluster-resources") {
+		leafCluster.ClusterResources = clusterLabelFlags.clusterResources
+	}
+	if cmd.Flags().Changed("project") {
+		leafCluster.Project = clusterLabelFlags.project
+	}
+	if leafCluster.ClusterResources && len(leafCluster.Namespaces) == 0 {
+		return fmt.Errorf("cluster resources can only be enabled when namespaces are set")
+	}
+
+	logger.Actionf("updating cluster secret %s in %s namespace", utils.ClusterSecretName(name), rootArgs.applicationNamespace)
+	if err := registry.Add(context.Background(), leafCluster); err != nil {
+		return err
+	}
+	logger.Successf("cluster %s updated", name)
+
+	return nil
+}
+
+// updateClusterLabels applies key=value pairs and key- removals to the labels of a cluster.
+func updateClusterLabels(cluster *utils.Cluster, args []string) error {
+	var removals []string
+	var pairs []string
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			removals = append(removals, strings.TrimSuffix(arg, "-"))
+		} else {
+			pairs = append(pairs, arg)
+		}
+	}
+	labels, err := parseClusterLabels(pairs)
+	if err != nil {
+		return err
+	}
+	for _, k := range removals {
+		if isReservedClusterLabel(k) {
+			return fmt.Errorf("label %q is managed by Flamingo", k)
+		}
+	}
+
+	if cluster.Labels == nil {
+		cluster.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		cluster.Labels[k] = v
+	}
+	for _, k := range removals {
+		delete(cluster.Labels, k)
+	}
+	return nil
+}
+
+// isReservedClusterLabel reports whether a label is managed by Flamingo or Argo CD on cluster secrets.
+func isReservedClusterLabel(key string) bool {
+	return key == utils.SecretTypeLabel || strings.HasPrefix(key, "flamingo/")
+}
+
+// parseClusterLabels parses key=value pairs into labels, refusing the labels managed by Flamingo.
+func parseClusterLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid label %q, must be in the format key=value", pair)
+		}
+		if e := validation.IsQualifiedName(k); len(e) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", k, strings.Join(e, "; "))
+		}
+		if e := validation.IsValidLabelValue(v); len(e) > 0 {
+			return nil, fmt.Errorf("invalid label value %q: %s", v, strings.Join(e, "; "))
+		}
+		if isReservedClusterLabel(k) {
+			return nil, fmt.Errorf("label %q is managed by Flamingo", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUpdateClusterLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "add", args: []string{"tier=frontend"}, want: map[string]string{"env": "dev", "team": "a", "tier": "frontend"}},
+		{name: "overwrite", args: []string{"env=prod"}, want: map[string]string{"env": "prod", "team": "a"}},
+		{name: "remove", args: []string{"env-"}, want: map[string]string{"team": "a"}},
+		{name: "add and remove", args: []string{"tier=frontend", "team-"}, want: map[string]string{"env": "dev", "tier": "frontend"}},
+		{name: "remove missing", args: []string{"region-"}, want: map[string]string{"env": "dev", "team": "a"}},
+		{name: "invalid value", args: []string{"env=not valid"}, wantErr: true},
+		{name: "missing value", args: []string{"env"}, wantErr: true},
+		{name: "set reserved", args: []string{"flamingo/cluster-name=dev-2"}, wantErr: true},
+		{name: "set reserved prefix", args: []string{"flamingo/synced=true"}, wantErr: true},
+		{name: "set secret type", args: []string{utils.SecretTypeLabel + "=repository"}, wantErr: true},
+		{name: "remove reserved", args: []string{utils.ClusterLabel + "-"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &utils.Cluster{Name: "dev-1", Labels: map[string]string{"env": "dev", "team": "a"}}
+			err := updateClusterLabels(cluster, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("updateClusterLabels() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cluster.Labels, tt.want) {
+				t.Errorf("labels = %v, want %v", cluster.Labels, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterLabelSecret(t *testing.T) {
+	cluster := &utils.Cluster{Name: "dev-1", Server: "https://dev-1.example.com", Labels: map[string]string{"env": "dev"}}
+	secret, err := cluster.Secret(rootArgs.applicationNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data = map[string][]byte{"shard": []byte("1")}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+	c := fake.NewClientBuilder().WithScheme(utils.NewScheme()).WithObjects(secret).Build()
+	registry := utils.NewClusterRegistry(c, rootArgs.applicationNamespace)
+
+	ctx := context.Background()
+	leafCluster, err := registry.Get(ctx, "dev-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateClusterLabels(leafCluster, []string{"tier=frontend", "env-"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Add(ctx, leafCluster); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(secret), updated); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"tier":                 "frontend",
+		utils.SecretTypeLabel:  "cluster",
+		utils.ClusterLabel:     "true",
+		utils.ClusterNameLabel: "dev-1",
+	}
+	if !reflect.DeepEqual(updated.Labels, want) {
+		t.Errorf("secret labels = %v, want %v", updated.Labels, want)
+	}
+	if string(updated.Data["shard"]) != "1" {
+		t.Errorf("shard = %q, want 1", updated.Data["shard"])
+	}
+}
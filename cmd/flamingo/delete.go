@@ -34,11 +34,11 @@ func deleteCmdRun(cmd *cobra.Command, args []string) error {
 
 	namespace := *kubeconfigArgs.Namespace
 	labelSelector := map[string]string{
-		"app.kubernetes.io/managed-by":   "flamingo",
-		"flamingo/destination-namespace": namespace,
+		"app.kubernetes.io/managed-by": "flamingo",
+		workloadNamespaceLabel:         namespace,
 	}
 	if getCmdFlags.all {
-		delete(labelSelector, "flamingo/destination-namespace")
+		delete(labelSelector, workloadNamespaceLabel)
 	}
 	app := &unstructured.Unstructured{}
 	app.SetName(args[0])
@@ -10,13 +10,16 @@ import (
 	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
 	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var generateAppCmd = &cobra.Command{
 	Use:     "generate-app NAME",
 	Aliases: []string{"gen-app"},
-	Args:    cobra.ExactArgs(1),
+	Args:    cobra.MaximumNArgs(1),
 	Short:   "Generate a Flamingo application from Flux resources (Kustomization or HelmRelease)",
 	Long: `
 # Generate a Flamingo application from a Flux Kustomization podinfo in the current namespace (flux-system).
@@ -37,14 +40,45 @@ flamingo generate-app -n podinfo hr/podinfo
 flamingo generate-app \
   --app-name=podinfo-ks \
   -n podinfo-kustomize dev-1/ks/podinfo
+
+# Generate Flamingo applications from all Flux Kustomizations and HelmReleases in the podinfo namespace.
+flamingo generate-app --all -n podinfo
+
+# Generate Flamingo applications from all Flux Kustomizations and HelmReleases labelled with team=dev in all namespaces of the dev-1 cluster.
+flamingo generate-app --all-namespaces --selector=team=dev --cluster=dev-1
+
+# Generate Flamingo applications named after the namespace and name of all Flux Kustomizations and HelmReleases of the dev-1 cluster.
+flamingo generate-app --all-namespaces --cluster=dev-1 --name-strategy='{{ .Cluster }}-{{ .Namespace }}-{{ .Name }}'
+
+# Generate Flamingo applications from the flux-system Kustomization and all the Kustomizations and HelmReleases it applies, as an app of apps.
+flamingo generate-app --recursive ks/flux-system
+
+# Generate Flamingo applications from the Flux objects of a local repository checkout, without reading the cluster.
+flamingo generate-app --all-namespaces --from-dir=./clusters/production --export
+
+# Keep watching all Flux Kustomizations and HelmReleases in the current namespace (flux-system) and sync their applications.
+flamingo generate-app --watch
 `,
 	RunE: generateAppCmdRun,
 }
 
 var generateAppFlags struct {
-	appName string
-	server  string
-	export  bool
+	appName         string
+	server          string
+	export          bool
+	all             bool
+	allNamespaces   bool
+	selector        string
+	cluster         string
+	watch           bool
+	includeSecrets  bool
+	postBuildPlugin string
+	pinRevision     bool
+	fromFiles       []string
+	fromDirs        []string
+	recursive       bool
+	nameStrategy    string
+	annotateSource  bool
 }
 
 func init() {
@@ -52,21 +86,68 @@ func init() {
 	generateAppCmd.Flags().StringVar(&generateAppFlags.appName, "app-name", "", "name of the generated application")
 	generateAppCmd.Flags().StringVar(&generateAppFlags.server, "server", "", "server URL to override the destination cluster")
 	generateAppCmd.Flags().BoolVar(&generateAppFlags.export, "export", false, "export the generated application to stdout")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.all, "all", false, "generate applications for all Kustomizations and HelmReleases in the namespace")
+	generateAppCmd.Flags().BoolVarP(&generateAppFlags.allNamespaces, "all-namespaces", "A", false, "generate applications for all Kustomizations and HelmReleases in all namespaces")
+	generateAppCmd.Flags().StringVar(&generateAppFlags.selector, "selector", "", "label selector to filter Kustomizations and HelmReleases, used with --all or --all-namespaces")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.watch, "watch", false, "keep watching Kustomizations and HelmReleases and sync their applications, like the sync-controller command")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.includeSecrets, "include-secrets", false, "include values read from Secrets in the generated application, the values are written in plain text")
+	generateAppCmd.Flags().StringVar(&generateAppFlags.postBuildPlugin, "post-build-plugin", "", "name of the Argo CD config management plugin substituting the postBuild variables of Kustomizations")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.pinRevision, "pin-revision", false, "use the exact revision of the last artifact fetched by the Flux source as target revision")
+	generateAppCmd.Flags().StringArrayVar(&generateAppFlags.fromFiles, "from-file", nil, "generate applications from the Flux objects of a manifest file instead of the cluster, can be repeated")
+	generateAppCmd.Flags().StringArrayVar(&generateAppFlags.fromDirs, "from-dir", nil, "generate applications from the Flux objects of the manifests in a directory instead of the cluster, can be repeated")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.recursive, "recursive", false, "also generate applications for the Kustomizations and HelmReleases applied by the Kustomization, as an app of apps")
+	generateAppCmd.Flags().StringVar(&generateAppFlags.nameStrategy, "name-strategy", nameStrategyName, "how applications are named after their Flux object: name, namespace-name, cluster-namespace-name, or a Go template like '{{ .Cluster }}-{{ .Name }}'")
+	generateAppCmd.Flags().BoolVar(&generateAppFlags.annotateSource, "annotate-source", false, "annotate the Flux objects with the namespace/name of their application")
+	addAppCustomizeFlags(generateAppCmd.Flags())
+	generateAppCmd.Flags().StringVar(&generateAppFlags.cluster, "cluster", "", "name of the cluster to generate applications from, used with --all or --all-namespaces")
 
 	rootCmd.AddCommand(generateAppCmd)
 }
 
 func generateAppCmdRun(_ *cobra.Command, args []string) error {
-	isValid := false
-	clusterName := ""
-	kindName := ""
-	objectName := ""
+	if err := validateAppCustomizeFlags(); err != nil {
+		return err
+	}
+	if err := validateNameStrategy(); err != nil {
+		return err
+	}
+	if generateAppFlags.watch && isOffline() {
+		return fmt.Errorf("--watch cannot be used with --from-file or --from-dir")
+	}
+	if generateAppFlags.annotateSource && (generateAppFlags.export || isOffline()) {
+		return fmt.Errorf("--annotate-source cannot be used with --export, --from-file or --from-dir")
+	}
+	if generateAppFlags.watch {
+		if len(args) > 0 || generateAppFlags.appName != "" || generateAppFlags.export || generateAppFlags.cluster != "" {
+			return fmt.Errorf("--watch cannot be used with NAME, --app-name, --export or --cluster")
+		}
+		return runSyncController(generateAppFlags.allNamespaces, generateAppFlags.selector)
+	}
+	if generateAppFlags.all || generateAppFlags.allNamespaces {
+		if len(args) > 0 {
+			return fmt.Errorf("NAME cannot be used with --all or --all-namespaces")
+		}
+		if generateAppFlags.appName != "" {
+			return fmt.Errorf("--app-name cannot be used with --all or --all-namespaces")
+		}
+		if generateAppFlags.recursive {
+			return fmt.Errorf("--recursive cannot be used with --all or --all-namespaces")
+		}
+		return generateAllAppsCmdRun()
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("NAME is required")
+	}
+	if generateAppFlags.selector != "" || generateAppFlags.cluster != "" {
+		return fmt.Errorf("--selector and --cluster can only be used with --all or --all-namespaces")
+	}
 
+	clusterName := ""
 	kindSlashName := ""
 	// FQN: fully qualified name is in the format of kind/name cluster-name/kind/name
 	fqn := args[0]
 	if strings.Count(fqn, "/") == 1 {
-		clusterName = "in-cluster"
+		clusterName = utils.InClusterName
 		kindSlashName = fqn
 	} else if strings.Count(fqn, "/") == 2 {
 		clusterName = strings.SplitN(fqn, "/", 2)[0]
@@ -75,6 +156,83 @@ func generateAppCmdRun(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("not a valid Kustomization or HelmRelease resource")
 	}
 
+	kindName, objectName, err := parseKindName(kindSlashName)
+	if err != nil {
+		return err
+	}
+
+	appName := generateAppFlags.appName
+	if appName == "" {
+		appName, err = appNameFor(clusterName, *kubeconfigArgs.Namespace, objectName, kindName)
+		if err != nil {
+			return err
+		}
+	}
+
+	leafCli, cluster, err := clientForCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	var tpl bytes.Buffer
+	if kindName == kustomizev1.KustomizationKind {
+		object := kustomizev1.Kustomization{}
+		key := client.ObjectKey{Namespace: *kubeconfigArgs.Namespace, Name: objectName}
+		if err := leafCli.Get(context.Background(), key, &object); err != nil {
+			return fmt.Errorf("%w in namespace %q", err, key.Namespace)
+		}
+		if err := generateKustomizationApp(leafCli, appName, &object, clusterName, cluster.Server, &tpl); err != nil {
+			return err
+		}
+		if generateAppFlags.recursive {
+			if err := generateChildApps(leafCli, &object, appName, clusterName, cluster.Server, &tpl); err != nil {
+				return err
+			}
+		}
+	} else if kindName == helmv2b1.HelmReleaseKind {
+		if generateAppFlags.recursive {
+			return fmt.Errorf("--recursive can only be used with Kustomizations")
+		}
+		object := helmv2b1.HelmRelease{}
+		key := client.ObjectKey{Namespace: *kubeconfigArgs.Namespace, Name: objectName}
+		if err := leafCli.Get(context.Background(), key, &object); err != nil {
+			return fmt.Errorf("%w in namespace %q", err, key.Namespace)
+		}
+		if err := generateHelmReleaseApp(leafCli, appName, &object, clusterName, cluster.Server, &tpl); err != nil {
+			return err
+		}
+	}
+
+	if generateAppFlags.export {
+		fmt.Print(tpl.String())
+		return nil
+	} else {
+		mgmtCli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+		if err != nil {
+			return err
+		}
+		if err := checkAppNameConflicts(mgmtCli, tpl.Bytes()); err != nil {
+			return err
+		}
+		logger.Actionf("applying generated application %s in %s namespace", appName, rootArgs.applicationNamespace)
+		applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, tpl.Bytes())
+		if err != nil {
+			return fmt.Errorf("install failed: %w", err)
+		}
+		fmt.Fprintln(os.Stderr, applyOutput)
+		if generateAppFlags.annotateSource {
+			if err := annotateSources(leafCli, tpl.Bytes()); err != nil {
+				return fmt.Errorf("annotating Flux objects failed: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseKindName parses a kind/name argument, where kind is a short, singular or plural name
+// of Kustomization or HelmRelease.
+func parseKindName(kindSlashName string) (string, string, error) {
 	// Define a map for valid kinds with their short and full names
 	var validKinds = map[string]string{
 		"ks":             kustomizev1.KustomizationKind,
@@ -84,74 +242,164 @@ func generateAppCmdRun(_ *cobra.Command, args []string) error {
 		"helmrelease":    helmv2b1.HelmReleaseKind,
 		"helmreleases":   helmv2b1.HelmReleaseKind,
 	}
-	// Check if the kindSlashName starts with any of the valid prefixes
-	for shortName, fullName := range validKinds {
-		if strings.HasPrefix(kindSlashName, shortName+"/") {
-			isValid = true
-			kindName = fullName
-			break
-		} else if strings.HasPrefix(kindSlashName, fullName+"/") {
-			isValid = true
-			kindName = fullName
-			break
-		}
+	kind, name, found := strings.Cut(kindSlashName, "/")
+	if !found || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("not a valid Kustomization or HelmRelease resource")
+	}
+	// Kinds are matched case insensitively, like Kustomization/podinfo
+	fullName, ok := validKinds[strings.ToLower(kind)]
+	if !ok {
+		return "", "", fmt.Errorf("not a valid Kustomization or HelmRelease resource")
 	}
+	return fullName, name, nil
+}
 
-	if !isValid {
-		return fmt.Errorf("not a valid Kustomization or HelmRelease resource")
+const (
+	// workloadNamespaceLabel, workloadUIDLabel and workloadAPIVersionAnnotation record the Flux object
+	// an application is generated from, along with the flamingo/workload-* and flamingo/cluster-name labels.
+	workloadNamespaceLabel       = "flamingo/workload-namespace"
+	workloadUIDLabel             = "flamingo/workload-uid"
+	workloadAPIVersionAnnotation = "flamingo/workload-api-version"
+	// destinationNamespaceLabel is the namespace the application deploys to, set from spec.destination.namespace.
+	destinationNamespaceLabel = "flamingo/destination-namespace"
+	// destinationClusterLabel is the Flamingo cluster the application deploys to, when the Flux object
+	// targets a remote cluster through spec.kubeConfig. flamingo/cluster-name stays the cluster of the Flux object.
+	destinationClusterLabel = "flamingo/destination-cluster"
+	// sourceAppAnnotation is set on the Flux object to the namespace/name of its application with --annotate-source.
+	sourceAppAnnotation = "flamingo/application"
+)
+
+// newFlamingoApp returns an application labelled with the Flux object it is generated from,
+// synced by the Flux Subsystem for Argo.
+func newFlamingoApp(appName string, gvk schema.GroupVersionKind, object client.Object, sourceType, clusterName string) *utils.Application {
+	// Objects read through another served version keep the version they were read with
+	if served := object.GetObjectKind().GroupVersionKind(); served.Kind == gvk.Kind && served.Version != "" {
+		gvk = served
+	}
+	app := utils.NewApplication(appName, rootArgs.applicationNamespace)
+	app.Labels = map[string]string{
+		"app.kubernetes.io/managed-by": "flamingo",
+		"flamingo/workload-name":       object.GetName(),
+		"flamingo/workload-type":       gvk.Kind,
+		"flamingo/source-type":         sourceType,
+		"flamingo/cluster-name":        clusterName,
+		workloadNamespaceLabel:         object.GetNamespace(),
+	}
+	// Objects read from manifest files have no UID
+	if object.GetUID() != "" {
+		app.Labels[workloadUIDLabel] = string(object.GetUID())
+	}
+	app.Annotations = map[string]string{
+		"weave.gitops.flamingo/base-url":     "http://localhost:9001",
+		"weave.gitops.flamingo/cluster-name": "Default",
+		workloadAPIVersionAnnotation:         gvk.GroupVersion().String(),
 	}
+	app.Spec.Project = "default"
+	app.Spec.SyncPolicy = &utils.SyncPolicy{
+		SyncOptions: []string{
+			"ApplyOutOfSyncOnly=true",
+			"FluxSubsystem=true",
+		},
+	}
+	return app
+}
 
-	objectName = strings.Split(kindSlashName, "/")[1]
-	appName := generateAppFlags.appName
-	if appName == "" {
-		appName = objectName
+// appWorkloadNamespace returns the namespace of the Flux object of an application from its labels.
+// Applications generated before the workload namespace label recorded it in the destination namespace label.
+func appWorkloadNamespace(labels map[string]string) string {
+	if namespace := labels[workloadNamespaceLabel]; namespace != "" {
+		return namespace
+	}
+	return labels[destinationNamespaceLabel]
+}
+
+// clientForCluster returns a client for the given Flamingo cluster and its registration,
+// the in-cluster name returns the current cluster, or the manifests of --from-file and --from-dir.
+func clientForCluster(clusterName string) (client.Client, *utils.Cluster, error) {
+	if isOffline() {
+		if clusterName != utils.InClusterName && clusterName != "" {
+			return nil, nil, fmt.Errorf("cluster %s cannot be used with --from-file or --from-dir", clusterName)
+		}
+		offlineCli, err := offlineClient(generateAppFlags.fromFiles, generateAppFlags.fromDirs)
+		if err != nil {
+			return nil, nil, err
+		}
+		cluster := &utils.Cluster{
+			Name:   utils.InClusterName,
+			Server: utils.InClusterServer,
+		}
+		if generateAppFlags.server != "" {
+			cluster.Server = generateAppFlags.server
+		}
+		return offlineCli, cluster, nil
 	}
 
 	mgmtCli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	leafCli := mgmtCli
-	var clusterConfig *utils.ClusterConfig
-	if clusterName != "in-cluster" && clusterName != "" {
-		leafCli, clusterConfig, err = utils.KubeClientForLeafCluster(mgmtCli, clusterName, kubeclientOptions)
+	var cluster *utils.Cluster
+	if clusterName != utils.InClusterName && clusterName != "" {
+		registry := utils.NewClusterRegistry(mgmtCli, rootArgs.applicationNamespace)
+		leafCli, cluster, err = registry.ClientFor(context.Background(), clusterName, kubeclientOptions)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		via := ""
+		if cluster.Config.ProxyURL != "" {
+			via = " via proxy " + cluster.Config.ProxyURL
 		}
+		logger.Actionf("connecting to cluster %s at %s%s", clusterName, cluster.CLIAddress(), via)
 	} else {
-		clusterConfig = &utils.ClusterConfig{
-			Server: "https://kubernetes.default.svc",
+		cluster = &utils.Cluster{
+			Name:   utils.InClusterName,
+			Server: utils.InClusterServer,
 		}
 	}
 
 	// Override the server URL if provided
 	if generateAppFlags.server != "" {
-		clusterConfig.Server = generateAppFlags.server
+		cluster.Server = generateAppFlags.server
 	}
 
-	var tpl bytes.Buffer
-	if kindName == kustomizev1.KustomizationKind {
-		if err := generateKustomizationApp(leafCli, appName, objectName, kindName, clusterName, clusterConfig.Server, &tpl); err != nil {
-			return err
-		}
-	} else if kindName == helmv2b1.HelmReleaseKind {
-		if err := generateHelmReleaseApp(leafCli, appName, objectName, kindName, clusterName, clusterConfig.Server, &tpl); err != nil {
-			return err
-		}
+	return leafCli, cluster, nil
+}
+
+// resolveKubeConfigDestination maps a Flux object reconciled through spec.kubeConfig to
+// the Flamingo cluster registered with the same kubeconfig secret, see add-cluster --flux-kubeconfig-namespace.
+// It returns the name and server of that cluster, or an empty name and the server unchanged for other objects.
+func resolveKubeConfigDestination(c client.Client, namespace string, kubeConfig *meta.KubeConfigReference, clusterName string, server string) (string, string, error) {
+	if kubeConfig == nil || kubeConfig.SecretRef.Name == "" {
+		return "", server, nil
+	}
+	// an explicit server always wins
+	if generateAppFlags.server != "" {
+		return "", server, nil
+	}
+	// the registry lives on the cluster running Flamingo
+	if clusterName != utils.InClusterName {
+		logger.Warningf("ignoring spec.kubeConfig of an object on cluster %s, use --server to set the destination", clusterName)
+		return "", server, nil
 	}
 
-	if generateAppFlags.export {
-		fmt.Print(tpl.String())
-		return nil
-	} else {
-		logger.Actionf("applying generated application %s in %s namespace", objectName, rootArgs.applicationNamespace)
-		applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, tpl.Bytes())
-		if err != nil {
-			return fmt.Errorf("install failed: %w", err)
-		}
-		fmt.Fprintln(os.Stderr, applyOutput)
+	registry := utils.NewClusterRegistry(c, rootArgs.applicationNamespace)
+	cluster, err := registry.FindByFluxKubeconfig(context.Background(), namespace, kubeConfig.SecretRef.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if cluster == nil {
+		return "", "", fmt.Errorf("no Flamingo cluster registered for the kubeconfig secret %s/%s, use add-cluster --flux-kubeconfig-namespace or --server",
+			namespace, kubeConfig.SecretRef.Name)
 	}
 
-	return nil
+	logger.Actionf("using cluster %s as destination, from the kubeConfig secret %s/%s", cluster.Name, namespace, kubeConfig.SecretRef.Name)
+	return cluster.Name, cluster.Server, nil
+}
+
+// unsupportedBucketError is returned for Bucket sources, as Argo CD cannot use
+// a bucket, nor the artifact source-controller builds from it, as a repoURL.
+func unsupportedBucketError(namespace, name string) error {
+	return fmt.Errorf("Bucket %s/%s is not supported as a source, Argo CD cannot fetch from buckets: use a GitRepository or an OCIRepository instead", namespace, name)
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	generatedStatus = "generated"
+	skippedStatus   = "skipped"
+	failedStatus    = "failed"
+)
+
+// workload is a Flux object an application is generated from.
+type workload struct {
+	kind      string
+	namespace string
+	name      string
+	appName   string
+	status    string
+	message   string
+
+	kustomization *kustomizev1.Kustomization
+	helmRelease   *helmv2b1.HelmRelease
+}
+
+// generateAllAppsCmdRun generates an application for every Kustomization and HelmRelease
+// matching the flags, and applies them in a single change set.
+func generateAllAppsCmdRun() error {
+	clusterName := generateAppFlags.cluster
+	if clusterName == "" {
+		clusterName = utils.InClusterName
+	}
+
+	leafCli, cluster, err := clientForCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	workloads, err := listWorkloads(leafCli, generateAppFlags.allNamespaces, generateAppFlags.selector)
+	if err != nil {
+		return err
+	}
+	if len(workloads) == 0 {
+		logger.Warningf("no Kustomizations or HelmReleases found")
+		return nil
+	}
+	if err := assignAppNames(workloads, clusterName); err != nil {
+		return err
+	}
+
+	var mgmtCli client.Client
+	if !generateAppFlags.export {
+		mgmtCli, err = utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	all := generateWorkloads(leafCli, mgmtCli, clusterName, cluster.Server, workloads)
+
+	if generateAppFlags.export {
+		fmt.Print(string(all))
+	} else if len(all) > 0 {
+		logger.Actionf("applying generated applications in %s namespace", rootArgs.applicationNamespace)
+		applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, all)
+		if err != nil {
+			return fmt.Errorf("install failed: %w", err)
+		}
+		fmt.Fprintln(os.Stderr, applyOutput)
+		if generateAppFlags.annotateSource {
+			if err := annotateSources(leafCli, all); err != nil {
+				return fmt.Errorf("annotating Flux objects failed: %w", err)
+			}
+		}
+	}
+
+	return printGenerateSummary(workloads)
+}
+
+// generateWorkloads generates the application of each workload not already failed, and returns them as
+// a multi-document YAML. Applications whose name is taken on the management cluster are skipped.
+// The management client is nil on export.
+func generateWorkloads(leafCli, mgmtCli client.Client, clusterName, server string, workloads []*workload) []byte {
+	var all bytes.Buffer
+	for _, w := range workloads {
+		if w.status == failedStatus {
+			continue
+		}
+		var tpl bytes.Buffer
+		if err := w.generate(leafCli, clusterName, server, &tpl); err != nil {
+			w.status, w.message = failedStatus, err.Error()
+			continue
+		}
+		if mgmtCli != nil {
+			objects, err := ssa.ReadObjects(bytes.NewReader(tpl.Bytes()))
+			if err != nil {
+				w.status, w.message = failedStatus, err.Error()
+				continue
+			}
+			conflict, err := appNameConflict(mgmtCli, objects[0])
+			if err != nil {
+				w.status, w.message = failedStatus, err.Error()
+				continue
+			}
+			if conflict != "" {
+				w.status, w.message = skippedStatus, conflict
+				continue
+			}
+		}
+		w.status = generatedStatus
+		all.Write(tpl.Bytes())
+	}
+	return all.Bytes()
+}
+
+// listWorkloads returns the Kustomizations and HelmReleases of the current namespace, or of all namespaces,
+// matching the label selector.
+func listWorkloads(c client.Client, allNamespaces bool, selectorExpr string) ([]*workload, error) {
+	var opts []client.ListOption
+	if !allNamespaces {
+		opts = append(opts, client.InNamespace(*kubeconfigArgs.Namespace))
+	}
+	if selectorExpr != "" {
+		selector, err := labels.Parse(selectorExpr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector: %w", err)
+		}
+		opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+	}
+
+	ksList := &kustomizev1.KustomizationList{}
+	if err := c.List(context.Background(), ksList, opts...); err != nil {
+		return nil, fmt.Errorf("listing Kustomizations failed: %w", err)
+	}
+	hrList := &helmv2b1.HelmReleaseList{}
+	if err := c.List(context.Background(), hrList, opts...); err != nil {
+		return nil, fmt.Errorf("listing HelmReleases failed: %w", err)
+	}
+
+	var workloads []*workload
+	for i := range ksList.Items {
+		object := &ksList.Items[i]
+		workloads = append(workloads, &workload{
+			kind:          kustomizev1.KustomizationKind,
+			namespace:     object.Namespace,
+			name:          object.Name,
+			kustomization: object,
+		})
+	}
+	for i := range hrList.Items {
+		object := &hrList.Items[i]
+		workloads = append(workloads, &workload{
+			kind:        helmv2b1.HelmReleaseKind,
+			namespace:   object.Namespace,
+			name:        object.Name,
+			helmRelease: object,
+		})
+	}
+	return workloads, nil
+}
+
+// object returns the Flux object of the workload.
+func (w *workload) object() client.Object {
+	if w.kustomization != nil {
+		return w.kustomization
+	}
+	return w.helmRelease
+}
+
+// generate generates the application of the workload.
+func (w *workload) generate(c client.Client, clusterName, server string, tpl *bytes.Buffer) error {
+	switch w.kind {
+	case kustomizev1.KustomizationKind:
+		return generateKustomizationApp(c, w.appName, w.kustomization, clusterName, server, tpl)
+	case helmv2b1.HelmReleaseKind:
+		return generateHelmReleaseApp(c, w.appName, w.helmRelease, clusterName, server, tpl)
+	}
+	return fmt.Errorf("unsupported kind %s", w.kind)
+}
+
+// assignAppNames names the applications according to --name-strategy. With the default strategy,
+// the namespace, then the kind, are only added to the names that would otherwise collide.
+// The workloads whose name still collides with another one are marked failed.
+func assignAppNames(workloads []*workload, clusterName string) error {
+	for _, w := range workloads {
+		appName, err := appNameFor(clusterName, w.namespace, w.name, w.kind)
+		if err != nil {
+			return err
+		}
+		w.appName = appName
+	}
+
+	count := map[string]int{}
+	if generateAppFlags.nameStrategy == nameStrategyName {
+		for _, w := range workloads {
+			count[w.appName]++
+		}
+		for _, w := range workloads {
+			if count[w.appName] > 1 {
+				w.appName = toAppName(w.name + "-" + w.namespace)
+			}
+		}
+	}
+
+	count = map[string]int{}
+	for _, w := range workloads {
+		count[w.appName]++
+	}
+	for _, w := range workloads {
+		if count[w.appName] > 1 {
+			if w.kind == kustomizev1.KustomizationKind {
+				w.appName = toAppName(w.appName + "-ks")
+			} else {
+				w.appName = toAppName(w.appName + "-hr")
+			}
+		}
+	}
+
+	owners := map[string][]*workload{}
+	for _, w := range workloads {
+		owners[w.appName] = append(owners[w.appName], w)
+	}
+	for _, w := range workloads {
+		if others := owners[w.appName]; len(others) > 1 {
+			var names []string
+			for _, o := range others {
+				names = append(names, fmt.Sprintf("%s %s/%s", o.kind, o.namespace, o.name))
+			}
+			w.status = failedStatus
+			w.message = fmt.Sprintf("application name %s is used by %s: use --name-strategy to name applications uniquely",
+				w.appName, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// printGenerateSummary prints the outcome of each object and fails if any object failed.
+func printGenerateSummary(workloads []*workload) error {
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tAPP\tSTATUS\tMESSAGE")
+	for _, wl := range workloads {
+		counts[wl.status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", wl.kind, wl.namespace, wl.name, wl.appName, wl.status, wl.message)
+	}
+	w.Flush()
+
+	summary := fmt.Sprintf("%d generated, %d skipped, %d failed", counts[generatedStatus], counts[skippedStatus], counts[failedStatus])
+	if counts[failedStatus] > 0 {
+		return fmt.Errorf("application generation failed: %s", summary)
+	}
+	logger.Successf("%s", summary)
+	return nil
+}
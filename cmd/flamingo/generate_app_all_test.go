@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAssignAppNames(t *testing.T) {
+	ks := func(namespace, name string) *workload {
+		return &workload{kind: kustomizev1.KustomizationKind, namespace: namespace, name: name}
+	}
+	hr := func(namespace, name string) *workload {
+		return &workload{kind: helmv2b1.HelmReleaseKind, namespace: namespace, name: name}
+	}
+
+	tests := []struct {
+		name      string
+		strategy  string
+		workloads []*workload
+		// application names, or "" for the workloads which must fail
+		want []string
+	}{
+		{
+			name:      "unique names",
+			workloads: []*workload{ks("apps", "podinfo"), hr("apps", "redis")},
+			want:      []string{"podinfo", "redis"},
+		},
+		{
+			name:      "same name in two namespaces",
+			workloads: []*workload{ks("apps", "podinfo"), ks("team", "podinfo")},
+			want:      []string{"podinfo-apps", "podinfo-team"},
+		},
+		{
+			name:      "same name and namespace",
+			workloads: []*workload{ks("apps", "podinfo"), hr("apps", "podinfo")},
+			want:      []string{"podinfo-apps-ks", "podinfo-apps-hr"},
+		},
+		{
+			name:      "chain of collisions",
+			workloads: []*workload{ks("apps", "podinfo"), hr("apps", "podinfo"), ks("apps", "podinfo-apps")},
+			want:      []string{"", "podinfo-apps-hr", ""},
+		},
+		{
+			name:      "namespace-name strategy",
+			strategy:  nameStrategyNamespaceName,
+			workloads: []*workload{ks("apps", "podinfo"), hr("apps", "podinfo"), ks("team", "podinfo")},
+			want:      []string{"apps-podinfo-ks", "apps-podinfo-hr", "team-podinfo"},
+		},
+		{
+			name:      "template without the namespace",
+			strategy:  "{{ .Name }}",
+			workloads: []*workload{ks("apps", "podinfo"), ks("team", "podinfo"), hr("team", "podinfo")},
+			want:      []string{"", "", "podinfo-hr"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateAppFlags.nameStrategy = nameStrategyName
+			if tt.strategy != "" {
+				generateAppFlags.nameStrategy = tt.strategy
+			}
+			t.Cleanup(func() { generateAppFlags.nameStrategy = nameStrategyName })
+
+			if err := assignAppNames(tt.workloads, utils.InClusterName); err != nil {
+				t.Fatal(err)
+			}
+			for i, w := range tt.workloads {
+				if tt.want[i] == "" {
+					if w.status != failedStatus || !strings.Contains(w.message, "--name-strategy") {
+						t.Errorf("%s %s/%s: status = %q (%s), want failed", w.kind, w.namespace, w.name, w.status, w.message)
+					}
+					continue
+				}
+				if w.status != "" || w.appName != tt.want[i] {
+					t.Errorf("%s %s/%s: app name = %s, status = %q, want %s", w.kind, w.namespace, w.name, w.appName, w.status, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateWorkloads(t *testing.T) {
+	repo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+		Spec: sourcev1.GitRepositorySpec{
+			URL:       "https://github.com/stefanprodan/podinfo",
+			Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+		},
+	}
+	podinfo := newTestKustomization("podinfo")
+	redis := newTestKustomization("redis")
+	// the source of the broken Kustomization does not exist
+	broken := newTestKustomization("broken")
+	broken.Spec.SourceRef.Name = "missing"
+	// the application name of taken is used by an application not managed by Flamingo
+	taken := newTestKustomization("taken")
+	// both Kustomizations are named podinfo-flux-system-ks
+	collision := newTestKustomization("podinfo-flux-system")
+	release := &helmv2b1.HelmRelease{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"}}
+	leafCli := fake.NewClientBuilder().
+		WithScheme(utils.NewScheme()).
+		WithObjects(repo, podinfo, redis, broken, taken, collision, release).
+		Build()
+
+	mapper := newTestRESTMapper(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+	mgmtCli := fake.NewClientBuilder().
+		WithRESTMapper(mapper).
+		WithObjects(newTestApp("taken", map[string]string{"team": "dev"})).
+		Build()
+
+	workloads, err := listWorkloads(leafCli, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workloads) != 6 {
+		t.Fatalf("listed %d workloads, want 6", len(workloads))
+	}
+	if err := assignAppNames(workloads, utils.InClusterName); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mgmt   bool
+		want   map[string]string
+		failed bool
+	}{
+		{
+			name: "export",
+			want: map[string]string{
+				"Kustomization/broken":              failedStatus,
+				"Kustomization/podinfo":             failedStatus,
+				"Kustomization/podinfo-flux-system": failedStatus,
+				"Kustomization/redis":               generatedStatus,
+				"Kustomization/taken":               generatedStatus,
+				// the HelmRelease has no chart
+				"HelmRelease/podinfo": failedStatus,
+			},
+			failed: true,
+		},
+		{
+			name: "apply",
+			mgmt: true,
+			want: map[string]string{
+				"Kustomization/broken":              failedStatus,
+				"Kustomization/podinfo":             failedStatus,
+				"Kustomization/podinfo-flux-system": failedStatus,
+				"Kustomization/redis":               generatedStatus,
+				"Kustomization/taken":               skippedStatus,
+				"HelmRelease/podinfo":               failedStatus,
+			},
+			failed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batch []*workload
+			for _, w := range workloads {
+				wl := *w
+				batch = append(batch, &wl)
+			}
+			var c client.Client
+			if tt.mgmt {
+				c = mgmtCli
+			}
+
+			all := generateWorkloads(leafCli, c, utils.InClusterName, utils.InClusterServer, batch)
+			for _, w := range batch {
+				key := w.kind + "/" + w.name
+				if w.status != tt.want[key] {
+					t.Errorf("%s: status = %s (%s), want %s", key, w.status, w.message, tt.want[key])
+				}
+				if generated := strings.Contains(string(all), "name: "+w.appName+"\n"); generated != (w.status == generatedStatus) {
+					t.Errorf("%s: application %s in the output = %v, want %v", key, w.appName, generated, !generated)
+				}
+			}
+			if err := printGenerateSummary(batch); (err != nil) != tt.failed {
+				t.Errorf("printGenerateSummary() error = %v, want failure %v", err, tt.failed)
+			}
+		})
+	}
+}
+
+func TestPrintGenerateSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		wantErr  string
+	}{
+		{name: "generated", statuses: []string{generatedStatus, generatedStatus}},
+		{name: "skipped", statuses: []string{generatedStatus, skippedStatus}},
+		{name: "failed", statuses: []string{generatedStatus, skippedStatus, failedStatus}, wantErr: "1 generated, 1 skipped, 1 failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var workloads []*workload
+			for _, status := range tt.statuses {
+				workloads = append(workloads, &workload{kind: kustomizev1.KustomizationKind, namespace: "apps", name: "podinfo", status: status})
+			}
+			err := printGenerateSummary(workloads)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("printGenerateSummary() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("printGenerateSummary() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// annotateSources sets the flamingo/application annotation on the Flux objects of the generated applications.
+func annotateSources(c client.Client, data []byte) error {
+	objects, err := ssa.ReadObjects(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for _, app := range objects {
+		if err := annotateSource(c, app); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotateSource sets the flamingo/application annotation of the Flux object an application is generated from
+// to the namespace/name of the application, so that the application can be found from the Flux object.
+func annotateSource(c client.Client, app *unstructured.Unstructured) error {
+	labels := app.GetLabels()
+	var object client.Object
+	switch labels["flamingo/workload-type"] {
+	case kustomizev1.KustomizationKind:
+		object = &kustomizev1.Kustomization{}
+	case helmv2b1.HelmReleaseKind:
+		object = &helmv2b1.HelmRelease{}
+	default:
+		return nil
+	}
+
+	key := client.ObjectKey{Namespace: labels[workloadNamespaceLabel], Name: labels["flamingo/workload-name"]}
+	if err := c.Get(context.Background(), key, object); err != nil {
+		return err
+	}
+	ref := app.GetNamespace() + "/" + app.GetName()
+	if object.GetAnnotations()[sourceAppAnnotation] == ref {
+		return nil
+	}
+
+	patch := client.MergeFrom(object.DeepCopyObject().(client.Object))
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[sourceAppAnnotation] = ref
+	object.SetAnnotations(annotations)
+	return c.Patch(context.Background(), object, patch)
+}
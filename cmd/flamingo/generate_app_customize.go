@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// appCustomizeFlags override the generated applications, they are shared by all commands generating applications.
+var appCustomizeFlags struct {
+	project     string
+	labels      []string
+	annotations []string
+	syncOptions []string
+	automated   string
+	patchFile   string
+}
+
+func addAppCustomizeFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&appCustomizeFlags.project, "project", "", "Argo CD project of the generated applications, or auto to use the project of the Flux tenant")
+	flags.StringArrayVar(&appCustomizeFlags.labels, "label", nil, "label to set on the generated applications in the format key=value, can be repeated")
+	flags.StringArrayVar(&appCustomizeFlags.annotations, "annotation", nil, "annotation to set on the generated applications in the format key=value, can be repeated")
+	flags.StringArrayVar(&appCustomizeFlags.syncOptions, "sync-option", nil, "sync option to set on the generated applications in the format Option=value, can be repeated")
+	flags.StringVar(&appCustomizeFlags.automated, "automated", "", "enable (true) or disable (false) the automated sync policy of the generated applications")
+	flags.Lookup("automated").NoOptDefVal = "true"
+	flags.StringVar(&appCustomizeFlags.patchFile, "patch-file", "", "path to a kustomize patch applied to the generated applications, a strategic merge patch or a JSON 6902 patch")
+}
+
+// validateAppCustomizeFlags checks the customization flags before generating any application.
+func validateAppCustomizeFlags() error {
+	if appCustomizeFlags.automated != "" && appCustomizeFlags.automated != "true" && appCustomizeFlags.automated != "false" {
+		return fmt.Errorf("invalid --automated value %q, must be true or false", appCustomizeFlags.automated)
+	}
+	if _, err := parseAppLabels(appCustomizeFlags.labels); err != nil {
+		return err
+	}
+	if _, err := parseAppAnnotations(appCustomizeFlags.annotations); err != nil {
+		return err
+	}
+	for _, option := range appCustomizeFlags.syncOptions {
+		if !strings.Contains(option, "=") {
+			return fmt.Errorf("invalid sync option %q, must be in the format Option=value", option)
+		}
+	}
+	if appCustomizeFlags.patchFile != "" {
+		if _, err := os.Stat(appCustomizeFlags.patchFile); err != nil {
+			return fmt.Errorf("unable to read patch file: %w", err)
+		}
+	}
+	return nil
+}
+
+// renderApp applies the customization flags to an application, validates it, and writes it as YAML.
+func renderApp(app *utils.Application, tpl *bytes.Buffer) error {
+	obj, err := app.ToUnstructured()
+	if err != nil {
+		return err
+	}
+	obj, err = customizeApp(obj)
+	if err != nil {
+		return err
+	}
+	// the destination namespace is only final once the application is patched
+	if namespace, _, _ := unstructured.NestedString(obj, "spec", "destination", "namespace"); namespace != "" {
+		if err := unstructured.SetNestedField(obj, namespace, "metadata", "labels", destinationNamespaceLabel); err != nil {
+			return err
+		}
+	}
+	if err := validateApp(obj); err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	tpl.WriteString("---\n")
+	tpl.Write(out)
+	return nil
+}
+
+// customizeApp sets the labels, annotations, sync options and sync policy of an application,
+// then applies the patch file.
+func customizeApp(app map[string]interface{}) (map[string]interface{}, error) {
+	metadata := nestedMap(app, "metadata")
+	spec := nestedMap(app, "spec")
+
+	labels, err := parseAppLabels(appCustomizeFlags.labels)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		nestedMap(metadata, "labels")[k] = v
+	}
+	annotations, err := parseAppAnnotations(appCustomizeFlags.annotations)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range annotations {
+		nestedMap(metadata, "annotations")[k] = v
+	}
+
+	if len(appCustomizeFlags.syncOptions) > 0 {
+		syncPolicy := nestedMap(spec, "syncPolicy")
+		options, _ := syncPolicy["syncOptions"].([]interface{})
+		syncPolicy["syncOptions"] = mergeSyncOptions(options, appCustomizeFlags.syncOptions)
+	}
+	switch appCustomizeFlags.automated {
+	case "true":
+		nestedMap(nestedMap(spec, "syncPolicy"), "automated")
+	case "false":
+		delete(nestedMap(spec, "syncPolicy"), "automated")
+	}
+
+	if appCustomizeFlags.patchFile != "" {
+		return patchApp(app, appCustomizeFlags.patchFile)
+	}
+	return app, nil
+}
+
+// patchApp applies a kustomize patch file to an application: a list of operations is a JSON 6902 patch,
+// otherwise the patch is merged into the application, like a strategic merge patch on a custom resource.
+func patchApp(app map[string]interface{}, patchFile string) (map[string]interface{}, error) {
+	patchData, err := os.ReadFile(patchFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read patch file: %w", err)
+	}
+	patchJSON, err := yaml.YAMLToJSON(patchData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch file %s: %w", patchFile, err)
+	}
+	appJSON, err := yaml.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	appJSON, err = yaml.YAMLToJSON(appJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	if bytes.HasPrefix(bytes.TrimSpace(patchJSON), []byte("[")) {
+		patch, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON 6902 patch in %s: %w", patchFile, err)
+		}
+		patched, err = patch.Apply(appJSON)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply patch %s: %w", patchFile, err)
+		}
+	} else {
+		patched, err = jsonpatch.MergePatch(appJSON, patchJSON)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply patch %s: %w", patchFile, err)
+		}
+	}
+
+	result := map[string]interface{}{}
+	if err := yaml.Unmarshal(patched, &result); err != nil {
+		return nil, err
+	}
+	// Flamingo finds and reconciles its applications with these labels
+	before, after := managedAppLabels(app), managedAppLabels(result)
+	for k, v := range after {
+		if previous, found := before[k]; !found || previous != v {
+			return nil, fmt.Errorf("patch %s changes the label %q managed by Flamingo", patchFile, k)
+		}
+	}
+	for k := range before {
+		if _, found := after[k]; !found {
+			return nil, fmt.Errorf("patch %s removes the label %q managed by Flamingo", patchFile, k)
+		}
+	}
+	return result, nil
+}
+
+// managedAppLabels returns the labels of an application that are managed by Flamingo.
+func managedAppLabels(app map[string]interface{}) map[string]string {
+	labels, _, _ := unstructured.NestedStringMap(app, "metadata", "labels")
+	managed := map[string]string{}
+	for k, v := range labels {
+		if isManagedAppLabel(k) {
+			managed[k] = v
+		}
+	}
+	return managed
+}
+
+// isManagedAppLabel reports whether a label key is managed by Flamingo.
+func isManagedAppLabel(key string) bool {
+	return key == "app.kubernetes.io/managed-by" || strings.HasPrefix(key, "flamingo/")
+}
+
+// mergeSyncOptions sets the sync options, replacing the existing options with the same name.
+func mergeSyncOptions(options []interface{}, overrides []string) []interface{} {
+	for _, override := range overrides {
+		name, _, _ := strings.Cut(override, "=")
+		replaced := false
+		for i, option := range options {
+			if existing, _, _ := strings.Cut(fmt.Sprint(option), "="); existing == name {
+				options[i] = override
+				replaced = true
+			}
+		}
+		if !replaced {
+			options = append(options, override)
+		}
+	}
+	return options
+}
+
+// nestedMap returns the map at key, creating it when missing.
+func nestedMap(m map[string]interface{}, key string) map[string]interface{} {
+	if child, ok := m[key].(map[string]interface{}); ok {
+		return child
+	}
+	child := map[string]interface{}{}
+	m[key] = child
+	return child
+}
+
+// parseAppLabels parses key=value pairs into labels, refusing the labels managed by Flamingo.
+func parseAppLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid label %q, must be in the format key=value", pair)
+		}
+		if e := validation.IsQualifiedName(k); len(e) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", k, strings.Join(e, "; "))
+		}
+		if e := validation.IsValidLabelValue(v); len(e) > 0 {
+			return nil, fmt.Errorf("invalid label value %q: %s", v, strings.Join(e, "; "))
+		}
+		if isManagedAppLabel(k) {
+			return nil, fmt.Errorf("label %q is managed by Flamingo", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// parseAppAnnotations parses key=value pairs into annotations.
+func parseAppAnnotations(pairs []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, pair := range pairs {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid annotation %q, must be in the format key=value", pair)
+		}
+		if e := validation.IsQualifiedName(k); len(e) > 0 {
+			return nil, fmt.Errorf("invalid annotation key %q: %s", k, strings.Join(e, "; "))
+		}
+		annotations[k] = v
+	}
+	return annotations, nil
+}
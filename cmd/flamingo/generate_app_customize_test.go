@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPatchApp(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		check   func(t *testing.T, app map[string]interface{})
+		wantErr string
+	}{
+		{
+			name:  "merge patch",
+			patch: "spec:\n  syncPolicy:\n    retry:\n      limit: 5\n",
+			check: func(t *testing.T, app map[string]interface{}) {
+				if limit, _, _ := unstructured.NestedFloat64(app, "spec", "syncPolicy", "retry", "limit"); limit != 5 {
+					t.Errorf("retry limit = %v, want 5", limit)
+				}
+				if options, _, _ := unstructured.NestedStringSlice(app, "spec", "syncPolicy", "syncOptions"); !reflect.DeepEqual(options, []string{"ApplyOutOfSyncOnly=true"}) {
+					t.Errorf("sync options = %v, not kept", options)
+				}
+			},
+		},
+		{
+			name:  "merge patch removing a field",
+			patch: "spec:\n  syncPolicy:\n    automated: null\n",
+			check: func(t *testing.T, app map[string]interface{}) {
+				if _, found, _ := unstructured.NestedMap(app, "spec", "syncPolicy", "automated"); found {
+					t.Errorf("automated sync policy not removed")
+				}
+			},
+		},
+		{
+			name:  "merge patch setting a label",
+			patch: "metadata:\n  labels:\n    team: a\n",
+			check: func(t *testing.T, app map[string]interface{}) {
+				labels, _, _ := unstructured.NestedStringMap(app, "metadata", "labels")
+				if labels["team"] != "a" || labels[workloadNamespaceLabel] != "podinfo" {
+					t.Errorf("labels = %v", labels)
+				}
+			},
+		},
+		{
+			name:  "JSON 6902 patch",
+			patch: `[{"op": "add", "path": "/spec/syncPolicy/syncOptions/-", "value": "CreateNamespace=true"}]`,
+			check: func(t *testing.T, app map[string]interface{}) {
+				options, _, _ := unstructured.NestedStringSlice(app, "spec", "syncPolicy", "syncOptions")
+				if !reflect.DeepEqual(options, []string{"ApplyOutOfSyncOnly=true", "CreateNamespace=true"}) {
+					t.Errorf("sync options = %v", options)
+				}
+			},
+		},
+		{
+			name:  "JSON 6902 patch in YAML",
+			patch: "- op: replace\n  path: /spec/project\n  value: team-a\n",
+			check: func(t *testing.T, app map[string]interface{}) {
+				if project, _, _ := unstructured.NestedString(app, "spec", "project"); project != "team-a" {
+					t.Errorf("project = %s, want team-a", project)
+				}
+			},
+		},
+		{
+			name:    "invalid YAML",
+			patch:   "spec: [",
+			wantErr: "invalid patch file",
+		},
+		{
+			name:    "invalid JSON 6902 operation",
+			patch:   `[{"op": "move", "path": "/spec/project"}]`,
+			wantErr: "unable to apply patch",
+		},
+		{
+			name:    "JSON 6902 patch of a missing path",
+			patch:   `[{"op": "replace", "path": "/spec/source/chart", "value": "podinfo"}]`,
+			wantErr: "unable to apply patch",
+		},
+		{
+			name:    "merge patch changing a flamingo label",
+			patch:   "metadata:\n  labels:\n    flamingo/workload-namespace: other\n",
+			wantErr: `changes the label "flamingo/workload-namespace" managed by Flamingo`,
+		},
+		{
+			name:    "merge patch adding a flamingo label",
+			patch:   "metadata:\n  labels:\n    flamingo/synced: \"true\"\n",
+			wantErr: `changes the label "flamingo/synced" managed by Flamingo`,
+		},
+		{
+			name:    "JSON 6902 patch removing a flamingo label",
+			patch:   `[{"op": "remove", "path": "/metadata/labels/flamingo~1workload-name"}]`,
+			wantErr: `removes the label "flamingo/workload-name" managed by Flamingo`,
+		},
+		{
+			name:    "JSON 6902 patch changing the managed-by label",
+			patch:   `[{"op": "replace", "path": "/metadata/labels/app.kubernetes.io~1managed-by", "value": "helm"}]`,
+			wantErr: `changes the label "app.kubernetes.io/managed-by" managed by Flamingo`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patchFile := filepath.Join(t.TempDir(), "patch.yaml")
+			if err := os.WriteFile(patchFile, []byte(tt.patch), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			app := map[string]interface{}{
+				"apiVersion": "argoproj.io/v1alpha1",
+				"kind":       "Application",
+				"metadata": map[string]interface{}{
+					"name": "podinfo",
+					"labels": map[string]interface{}{
+						"app.kubernetes.io/managed-by": "flamingo",
+						workloadNamespaceLabel:         "podinfo",
+						"flamingo/workload-name":       "podinfo",
+					},
+				},
+				"spec": map[string]interface{}{
+					"project": "default",
+					"syncPolicy": map[string]interface{}{
+						"automated":   map[string]interface{}{"prune": true},
+						"syncOptions": []interface{}{"ApplyOutOfSyncOnly=true"},
+					},
+				},
+			}
+
+			got, err := patchApp(app, patchFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("patchApp() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestParseAppLabels(t *testing.T) {
+	tests := []struct {
+		pairs   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{pairs: []string{"team=a", "tier=frontend"}, want: map[string]string{"team": "a", "tier": "frontend"}},
+		{pairs: []string{"team"}, wantErr: "must be in the format key=value"},
+		{pairs: []string{"team=a b"}, wantErr: "invalid label value"},
+		{pairs: []string{"flamingo/synced=true"}, wantErr: "is managed by Flamingo"},
+		{pairs: []string{"app.kubernetes.io/managed-by=helm"}, wantErr: "is managed by Flamingo"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.pairs, ","), func(t *testing.T) {
+			got, err := parseAppLabels(tt.pairs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseAppLabels() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAppLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,123 +4,246 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"text/template"
+	"path"
+	"strings"
 
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
 	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const hrAppTemplate = `---
-apiVersion: argoproj.io/v1alpha1
-kind: Application
-metadata:
-  name: {{ .Name }}
-  namespace: {{ .Namespace }}
-  labels:
-    app.kubernetes.io/managed-by: flamingo
-    flamingo/workload-name: {{ .WorkloadName }}
-    flamingo/workload-type: "{{ .WorkloadType }}"
-    flamingo/source-type: "{{ .SourceType }}"
-    flamingo/destination-namespace: "{{ .DestinationNamespace }}"
-    flamingo/cluster-name: "{{ .ClusterName }}"
-  annotations:
-    weave.gitops.flamingo/base-url: "http://localhost:9001"
-    weave.gitops.flamingo/cluster-name: "Default"
-spec:
-  destination:
-    namespace: {{ .DestinationNamespace }}
-    server: {{ .Server }}
-  project: default
-  source:
-    chart: {{ .ChartName }}
-    repoURL: {{ .ChartURL }}
-    targetRevision: "{{ .ChartRevision }}"
-    helm:
-      releaseName: {{ .ReleaseName }}
-  syncPolicy:
-    syncOptions:
-    - ApplyOutOfSyncOnly=true
-    - FluxSubsystem=true
-`
-
-func generateHelmReleaseApp(c client.Client, appName string, objectName string, kindName string, clusterName string, server string, tpl *bytes.Buffer) error {
-	object := helmv2b1.HelmRelease{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      objectName,
-			Namespace: *kubeconfigArgs.Namespace,
-		},
-	}
-	key := client.ObjectKeyFromObject(&object)
-	if err := c.Get(context.Background(), key, &object); err != nil {
-		return fmt.Errorf("%w in namespace %q", err, object.Namespace)
+func generateHelmReleaseApp(c client.Client, appName string, object *helmv2b1.HelmRelease, clusterName string, server string, tpl *bytes.Buffer) error {
+	// Argo CD has no Helm post-renderers, the chart would be deployed without them
+	if len(object.Spec.PostRenderers) > 0 {
+		return fmt.Errorf("HelmRelease %s/%s has post-renderers, which Argo CD does not apply: move the patches into the chart values, or into a Kustomization wrapping the chart",
+			object.Namespace, object.Name)
 	}
 
-	sourceKind := object.Spec.Chart.Spec.SourceRef.Kind
-	sourceName := object.Spec.Chart.Spec.SourceRef.Name
-	sourceNamespace := object.Spec.Chart.Spec.SourceRef.Namespace
-	if sourceNamespace == "" {
-		sourceNamespace = *kubeconfigArgs.Namespace
+	// Objects deploying to a remote cluster target the matching Flamingo cluster
+	destinationCluster, server, err := resolveKubeConfigDestination(c, object.Namespace, object.Spec.KubeConfig, clusterName, server)
+	if err != nil {
+		return err
 	}
 
-	t, err := template.New("template").Parse(hrAppTemplate)
+	chartSource, err := resolveHelmReleaseChart(c, object)
 	if err != nil {
 		return err
 	}
 
-	var params struct {
-		Name                 string
-		Namespace            string
-		WorkloadName         string
-		WorkloadType         string
-		SourceType           string
-		DestinationNamespace string
-		ClusterName          string
+	app := newFlamingoApp(appName, helmv2b1.GroupVersion.WithKind(helmv2b1.HelmReleaseKind), object, chartSource.Kind, clusterName)
+	if destinationCluster != "" {
+		app.Labels[destinationClusterLabel] = destinationCluster
+	}
+	app.Spec.Project, err = appProject(c, object)
+	if err != nil {
+		return err
+	}
+	app.Spec.Destination.Server = server
+	app.Spec.Destination.Namespace = object.GetReleaseNamespace()
 
-		Server string
+	values, err := helmReleaseValues(c, object)
+	if err != nil {
+		return err
+	}
+	app.Spec.Source = &utils.ApplicationSource{
+		RepoURL:        chartSource.RepoURL,
+		Path:           chartSource.Path,
+		Chart:          chartSource.Chart,
+		TargetRevision: chartSource.Revision,
+		Helm: &utils.ApplicationSourceHelm{
+			ReleaseName:  object.GetReleaseName(),
+			ValueFiles:   helmValueFiles(object, chartSource),
+			ValuesObject: values,
+			SkipCrds:     helmSkipCRDs(object),
+		},
+	}
+	if chartSource.Path != "" {
+		app.Spec.Source.Chart = ""
+	}
+	if object.Spec.GetInstall().CreateNamespace {
+		app.Spec.SyncPolicy.SyncOptions = append(app.Spec.SyncPolicy.SyncOptions, "CreateNamespace=true")
+	}
 
-		ChartName     string
-		ChartURL      string
-		ChartRevision string
-		ReleaseName   string
+	if fields := unsupportedHelmReleaseFields(object); len(fields) > 0 {
+		logger.Warningf("HelmRelease %s/%s: ignoring %s, not supported by Argo CD", object.Namespace, object.Name, strings.Join(fields, ", "))
 	}
 
-	params.Name = appName
-	params.Namespace = rootArgs.applicationNamespace
-	params.DestinationNamespace = *kubeconfigArgs.Namespace
+	return renderApp(app, tpl)
+}
+
+// helmChartSource is where Argo CD finds the chart of a HelmRelease.
+// Charts from Helm repositories have a Chart name, charts from Git a Path.
+type helmChartSource struct {
+	Kind     string
+	RepoURL  string
+	Chart    string
+	Path     string
+	Revision string
+}
 
-	params.WorkloadName = object.Name
-	params.WorkloadType = kindName
-	params.SourceType = sourceKind
-	params.ClusterName = clusterName
+// resolveHelmReleaseChart finds the chart of a HelmRelease, either from spec.chart or from spec.chartRef.
+func resolveHelmReleaseChart(c client.Client, object *helmv2b1.HelmRelease) (*helmChartSource, error) {
+	chartSpec := object.Spec.Chart.Spec
+	if chartSpec.Chart != "" {
+		sourceNamespace := chartSpec.SourceRef.Namespace
+		if sourceNamespace == "" {
+			sourceNamespace = object.Namespace
+		}
+		return resolveHelmChartSource(c, chartSpec.SourceRef.Kind, chartSpec.SourceRef.Name, sourceNamespace, chartSpec.Chart, chartSpec.Version)
+	}
 
-	params.Server = server
+	chartRef, err := getHelmReleaseChartRef(c, object)
+	if err != nil {
+		return nil, err
+	}
+	if chartRef == nil {
+		return nil, fmt.Errorf("HelmRelease %s/%s has neither spec.chart nor spec.chartRef", object.Namespace, object.Name)
+	}
+	refNamespace := chartRef.Namespace
+	if refNamespace == "" {
+		refNamespace = object.Namespace
+	}
 
-	params.ChartName = object.Spec.Chart.Spec.Chart
-	params.ChartRevision = object.Spec.Chart.Spec.Version
-	params.ReleaseName = object.Spec.ReleaseName
-	if params.ReleaseName == "" {
-		params.ReleaseName = object.Name
+	switch chartRef.Kind {
+	case sourcev1b2.OCIRepositoryKind:
+		sourceObj := sourcev1b2.OCIRepository{}
+		if err := c.Get(context.Background(), client.ObjectKey{Namespace: refNamespace, Name: chartRef.Name}, &sourceObj); err != nil {
+			return nil, err
+		}
+		revision, err := ociChartVersion(&sourceObj)
+		if err != nil {
+			return nil, err
+		}
+		// oci://registry/path/chart is the chart named chart in the registry/path repository
+		repoURL := strings.TrimPrefix(sourceObj.Spec.URL, "oci://")
+		chart := path.Base(repoURL)
+		return &helmChartSource{
+			Kind:     sourcev1b2.OCIRepositoryKind,
+			RepoURL:  path.Dir(repoURL),
+			Chart:    chart,
+			Revision: revision,
+		}, nil
+	case sourcev1b2.HelmChartKind:
+		helmChart := sourcev1b2.HelmChart{}
+		if err := c.Get(context.Background(), client.ObjectKey{Namespace: refNamespace, Name: chartRef.Name}, &helmChart); err != nil {
+			return nil, err
+		}
+		return resolveHelmChartSource(c, helmChart.Spec.SourceRef.Kind, helmChart.Spec.SourceRef.Name, refNamespace, helmChart.Spec.Chart, helmChart.Spec.Version)
+	default:
+		return nil, fmt.Errorf("unsupported chartRef kind %q in HelmRelease %s/%s", chartRef.Kind, object.Namespace, object.Name)
 	}
+}
 
+// resolveHelmChartSource finds a chart in the given Flux source.
+func resolveHelmChartSource(c client.Client, sourceKind, sourceName, sourceNamespace, chart, version string) (*helmChartSource, error) {
+	sourceKey := client.ObjectKey{Namespace: sourceNamespace, Name: sourceName}
 	switch sourceKind {
 	case sourcev1b2.HelmRepositoryKind:
-		sourceObj := sourcev1b2.HelmRepository{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      sourceName,
-				Namespace: sourceNamespace,
-			},
+		sourceObj := sourcev1b2.HelmRepository{}
+		if err := c.Get(context.Background(), sourceKey, &sourceObj); err != nil {
+			return nil, err
+		}
+		repoURL := sourceObj.Spec.URL
+		// Argo CD expects OCI Helm repositories without the scheme
+		if sourceObj.Spec.Type == sourcev1b2.HelmRepositoryTypeOCI {
+			repoURL = strings.TrimPrefix(repoURL, "oci://")
 		}
-		sourceKey := client.ObjectKeyFromObject(&sourceObj)
+		return &helmChartSource{
+			Kind:     sourceKind,
+			RepoURL:  repoURL,
+			Chart:    chart,
+			Revision: version,
+		}, nil
+	case sourcev1.GitRepositoryKind:
+		sourceObj := sourcev1.GitRepository{}
 		if err := c.Get(context.Background(), sourceKey, &sourceObj); err != nil {
-			return err
+			return nil, err
 		}
-		params.ChartURL = sourceObj.Spec.URL
+		revision, err := getGitRepositorySourceRevision(&sourceObj)
+		if err != nil {
+			return nil, err
+		}
+		return &helmChartSource{
+			Kind:     sourceKind,
+			RepoURL:  sourceObj.Spec.URL,
+			Path:     chartPath(chart),
+			Revision: revision,
+		}, nil
+	case sourcev1b2.BucketKind:
+		return nil, unsupportedBucketError(sourceNamespace, sourceName)
+	default:
+		return nil, fmt.Errorf("unsupported chart source kind %q", sourceKind)
 	}
+}
 
-	if err := t.Execute(tpl, params); err != nil {
-		return err
+// ociChartVersion returns the chart version of an OCIRepository referenced by spec.chartRef.
+// Argo CD pulls OCI charts by version, the tag of the artifact, so neither a digest nor the latest tag
+// source-controller defaults to can be used: those are resolved from the tag of the last fetched artifact.
+func ociChartVersion(source *sourcev1b2.OCIRepository) (string, error) {
+	reference := source.Spec.Reference
+	if reference == nil {
+		reference = &sourcev1b2.OCIRepositoryRef{}
+	}
+	if !generateAppFlags.pinRevision && reference.Digest == "" && (reference.SemVer != "" || reference.Tag != "") {
+		return getOCIRepositorySourceRevision(source)
+	}
+
+	artifactRef, _ := splitArtifactRevision(artifactRevision(source.GetArtifact()))
+	if artifactRef == "" || artifactRef == "latest" {
+		return "", fmt.Errorf("cannot resolve the chart version of OCIRepository %s/%s: set spec.ref.tag or spec.ref.semver, "+
+			"or wait for an artifact with a version tag", source.Namespace, source.Name)
+	}
+	return artifactRef, nil
+}
+
+// chartPath turns the chart of a HelmRelease pointing to a Git source into a path.
+func chartPath(chart string) string {
+	p := path.Clean(strings.TrimPrefix(chart, "./"))
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// helmChartReference is the spec.chartRef of the HelmRelease API versions newer than v2beta1.
+type helmChartReference struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// getHelmReleaseChartRef reads spec.chartRef, which the v2beta1 API does not know,
+// through the newer HelmRelease API versions served by the cluster.
+func getHelmReleaseChartRef(c client.Client, object *helmv2b1.HelmRelease) (*helmChartReference, error) {
+	for _, version := range []string{"v2", "v2beta2"} {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(schema.GroupVersionKind{
+			Group:   helmv2b1.GroupVersion.Group,
+			Version: version,
+			Kind:    helmv2b1.HelmReleaseKind,
+		})
+		err := c.Get(context.Background(), client.ObjectKeyFromObject(object), u)
+		if apimeta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ref, found, err := unstructured.NestedStringMap(u.Object, "spec", "chartRef")
+		if err != nil || !found {
+			return nil, err
+		}
+		return &helmChartReference{
+			Kind:      ref["kind"],
+			Name:      ref["name"],
+			Namespace: ref["namespace"],
+		}, nil
 	}
-	return nil
+	return nil, nil
 }
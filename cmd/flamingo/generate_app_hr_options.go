@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+)
+
+// helmValueFiles returns the values files of the chart of a HelmRelease, relative to the chart,
+// as Argo CD expects them. Flux reads the values files of charts from Git relative to the repository root.
+func helmValueFiles(object *helmv2b1.HelmRelease, chartSource *helmChartSource) []string {
+	chartSpec := object.Spec.Chart.Spec
+	var files []string
+	// the deprecated valuesFile is merged before valuesFiles
+	if chartSpec.ValuesFile != "" {
+		files = append(files, chartSpec.ValuesFile)
+	}
+	files = append(files, chartSpec.ValuesFiles...)
+
+	if chartSource.Path == "" {
+		return files
+	}
+	chartPath := path.Clean(strings.TrimPrefix(chartSource.Path, "./"))
+	for i, file := range files {
+		files[i] = relativePath(chartPath, path.Clean(strings.TrimPrefix(file, "./")))
+	}
+	return files
+}
+
+// relativePath returns the path of target relative to the base directory, both relative to the same root.
+func relativePath(base, target string) string {
+	if base == "." {
+		return target
+	}
+	baseParts := strings.Split(base, "/")
+	targetParts := strings.Split(target, "/")
+	common := 0
+	for common < len(baseParts) && common < len(targetParts)-1 && baseParts[common] == targetParts[common] {
+		common++
+	}
+	parts := make([]string, 0, len(baseParts)-common+len(targetParts)-common)
+	for range baseParts[common:] {
+		parts = append(parts, "..")
+	}
+	return path.Join(append(parts, targetParts[common:]...)...)
+}
+
+// helmSkipCRDs reports whether the chart CRDs are skipped on install,
+// with install.crds, or the deprecated install.skipCRDs when install.crds is not set.
+func helmSkipCRDs(object *helmv2b1.HelmRelease) bool {
+	install := object.Spec.GetInstall()
+	if install.CRDs != "" {
+		return install.CRDs == helmv2b1.Skip
+	}
+	return install.SkipCRDs
+}
+
+// unsupportedHelmReleaseFields lists the fields of a HelmRelease which have no equivalent in Argo CD,
+// as Argo CD renders charts with helm template and keeps no Helm release.
+func unsupportedHelmReleaseFields(object *helmv2b1.HelmRelease) []string {
+	var fields []string
+	if object.Spec.StorageNamespace != "" {
+		fields = append(fields, "spec.storageNamespace")
+	}
+	if object.Spec.MaxHistory != nil {
+		fields = append(fields, "spec.maxHistory")
+	}
+	install := object.Spec.GetInstall()
+	if install.DisableHooks {
+		fields = append(fields, "spec.install.disableHooks")
+	}
+	if install.DisableOpenAPIValidation {
+		fields = append(fields, "spec.install.disableOpenAPIValidation")
+	}
+	upgrade := object.Spec.GetUpgrade()
+	if upgrade.DisableHooks {
+		fields = append(fields, "spec.upgrade.disableHooks")
+	}
+	if upgrade.DisableOpenAPIValidation {
+		fields = append(fields, "spec.upgrade.disableOpenAPIValidation")
+	}
+	// Argo CD applies the chart CRDs on every sync, unless they are skipped altogether
+	if upgrade.CRDs == helmv2b1.Skip && !helmSkipCRDs(object) {
+		fields = append(fields, "spec.upgrade.crds")
+	}
+	if object.Spec.GetTest().Enable {
+		fields = append(fields, "spec.test.enable")
+	}
+	return fields
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestOCIChartVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		reference *sourcev1b2.OCIRepositoryRef
+		revision  string
+		pin       bool
+		want      string
+		wantErr   bool
+	}{
+		{name: "tag", reference: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, revision: "6.5.0@sha256:abc", want: "6.5.0"},
+		{name: "semver", reference: &sourcev1b2.OCIRepositoryRef{SemVer: "6.x"}, revision: "6.5.4@sha256:abc", want: "6.5.4"},
+		{name: "no ref", revision: "6.5.4@sha256:abc", want: "6.5.4"},
+		{name: "no ref with latest artifact", revision: "latest@sha256:abc", wantErr: true},
+		{name: "no ref without artifact", wantErr: true},
+		{name: "digest", reference: &sourcev1b2.OCIRepositoryRef{Digest: "sha256:abc"}, revision: "6.5.0@sha256:abc", want: "6.5.0"},
+		{name: "digest without tag", reference: &sourcev1b2.OCIRepositoryRef{Digest: "sha256:abc"}, revision: "sha256:abc", wantErr: true},
+		{name: "pinned", reference: &sourcev1b2.OCIRepositoryRef{SemVer: "6.x"}, revision: "6.5.4@sha256:abc", pin: true, want: "6.5.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateAppFlags.pinRevision = tt.pin
+			defer func() { generateAppFlags.pinRevision = false }()
+
+			source := &sourcev1b2.OCIRepository{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+				Spec:       sourcev1b2.OCIRepositorySpec{Reference: tt.reference},
+			}
+			if tt.revision != "" {
+				source.Status.Artifact = &sourcev1.Artifact{Revision: tt.revision}
+			}
+			got, err := ociChartVersion(source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ociChartVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ociChartVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	tests := []struct {
+		base   string
+		target string
+		want   string
+	}{
+		{base: ".", target: "values.yaml", want: "values.yaml"},
+		{base: "charts/podinfo", target: "charts/podinfo/values-prod.yaml", want: "values-prod.yaml"},
+		{base: "charts/podinfo", target: "charts/podinfo/envs/prod.yaml", want: "envs/prod.yaml"},
+		{base: "charts/podinfo", target: "values/prod.yaml", want: "../../values/prod.yaml"},
+		{base: "charts/podinfo", target: "charts/values.yaml", want: "../values.yaml"},
+		{base: "charts/podinfo", target: "charts/redis/values.yaml", want: "../redis/values.yaml"},
+		// the last element of the target is a file, never a common directory
+		{base: "charts/podinfo", target: "charts", want: "../../charts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.base+" "+tt.target, func(t *testing.T) {
+			if got := relativePath(tt.base, tt.target); got != tt.want {
+				t.Errorf("relativePath(%q, %q) = %q, want %q", tt.base, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmSkipCRDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		install *helmv2b1.Install
+		want    bool
+	}{
+		{name: "no install"},
+		{name: "create", install: &helmv2b1.Install{CRDs: helmv2b1.Create}},
+		{name: "create replace", install: &helmv2b1.Install{CRDs: helmv2b1.CreateReplace}},
+		{name: "skip", install: &helmv2b1.Install{CRDs: helmv2b1.Skip}, want: true},
+		{name: "deprecated skipCRDs", install: &helmv2b1.Install{SkipCRDs: true}, want: true},
+		{name: "crds over skipCRDs", install: &helmv2b1.Install{CRDs: helmv2b1.Create, SkipCRDs: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := &helmv2b1.HelmRelease{Spec: helmv2b1.HelmReleaseSpec{Install: tt.install}}
+			if got := helmSkipCRDs(object); got != tt.want {
+				t.Errorf("helmSkipCRDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateHelmReleaseAppPostRenderers(t *testing.T) {
+	object := &helmv2b1.HelmRelease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+		Spec: helmv2b1.HelmReleaseSpec{
+			PostRenderers: []helmv2b1.PostRenderer{{Kustomize: &helmv2b1.Kustomize{}}},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(utils.NewScheme()).WithObjects(object).Build()
+
+	var tpl bytes.Buffer
+	err := generateHelmReleaseApp(c, "podinfo", object, utils.InClusterName, utils.InClusterServer, &tpl)
+	if err == nil || !strings.Contains(err.Error(), "HelmRelease flux-system/podinfo has post-renderers") {
+		t.Errorf("generateHelmReleaseApp() error = %v, want a post-renderers error", err)
+	}
+	if tpl.Len() > 0 {
+		t.Errorf("application generated:\n%s", tpl.String())
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
-	"text/template"
 
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
@@ -14,92 +15,90 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const ksAppTemplate = `---
-apiVersion: argoproj.io/v1alpha1
-kind: Application
-metadata:
-  name: {{ .Name }}
-  namespace: {{ .Namespace }}
-  labels:
-    app.kubernetes.io/managed-by: flamingo
-    flamingo/workload-name: {{ .WorkloadName }}
-    flamingo/workload-type: "{{ .WorkloadType }}"
-    flamingo/source-type: "{{ .SourceType }}"
-    flamingo/destination-namespace: "{{ .DestinationNamespace }}"
-    flamingo/cluster-name: "{{ .ClusterName }}"
-  annotations:
-    weave.gitops.flamingo/base-url: "http://localhost:9001"
-    weave.gitops.flamingo/cluster-name: "Default"
-spec:
-  destination:
-    namespace: {{ .DestinationNamespace }}
-    server: {{ .Server }}
-  project: default
-  source:
-    path: {{ .Path }}
-    repoURL: {{ .SourceURL }}
-    targetRevision: "{{ .SourceRevision }}"
-  syncPolicy:
-    syncOptions:
-    - ApplyOutOfSyncOnly=true
-    - FluxSubsystem=true
-`
-
-func generateKustomizationApp(c client.Client, appName string, objectName string, kindName string, clusterName string, server string, tpl *bytes.Buffer) error {
-	object := kustomizev1.Kustomization{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      objectName,
-			Namespace: *kubeconfigArgs.Namespace,
-		},
-	}
-	key := client.ObjectKeyFromObject(&object)
-	if err := c.Get(context.Background(), key, &object); err != nil {
-		return fmt.Errorf("%w in namespace %q", err, object.Namespace)
+func generateKustomizationApp(c client.Client, appName string, object *kustomizev1.Kustomization, clusterName string, server string, tpl *bytes.Buffer) error {
+	// Objects deploying to a remote cluster target the matching Flamingo cluster
+	destinationCluster, server, err := resolveKubeConfigDestination(c, object.Namespace, object.Spec.KubeConfig, clusterName, server)
+	if err != nil {
+		return err
 	}
 
-	sourceKind := object.Spec.SourceRef.Kind
-	sourceName := object.Spec.SourceRef.Name
-	sourceNamespace := object.Spec.SourceRef.Namespace
-	if sourceNamespace == "" {
-		sourceNamespace = *kubeconfigArgs.Namespace
+	app := newFlamingoApp(appName, kustomizev1.GroupVersion.WithKind(kustomizev1.KustomizationKind), object, object.Spec.SourceRef.Kind, clusterName)
+	if destinationCluster != "" {
+		app.Labels[destinationClusterLabel] = destinationCluster
 	}
-
-	t, err := template.New("template").Parse(ksAppTemplate)
+	app.Spec.Project, err = appProject(c, object)
 	if err != nil {
 		return err
 	}
 
-	var params struct {
-		Name                 string
-		Namespace            string
-		WorkloadType         string
-		WorkloadName         string
-		SourceType           string
-		DestinationNamespace string
-		ClusterName          string
+	repoURL, revision, err := resolveKustomizationSource(c, object)
+	if err != nil {
+		return err
+	}
+	// The default path is '.' unless provided by the object
+	path := "."
+	if object.Spec.Path != "" {
+		path = object.Spec.Path
+	}
+	app.Spec.Source = &utils.ApplicationSource{
+		RepoURL:        repoURL,
+		Path:           path,
+		TargetRevision: revision,
+		Kustomize:      kustomizationOptions(object),
+	}
 
-		Server string
+	app.Spec.Destination.Server = server
+	app.Spec.Destination.Namespace = object.Namespace
+	if object.Spec.TargetNamespace != "" {
+		app.Spec.Destination.Namespace = object.Spec.TargetNamespace
+	}
 
-		Path           string
-		SourceURL      string
-		SourceRevision string
+	if object.Spec.Suspend {
+		app.Annotations["flamingo/suspended"] = "true"
+	} else {
+		app.Spec.SyncPolicy.Automated = &utils.SyncPolicyAutomated{Prune: object.Spec.Prune}
+	}
+	if object.Spec.Force {
+		app.Spec.SyncPolicy.SyncOptions = append(app.Spec.SyncPolicy.SyncOptions, "Force=true", "Replace=true")
+	}
+	// Argo CD has no per-application health wait or timeout, they are only recorded
+	if object.Spec.Wait {
+		app.Annotations["flamingo/wait"] = "true"
+	}
+	if object.Spec.Timeout != nil {
+		app.Annotations["flamingo/timeout"] = object.Spec.Timeout.Duration.String()
 	}
 
-	params.Name = appName
-	params.Namespace = rootArgs.applicationNamespace
-	params.DestinationNamespace = *kubeconfigArgs.Namespace
+	if len(object.Spec.DependsOn) > 0 {
+		var deps []string
+		for _, dep := range object.Spec.DependsOn {
+			deps = append(deps, dependencyKey(object.Namespace, dep.Namespace, dep.Name))
+		}
+		app.Annotations["flamingo/depends-on"] = strings.Join(deps, ",")
+		app.Annotations["argocd.argoproj.io/sync-wave"] = strconv.Itoa(kustomizationSyncWave(c, object, map[string]bool{}))
+	}
 
-	params.WorkloadName = object.Name
-	params.WorkloadType = kindName
-	params.SourceType = sourceKind
-	params.ClusterName = clusterName
+	vars, err := kustomizationSubstitutions(c, object)
+	if err != nil {
+		return err
+	}
+	if len(vars) > 0 {
+		app.Spec.Source.Plugin, err = substitutePlugin(object, vars)
+		if err != nil {
+			return err
+		}
+	}
 
-	params.Server = server
+	return renderApp(app, tpl)
+}
 
-	// The default path is '.' unless provided by the object
-	params.Path = "."
-	if object.Spec.Path != "" {
-		params.Path = object.Spec.Path
+// resolveKustomizationSource returns the repository URL and the target revision of the source of a Kustomization.
+func resolveKustomizationSource(c client.Client, object *kustomizev1.Kustomization) (string, string, error) {
+	sourceKind := object.Spec.SourceRef.Kind
+	sourceName := object.Spec.SourceRef.Name
+	sourceNamespace := object.Spec.SourceRef.Namespace
+	if sourceNamespace == "" {
+		sourceNamespace = object.Namespace
 	}
 
 	switch sourceKind {
@@ -112,23 +111,12 @@ func generateKustomizationApp(c client.Client, appName string, objectName string
 		}
 		sourceKey := client.ObjectKeyFromObject(&sourceObj)
 		if err := c.Get(context.Background(), sourceKey, &sourceObj); err != nil {
-			return err
+			return "", "", err
 		}
-		params.SourceURL = sourceObj.Spec.URL
-		params.SourceRevision = getGitRepositorySourceRevision(sourceObj.Spec.Reference)
+		revision, err := getGitRepositorySourceRevision(&sourceObj)
+		return sourceObj.Spec.URL, revision, err
 	case sourcev1b2.BucketKind:
-		sourceObj := sourcev1b2.Bucket{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      sourceName,
-				Namespace: sourceNamespace,
-			},
-		}
-		sourceKey := client.ObjectKeyFromObject(&sourceObj)
-		if err := c.Get(context.Background(), sourceKey, &sourceObj); err != nil {
-			return err
-		}
-		params.SourceURL = getBucketURL(sourceObj.Spec)
-		params.SourceRevision = "HEAD"
+		return "", "", unsupportedBucketError(sourceNamespace, sourceName)
 	case sourcev1b2.OCIRepositoryKind:
 		sourceObj := sourcev1b2.OCIRepository{
 			ObjectMeta: metav1.ObjectMeta{
@@ -138,80 +126,73 @@ func generateKustomizationApp(c client.Client, appName string, objectName string
 		}
 		sourceKey := client.ObjectKeyFromObject(&sourceObj)
 		if err := c.Get(context.Background(), sourceKey, &sourceObj); err != nil {
-			return err
+			return "", "", err
 		}
-		params.SourceURL = sourceObj.Spec.URL
-		params.SourceRevision = getOCIRepositorySourceRevision(sourceObj.Spec.Reference)
-	}
-
-	if err := t.Execute(tpl, params); err != nil {
-		return err
+		revision, err := getOCIRepositorySourceRevision(&sourceObj)
+		return sourceObj.Spec.URL, revision, err
+	default:
+		return "", "", fmt.Errorf("unsupported source kind %q in Kustomization %s/%s", sourceKind, object.Namespace, object.Name)
 	}
-	return nil
 }
 
-func getBucketURL(bs sourcev1b2.BucketSpec) string {
-	switch bs.Provider {
-	case "aws":
-		if bs.Region == "" {
-			return ""
+// kustomizationOptions maps images to the kustomize source options.
+// Kustomization v1 has no namePrefix or nameSuffix, those are left to the kustomization.yaml in the source.
+func kustomizationOptions(object *kustomizev1.Kustomization) *utils.ApplicationSourceKustomize {
+	var images []string
+	for _, image := range object.Spec.Images {
+		newName := image.NewName
+		if newName == "" {
+			newName = image.Name
 		}
-		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bs.BucketName, bs.Region)
-	case "gcp":
-		return fmt.Sprintf("https://storage.googleapis.com/%s/", bs.BucketName)
-	case "azure":
-		return fmt.Sprintf("https://%s.blob.core.windows.net/", bs.BucketName)
-	case "generic":
-		protocol := "https"
-		if bs.Insecure {
-			protocol = "http"
+		switch {
+		case image.Digest != "":
+			images = append(images, fmt.Sprintf("%s=%s@%s", image.Name, newName, image.Digest))
+		case image.NewTag != "":
+			images = append(images, fmt.Sprintf("%s=%s:%s", image.Name, newName, image.NewTag))
+		case image.NewName != "":
+			images = append(images, fmt.Sprintf("%s=%s", image.Name, newName))
 		}
-		// Ensure the endpoint doesn't have a trailing slash.
-		endpoint := strings.TrimRight(bs.Endpoint, "/")
-		return fmt.Sprintf("%s://%s/%s/", protocol, endpoint, bs.BucketName)
-	default:
-		return ""
 	}
-}
-
-func getGitRepositorySourceRevision(reference *sourcev1.GitRepositoryRef) string {
-	if reference == nil {
-		return "master"
+	if len(images) == 0 {
+		return nil
 	}
+	return &utils.ApplicationSourceKustomize{Images: images}
+}
 
-	if reference.Commit != "" {
-		return reference.Commit
-	}
-	if reference.Name != "" {
-		return reference.Name
-	}
-	if reference.SemVer != "" {
-		return reference.SemVer
-	}
-	if reference.Tag != "" {
-		return reference.Tag
-	}
-	if reference.Branch != "" {
-		return reference.Branch
+// kustomizationSyncWave returns the depth of the Kustomization in its dependsOn graph,
+// so that dependencies are synced in earlier waves.
+func kustomizationSyncWave(c client.Client, object *kustomizev1.Kustomization, visiting map[string]bool) int {
+	key := object.Namespace + "/" + object.Name
+	if visiting[key] {
+		logger.Warningf("dependency cycle detected at Kustomization %s", key)
+		return 0
+	}
+	visiting[key] = true
+	defer delete(visiting, key)
+
+	wave := 0
+	for _, dep := range object.Spec.DependsOn {
+		depKey := dependencyKey(object.Namespace, dep.Namespace, dep.Name)
+		depObj := &kustomizev1.Kustomization{}
+		namespace, name, _ := strings.Cut(depKey, "/")
+		if err := c.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, depObj); err != nil {
+			logger.Warningf("could not get dependency %s of Kustomization %s: %v", depKey, key, err)
+			if wave < 1 {
+				wave = 1
+			}
+			continue
+		}
+		if depWave := kustomizationSyncWave(c, depObj, visiting) + 1; depWave > wave {
+			wave = depWave
+		}
 	}
-
-	// the default value of the branch is master
-	return "master"
+	return wave
 }
 
-func getOCIRepositorySourceRevision(reference *sourcev1b2.OCIRepositoryRef) string {
-	if reference == nil {
-		return "latest"
-	}
-	if reference.Digest != "" {
-		return reference.Digest
+// dependencyKey returns the namespace/name of a dependency, defaulting to the namespace of the dependent object.
+func dependencyKey(namespace, depNamespace, depName string) string {
+	if depNamespace == "" {
+		depNamespace = namespace
 	}
-	if reference.SemVer != "" {
-		return reference.SemVer
-	}
-	if reference.Tag != "" {
-		return reference.Tag
-	}
-
-	return "latest"
+	return depNamespace + "/" + depName
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+// newTestKustomization returns a Kustomization of the podinfo GitRepository.
+func newTestKustomization(name string) *kustomizev1.Kustomization {
+	return &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: name},
+		Spec: kustomizev1.KustomizationSpec{
+			Path:      "./kustomize",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{Kind: sourcev1.GitRepositoryKind, Name: "podinfo"},
+		},
+	}
+}
+
+// renderTestApp parses the application generated into tpl.
+func renderTestApp(t *testing.T, tpl *bytes.Buffer) *utils.Application {
+	t.Helper()
+	app := &utils.Application{}
+	if err := yaml.Unmarshal(tpl.Bytes(), app); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestGenerateKustomizationApp(t *testing.T) {
+	repo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+		Spec: sourcev1.GitRepositorySpec{
+			URL:       "https://github.com/stefanprodan/podinfo",
+			Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+		},
+	}
+	crds := newTestKustomization("crds")
+	infra := newTestKustomization("infra")
+	infra.Spec.DependsOn = []meta.NamespacedObjectReference{{Name: "crds"}}
+
+	tests := []struct {
+		name   string
+		modify func(ks *kustomizev1.Kustomization)
+		check  func(t *testing.T, app *utils.Application)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, app *utils.Application) {
+				if got := app.Spec.Destination.Namespace; got != "flux-system" {
+					t.Errorf("destination namespace = %s, want flux-system", got)
+				}
+				if app.Spec.Source.Path != "./kustomize" || app.Spec.Source.TargetRevision != "master" {
+					t.Errorf("source = %+v", app.Spec.Source)
+				}
+				if app.Spec.SyncPolicy.Automated == nil || app.Spec.SyncPolicy.Automated.Prune {
+					t.Errorf("automated = %+v, want automated without prune", app.Spec.SyncPolicy.Automated)
+				}
+				if _, found := app.Annotations["argocd.argoproj.io/sync-wave"]; found {
+					t.Errorf("sync wave set without dependencies")
+				}
+			},
+		},
+		{
+			name:   "targetNamespace",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.TargetNamespace = "podinfo" },
+			check: func(t *testing.T, app *utils.Application) {
+				if got := app.Spec.Destination.Namespace; got != "podinfo" {
+					t.Errorf("destination namespace = %s, want podinfo", got)
+				}
+			},
+		},
+		{
+			name:   "prune",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.Prune = true },
+			check: func(t *testing.T, app *utils.Application) {
+				if app.Spec.SyncPolicy.Automated == nil || !app.Spec.SyncPolicy.Automated.Prune {
+					t.Errorf("automated = %+v, want prune", app.Spec.SyncPolicy.Automated)
+				}
+			},
+		},
+		{
+			name:   "suspend",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.Suspend = true },
+			check: func(t *testing.T, app *utils.Application) {
+				if app.Spec.SyncPolicy.Automated != nil {
+					t.Errorf("automated = %+v, want none", app.Spec.SyncPolicy.Automated)
+				}
+				if app.Annotations["flamingo/suspended"] != "true" {
+					t.Errorf("flamingo/suspended annotation not set")
+				}
+			},
+		},
+		{
+			name:   "force",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.Force = true },
+			check:  wantSyncOptions("Force=true", "Replace=true"),
+		},
+		{
+			name:   "wait",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.Wait = true },
+			check:  wantAnnotation("flamingo/wait", "true"),
+		},
+		{
+			name:   "timeout",
+			modify: func(ks *kustomizev1.Kustomization) { ks.Spec.Timeout = &metav1.Duration{Duration: 5 * time.Minute} },
+			check:  wantAnnotation("flamingo/timeout", "5m0s"),
+		},
+		{
+			name: "images",
+			modify: func(ks *kustomizev1.Kustomization) {
+				ks.Spec.Images = []kustomize.Image{
+					{Name: "podinfo", NewTag: "6.5.0"},
+					{Name: "nginx", NewName: "registry.example.com/nginx", Digest: "sha256:abc"},
+					{Name: "redis", NewName: "registry.example.com/redis"},
+				}
+			},
+			check: func(t *testing.T, app *utils.Application) {
+				want := []string{"podinfo=podinfo:6.5.0", "nginx=registry.example.com/nginx@sha256:abc", "redis=registry.example.com/redis"}
+				if app.Spec.Source.Kustomize == nil || !reflect.DeepEqual(app.Spec.Source.Kustomize.Images, want) {
+					t.Errorf("kustomize = %+v, want images %v", app.Spec.Source.Kustomize, want)
+				}
+			},
+		},
+		{
+			name: "postBuild",
+			modify: func(ks *kustomizev1.Kustomization) {
+				ks.Spec.PostBuild = &kustomizev1.PostBuild{
+					Substitute: map[string]string{"cluster": "dev"},
+					SubstituteFrom: []kustomizev1.SubstituteReference{
+						{Kind: "ConfigMap", Name: "vars"},
+						{Kind: "Secret", Name: "secret-vars"},
+					},
+				}
+			},
+			check: func(t *testing.T, app *utils.Application) {
+				want := &utils.ApplicationSourcePlugin{
+					Name: "envsubst",
+					Env: []utils.EnvEntry{
+						{Name: "cluster", Value: "dev"},
+						{Name: "region", Value: "eu"},
+						{Name: "token", Value: "s3cr3t"},
+					},
+				}
+				if got := app.Spec.Source.Plugin; !reflect.DeepEqual(got, want) {
+					t.Errorf("plugin = %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name: "kubeConfig",
+			modify: func(ks *kustomizev1.Kustomization) {
+				ks.Spec.KubeConfig = &meta.KubeConfigReference{SecretRef: meta.SecretKeyReference{Name: "dev-1-kubeconfig"}}
+			},
+			check: func(t *testing.T, app *utils.Application) {
+				if got := app.Spec.Destination.Server; got != "https://dev-1.example.com" {
+					t.Errorf("destination server = %s, want https://dev-1.example.com", got)
+				}
+				if got := app.Labels["flamingo/cluster-name"]; got != utils.InClusterName {
+					t.Errorf("flamingo/cluster-name = %s, want %s", got, utils.InClusterName)
+				}
+				if got := app.Labels[destinationClusterLabel]; got != "dev-1" {
+					t.Errorf("%s = %s, want dev-1", destinationClusterLabel, got)
+				}
+			},
+		},
+		{
+			name: "dependsOn",
+			modify: func(ks *kustomizev1.Kustomization) {
+				ks.Spec.DependsOn = []meta.NamespacedObjectReference{{Name: "infra"}}
+			},
+			check: func(t *testing.T, app *utils.Application) {
+				if got := app.Annotations["flamingo/depends-on"]; got != "flux-system/infra" {
+					t.Errorf("flamingo/depends-on = %s, want flux-system/infra", got)
+				}
+				// infra depends on crds
+				if got := app.Annotations["argocd.argoproj.io/sync-wave"]; got != "2" {
+					t.Errorf("sync wave = %s, want 2", got)
+				}
+			},
+		},
+	}
+	vars := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "vars"},
+		Data:       map[string]string{"cluster": "prod", "region": "eu"},
+	}
+	secretVars := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "secret-vars"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	}
+	remote := &utils.Cluster{
+		Name:        "dev-1",
+		Server:      "https://dev-1.example.com",
+		Annotations: map[string]string{utils.FluxKubeconfigAnnotation: "flux-system/dev-1-kubeconfig"},
+	}
+	remoteSecret, err := remote.Secret(rootArgs.applicationNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake client does not move stringData into data like the API server
+	remoteSecret.Data = map[string][]byte{}
+	for k, v := range remoteSecret.StringData {
+		remoteSecret.Data[k] = []byte(v)
+	}
+	generateAppFlags.includeSecrets = true
+	generateAppFlags.postBuildPlugin = "envsubst"
+	t.Cleanup(func() {
+		generateAppFlags.includeSecrets = false
+		generateAppFlags.postBuildPlugin = ""
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := newTestKustomization("podinfo")
+			if tt.modify != nil {
+				tt.modify(ks)
+			}
+			c := fake.NewClientBuilder().
+				WithScheme(utils.NewScheme()).
+				WithObjects(repo, crds, infra, vars, secretVars, remoteSecret, ks).
+				Build()
+
+			var tpl bytes.Buffer
+			if err := generateKustomizationApp(c, "podinfo", ks, utils.InClusterName, utils.InClusterServer, &tpl); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, renderTestApp(t, &tpl))
+		})
+	}
+}
+
+// wantSyncOptions checks that the application has each sync option as a separate entry.
+func wantSyncOptions(options ...string) func(t *testing.T, app *utils.Application) {
+	return func(t *testing.T, app *utils.Application) {
+		t.Helper()
+		for _, option := range options {
+			found := false
+			for _, existing := range app.Spec.SyncPolicy.SyncOptions {
+				found = found || existing == option
+			}
+			if !found {
+				t.Errorf("sync options = %v, want %s", app.Spec.SyncPolicy.SyncOptions, option)
+			}
+		}
+	}
+}
+
+// wantAnnotation checks that the application has the annotation, and no Wait or Timeout sync option.
+func wantAnnotation(key, value string) func(t *testing.T, app *utils.Application) {
+	return func(t *testing.T, app *utils.Application) {
+		t.Helper()
+		if got := app.Annotations[key]; got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+		for _, option := range app.Spec.SyncPolicy.SyncOptions {
+			if strings.HasPrefix(option, "Wait=") || strings.HasPrefix(option, "Timeout=") {
+				t.Errorf("sync options = %v, want no %s option", app.Spec.SyncPolicy.SyncOptions, option)
+			}
+		}
+	}
+}
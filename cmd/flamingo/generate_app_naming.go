@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/fluxcd/pkg/ssa"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	nameStrategyName                 = "name"
+	nameStrategyNamespaceName        = "namespace-name"
+	nameStrategyClusterNamespaceName = "cluster-namespace-name"
+)
+
+// invalidAppNameChars are the characters replaced by a dash in application names.
+var invalidAppNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// appNameParams are the fields available to a --name-strategy template.
+type appNameParams struct {
+	Cluster   string
+	Namespace string
+	Name      string
+	Kind      string
+}
+
+// validateNameStrategy checks the --name-strategy flag before generating any application.
+func validateNameStrategy() error {
+	_, err := appNameFor(utils.InClusterName, "flux-system", "podinfo", "Kustomization")
+	return err
+}
+
+// appNameFor names the application of a Flux object according to --name-strategy.
+// Strategies other than the built-in ones are Go templates, e.g. {{ .Cluster }}-{{ .Name }}.
+func appNameFor(cluster, namespace, name, kind string) (string, error) {
+	var parts []string
+	switch strategy := generateAppFlags.nameStrategy; strategy {
+	case nameStrategyName:
+		parts = []string{name}
+	case nameStrategyNamespaceName:
+		parts = []string{namespace, name}
+	case nameStrategyClusterNamespaceName:
+		parts = []string{cluster, namespace, name}
+	default:
+		if !strings.Contains(strategy, "{{") {
+			return "", fmt.Errorf("invalid name strategy %q, must be %s, %s, %s or a Go template",
+				strategy, nameStrategyName, nameStrategyNamespaceName, nameStrategyClusterNamespaceName)
+		}
+		t, err := template.New("name").Option("missingkey=error").Parse(strategy)
+		if err != nil {
+			return "", fmt.Errorf("invalid name strategy template: %w", err)
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, appNameParams{Cluster: cluster, Namespace: namespace, Name: name, Kind: kind}); err != nil {
+			return "", fmt.Errorf("invalid name strategy template: %w", err)
+		}
+		parts = []string{out.String()}
+	}
+
+	appName := toAppName(strings.Join(parts, "-"))
+	if appName == "" {
+		return "", fmt.Errorf("name strategy %q gives an empty application name for %s %s/%s", generateAppFlags.nameStrategy, kind, namespace, name)
+	}
+	return appName, nil
+}
+
+// toAppName turns a name into a DNS-1123 label, so that it is also a valid label value, like the
+// app.kubernetes.io/instance label Argo CD tracks resources with. Names too long are truncated,
+// and suffixed with a hash of the full name to keep them unique.
+func toAppName(name string) string {
+	appName := strings.Trim(invalidAppNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(appName) <= validation.DNS1123LabelMaxLength {
+		return appName
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(appName[:validation.DNS1123LabelMaxLength-len(hash)-1], "-") + "-" + hash
+}
+
+// appNameConflict returns why the application cannot be applied under its name, that is
+// an application with the same name exists and is not managed by Flamingo, or belongs to
+// a different Flux object, according to its flamingo/workload-type, flamingo/workload-name,
+// flamingo/workload-namespace and flamingo/cluster-name labels. It returns an empty string when the name can be used.
+func appNameConflict(c client.Client, app *unstructured.Unstructured) (string, error) {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Application",
+	})
+	err := c.Get(context.Background(), client.ObjectKey{Namespace: rootArgs.applicationNamespace, Name: app.GetName()}, existing)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	labels := existing.GetLabels()
+	if labels["app.kubernetes.io/managed-by"] != "flamingo" {
+		return fmt.Sprintf("application %s exists and is not managed by Flamingo", app.GetName()), nil
+	}
+	namespace := appWorkloadNamespace(labels)
+	owned := namespace == appWorkloadNamespace(app.GetLabels())
+	for _, key := range []string{"flamingo/workload-type", "flamingo/workload-name", "flamingo/cluster-name"} {
+		owned = owned && labels[key] == app.GetLabels()[key]
+	}
+	if !owned {
+		return fmt.Sprintf("application %s belongs to %s %s/%s on cluster %s", app.GetName(),
+			labels["flamingo/workload-type"], namespace, labels["flamingo/workload-name"], labels["flamingo/cluster-name"]), nil
+	}
+	return "", nil
+}
+
+// checkAppNameConflicts fails if any of the generated applications would overwrite the application of another Flux object.
+func checkAppNameConflicts(c client.Client, data []byte) error {
+	objects, err := ssa.ReadObjects(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for _, app := range objects {
+		conflict, err := appNameConflict(c, app)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			return fmt.Errorf("%s, use --app-name or --name-strategy to pick another name", conflict)
+		}
+	}
+	return nil
+}
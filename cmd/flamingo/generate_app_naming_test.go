@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestApp(name string, labels map[string]string) *unstructured.Unstructured {
+	app := &unstructured.Unstructured{}
+	app.SetGroupVersionKind(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+	app.SetNamespace(rootArgs.applicationNamespace)
+	app.SetName(name)
+	app.SetLabels(labels)
+	return app
+}
+
+func TestAppNameConflict(t *testing.T) {
+	owner := map[string]string{
+		"app.kubernetes.io/managed-by": "flamingo",
+		"flamingo/workload-type":       "Kustomization",
+		"flamingo/workload-name":       "podinfo",
+		workloadNamespaceLabel:         "flux-system",
+		"flamingo/cluster-name":        "in-cluster",
+	}
+	with := func(key, value string) map[string]string {
+		labels := map[string]string{}
+		for k, v := range owner {
+			labels[k] = v
+		}
+		if value == "" {
+			delete(labels, key)
+		} else {
+			labels[key] = value
+		}
+		return labels
+	}
+
+	// applications generated before the workload namespace label
+	legacy := with(workloadNamespaceLabel, "")
+	legacy[destinationNamespaceLabel] = "flux-system"
+
+	tests := []struct {
+		name     string
+		existing map[string]string
+		conflict bool
+	}{
+		{name: "same object", existing: owner},
+		{name: "legacy namespace label", existing: legacy},
+		{name: "no application", existing: nil},
+		{name: "not managed by flamingo", existing: with("app.kubernetes.io/managed-by", ""), conflict: true},
+		{name: "other kind", existing: with("flamingo/workload-type", "HelmRelease"), conflict: true},
+		{name: "other name", existing: with("flamingo/workload-name", "podinfo-2"), conflict: true},
+		{name: "other namespace", existing: with(workloadNamespaceLabel, "team"), conflict: true},
+		{name: "other cluster", existing: with("flamingo/cluster-name", "dev-1"), conflict: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := newTestRESTMapper(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+			builder := fake.NewClientBuilder().WithRESTMapper(mapper)
+			if tt.existing != nil {
+				builder = builder.WithObjects(newTestApp("podinfo", tt.existing))
+			}
+			c := builder.Build()
+
+			reason, err := appNameConflict(c, newTestApp("podinfo", owner))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (reason != "") != tt.conflict {
+				t.Errorf("appNameConflict() = %q, want conflict %v", reason, tt.conflict)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// isOffline reports whether applications are generated from manifests instead of the cluster.
+func isOffline() bool {
+	return len(generateAppFlags.fromFiles) > 0 || len(generateAppFlags.fromDirs) > 0
+}
+
+// offlineClient returns an in-memory client holding the objects of the manifest files and directories,
+// so that Flux objects are resolved against each other like in a cluster.
+// Only Flux objects, ConfigMaps, Secrets and Namespaces are read, other objects like the workloads deployed by Flux are ignored.
+func offlineClient(files, dirs []string) (client.Client, error) {
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != dir && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch filepath.Ext(path) {
+			case ".yaml", ".yml", ".json":
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read directory %s: %w", dir, err)
+		}
+	}
+
+	scheme := utils.NewScheme()
+	objects := map[string]client.Object{}
+	var keys []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifest: %w", err)
+		}
+		decoder := k8syaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+		for {
+			u := &unstructured.Unstructured{}
+			if err := decoder.Decode(&u.Object); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("invalid manifest %s: %w", file, err)
+			}
+			if len(u.Object) == 0 || !isOfflineKind(u) {
+				continue
+			}
+			// Flux objects of other API versions are read as the version of the Flamingo scheme
+			gvk, known := utils.SchemeGVK(scheme, u.GroupVersionKind())
+			if !known {
+				continue
+			}
+
+			typed, err := scheme.New(gvk)
+			if err != nil {
+				return nil, err
+			}
+			if err := apiruntime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed); err != nil {
+				return nil, fmt.Errorf("invalid %s %s in %s: %w", u.GetKind(), u.GetName(), file, err)
+			}
+			object, ok := typed.(client.Object)
+			if !ok {
+				continue
+			}
+			if object.GetNamespace() == "" && u.GetKind() != "Namespace" {
+				object.SetNamespace(*kubeconfigArgs.Namespace)
+			}
+
+			key := fmt.Sprintf("%s/%s/%s", u.GroupVersionKind().GroupKind(), object.GetNamespace(), object.GetName())
+			if _, found := objects[key]; found {
+				logger.Warningf("%s %s/%s is defined more than once, using the one of %s", u.GetKind(), object.GetNamespace(), object.GetName(), file)
+			} else {
+				keys = append(keys, key)
+			}
+			objects[key] = object
+		}
+	}
+
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for _, key := range keys {
+		builder = builder.WithObjects(objects[key])
+	}
+	return builder.Build(), nil
+}
+
+// isOfflineKind reports whether the object is needed to generate applications.
+func isOfflineKind(u *unstructured.Unstructured) bool {
+	gvk := u.GroupVersionKind()
+	if strings.HasSuffix(gvk.Group, ".toolkit.fluxcd.io") {
+		return true
+	}
+	return gvk.Group == "" && (gvk.Kind == "ConfigMap" || gvk.Kind == "Secret" || gvk.Kind == "Namespace")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TestOfflineClient reads the manifests of testdata/offline.
+func TestOfflineClient(t *testing.T) {
+	namespace, previous := *kubeconfigArgs.Namespace, logger
+	*kubeconfigArgs.Namespace = "flux-system"
+	var stderr bytes.Buffer
+	logger = stderrLogger{stderr: &stderr}
+	t.Cleanup(func() {
+		*kubeconfigArgs.Namespace = namespace
+		logger = previous
+	})
+
+	dir := filepath.Join("testdata", "offline")
+	c, err := offlineClient(nil, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// multi-document YAML, with the default namespace applied to namespaced objects only
+	ks := &kustomizev1.Kustomization{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "flux-system", Name: "podinfo"}, ks); err != nil {
+		t.Errorf("Kustomization of an older API version not read in the default namespace: %v", err)
+	} else if ks.Spec.SourceRef.Name != "podinfo" {
+		t.Errorf("Kustomization sourceRef = %+v", ks.Spec.SourceRef)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: "podinfo"}, &corev1.Namespace{}); err != nil {
+		t.Errorf("Namespace not read: %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "podinfo", Name: "podinfo"}, &appsv1.Deployment{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Deployment read, error = %v, want not found", err)
+	}
+
+	// multi-document JSON
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "podinfo", Name: "podinfo-values"}, cm); err != nil {
+		t.Errorf("ConfigMap not read: %v", err)
+	} else if cm.Data["replicaCount"] != "2" {
+		t.Errorf("ConfigMap data = %v", cm.Data)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "podinfo", Name: "podinfo"}, &helmv2b1.HelmRelease{}); err != nil {
+		t.Errorf("HelmRelease not read: %v", err)
+	}
+
+	// duplicate objects are reported, the last one read wins
+	repo := &sourcev1.GitRepository{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "flux-system", Name: "podinfo"}, repo); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Spec.URL != "https://github.com/stefanprodan/podinfo" {
+		t.Errorf("GitRepository url = %s, want the one of clusters/dev", repo.Spec.URL)
+	}
+	wantWarning := "GitRepository flux-system/podinfo is defined more than once, using the one of " + filepath.Join(dir, "clusters", "dev", "flux-system.yaml")
+	if !strings.Contains(stderr.String(), wantWarning) {
+		t.Errorf("warnings = %q, want %q", stderr.String(), wantWarning)
+	}
+
+	// dot-directories are skipped, unless their files are given explicitly
+	hiddenKey := client.ObjectKey{Namespace: "flux-system", Name: "hidden"}
+	if err := c.Get(ctx, hiddenKey, &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Secret of a dot-directory read, error = %v, want not found", err)
+	}
+	c, err = offlineClient([]string{filepath.Join(dir, ".hidden", "secret.yaml")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, hiddenKey, &corev1.Secret{}); err != nil {
+		t.Errorf("Secret of a file not read: %v", err)
+	}
+}
+
+func TestOfflineClientInvalidManifest(t *testing.T) {
+	if _, err := offlineClient([]string{filepath.Join("testdata", "offline", "missing.yaml")}, nil); err == nil || !strings.Contains(err.Error(), "unable to read manifest") {
+		t.Errorf("offlineClient() error = %v, want unable to read manifest", err)
+	}
+	if _, err := offlineClient(nil, []string{filepath.Join("testdata", "offline", "missing")}); err == nil || !strings.Contains(err.Error(), "unable to read directory") {
+		t.Errorf("offlineClient() error = %v, want unable to read directory", err)
+	}
+}
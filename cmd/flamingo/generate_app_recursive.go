@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// parentAppLabel holds the name of the application of the parent Kustomization.
+const parentAppLabel = "flamingo/parent-app"
+
+// inventoryObject is a Kustomization or HelmRelease found in the inventory of a Kustomization.
+type inventoryObject struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// childAppGenerator generates the applications of a Kustomization tree.
+type childAppGenerator struct {
+	client      client.Client
+	clusterName string
+	server      string
+	visited     map[string]bool
+	appNames    map[string]bool
+}
+
+// generateChildApps generates the applications of the Kustomizations and HelmReleases applied by a Kustomization,
+// as found in its status.inventory, recursively. Each application is linked to the application of its parent,
+// so that Argo CD shows them as an app of apps.
+func generateChildApps(c client.Client, root *kustomizev1.Kustomization, rootApp string, clusterName, server string, tpl *bytes.Buffer) error {
+	if root.Status.Inventory == nil {
+		logger.Warningf("Kustomization %s/%s has no inventory, its children cannot be found", root.Namespace, root.Name)
+		return nil
+	}
+	g := &childAppGenerator{
+		client:      c,
+		clusterName: clusterName,
+		server:      server,
+		visited:     map[string]bool{kustomizev1.KustomizationKind + "/" + root.Namespace + "/" + root.Name: true},
+		appNames:    map[string]bool{rootApp: true},
+	}
+	return g.generate(root, rootApp, tpl)
+}
+
+func (g *childAppGenerator) generate(parent *kustomizev1.Kustomization, parentApp string, tpl *bytes.Buffer) error {
+	// Kustomizations not reconciled yet have no inventory
+	if parent.Status.Inventory == nil {
+		return nil
+	}
+
+	for _, child := range inventoryChildren(parent.Status.Inventory) {
+		key := child.kind + "/" + child.namespace + "/" + child.name
+		if g.visited[key] {
+			continue
+		}
+		g.visited[key] = true
+
+		appName, err := g.childAppName(child)
+		if err != nil {
+			return err
+		}
+		objectKey := client.ObjectKey{Namespace: child.namespace, Name: child.name}
+		var buf bytes.Buffer
+		var childKs *kustomizev1.Kustomization
+		switch child.kind {
+		case kustomizev1.KustomizationKind:
+			childKs = &kustomizev1.Kustomization{}
+			if err := g.client.Get(context.Background(), objectKey, childKs); err != nil {
+				return fmt.Errorf("child %s: %w", key, err)
+			}
+			if err := generateKustomizationApp(g.client, appName, childKs, g.clusterName, g.server, &buf); err != nil {
+				return fmt.Errorf("child %s: %w", key, err)
+			}
+		case helmv2b1.HelmReleaseKind:
+			hr := &helmv2b1.HelmRelease{}
+			if err := g.client.Get(context.Background(), objectKey, hr); err != nil {
+				return fmt.Errorf("child %s: %w", key, err)
+			}
+			if err := generateHelmReleaseApp(g.client, appName, hr, g.clusterName, g.server, &buf); err != nil {
+				return fmt.Errorf("child %s: %w", key, err)
+			}
+		}
+
+		linked, err := linkChildApp(buf.Bytes(), parentApp)
+		if err != nil {
+			return err
+		}
+		tpl.Write(linked)
+		logger.Actionf("generated application %s for %s, child of %s", appName, key, parentApp)
+
+		if childKs != nil {
+			if err := g.generate(childKs, appName, tpl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// childAppName names the application according to --name-strategy. With the default strategy,
+// the namespace, then the kind, are added on collisions. It fails when all the names are taken.
+func (g *childAppGenerator) childAppName(child inventoryObject) (string, error) {
+	appName, err := appNameFor(g.clusterName, child.namespace, child.name, child.kind)
+	if err != nil {
+		return "", err
+	}
+	suffix := "-ks"
+	if child.kind == helmv2b1.HelmReleaseKind {
+		suffix = "-hr"
+	}
+	candidates := []string{appName}
+	if generateAppFlags.nameStrategy == nameStrategyName {
+		appName = toAppName(child.name + "-" + child.namespace)
+		candidates = append(candidates, appName)
+	}
+	candidates = append(candidates, toAppName(appName+suffix))
+	for _, name := range candidates {
+		if !g.appNames[name] {
+			g.appNames[name] = true
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("cannot name the application of %s %s/%s, %s are already used: use --name-strategy to name applications uniquely",
+		child.kind, child.namespace, child.name, strings.Join(candidates, ", "))
+}
+
+// inventoryChildren returns the Kustomizations and HelmReleases of an inventory.
+// Inventory IDs are in the namespace_name_group_kind format.
+func inventoryChildren(inventory *kustomizev1.ResourceInventory) []inventoryObject {
+	var children []inventoryObject
+	for _, entry := range inventory.Entries {
+		parts := strings.Split(entry.ID, "_")
+		if len(parts) != 4 {
+			continue
+		}
+		namespace, name, group, kind := parts[0], parts[1], parts[2], parts[3]
+		if (group == kustomizev1.GroupVersion.Group && kind == kustomizev1.KustomizationKind) ||
+			(group == helmv2b1.GroupVersion.Group && kind == helmv2b1.HelmReleaseKind) {
+			children = append(children, inventoryObject{kind: kind, namespace: namespace, name: name})
+		}
+	}
+	return children
+}
+
+// linkChildApp makes the parent application track the child application, with both the label and the annotation
+// tracking methods of Argo CD. The child is never pruned by its parent, as it is not part of the parent's source.
+func linkChildApp(data []byte, parentApp string) ([]byte, error) {
+	app := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &app); err != nil {
+		return nil, fmt.Errorf("unable to read the generated application: %w", err)
+	}
+	metadata := nestedMap(app, "metadata")
+	labels := nestedMap(metadata, "labels")
+	labels[parentAppLabel] = parentApp
+	labels["app.kubernetes.io/instance"] = parentApp
+
+	annotations := nestedMap(metadata, "annotations")
+	annotations["argocd.argoproj.io/tracking-id"] = fmt.Sprintf("%s:argoproj.io/Application:%s/%s", parentApp, metadata["namespace"], metadata["name"])
+	annotations["argocd.argoproj.io/compare-options"] = "IgnoreExtraneous"
+	annotations["argocd.argoproj.io/sync-options"] = "Prune=false"
+
+	out, err := yaml.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), out...), nil
+}
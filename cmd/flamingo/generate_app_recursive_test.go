@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestChildAppName(t *testing.T) {
+	g := &childAppGenerator{clusterName: "in-cluster", appNames: map[string]bool{"podinfo": true}}
+
+	children := []struct {
+		child inventoryObject
+		want  string
+	}{
+		{child: inventoryObject{kind: kustomizev1.KustomizationKind, namespace: "apps", name: "podinfo"}, want: "podinfo-apps"},
+		{child: inventoryObject{kind: helmv2b1.HelmReleaseKind, namespace: "apps", name: "podinfo"}, want: "podinfo-apps-hr"},
+		{child: inventoryObject{kind: kustomizev1.KustomizationKind, namespace: "apps", name: "podinfo-apps"}, want: "podinfo-apps-apps"},
+	}
+	for _, tt := range children {
+		got, err := g.childAppName(tt.child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("childAppName(%v) = %q, want %q", tt.child, got, tt.want)
+		}
+	}
+
+	// podinfo, podinfo-apps and podinfo-apps-hr are all taken
+	if got, err := g.childAppName(inventoryObject{kind: helmv2b1.HelmReleaseKind, namespace: "apps", name: "podinfo"}); err == nil {
+		t.Errorf("childAppName() = %q, want an error for a name already used", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+)
+
+// defaultGitRevision makes Argo CD follow the default branch of the repository.
+const defaultGitRevision = "HEAD"
+
+// getGitRepositorySourceRevision returns the target revision of a GitRepository.
+// With --pin-revision, it is the commit of the artifact last fetched by source-controller.
+// The reference fields are used in the order of precedence of source-controller:
+// commit, name, semver, tag and branch.
+func getGitRepositorySourceRevision(source *sourcev1.GitRepository) (string, error) {
+	artifactRef, artifactDigest := splitArtifactRevision(artifactRevision(source.GetArtifact()))
+
+	if generateAppFlags.pinRevision {
+		if artifactDigest == "" {
+			return "", fmt.Errorf("cannot pin the revision of GitRepository %s/%s, it has no artifact", source.Namespace, source.Name)
+		}
+		return digestValue(artifactDigest), nil
+	}
+
+	reference := source.Spec.Reference
+	if reference == nil {
+		reference = &sourcev1.GitRepositoryRef{}
+	}
+
+	switch {
+	case reference.Commit != "":
+		return reference.Commit, nil
+	case reference.Name != "":
+		return strings.TrimPrefix(strings.TrimPrefix(reference.Name, "refs/heads/"), "refs/tags/"), nil
+	case reference.SemVer != "":
+		if artifactRef == "" {
+			logger.Warningf("GitRepository %s/%s has no artifact to resolve the semver range %q, using the range as target revision", source.Namespace, source.Name, reference.SemVer)
+			return reference.SemVer, nil
+		}
+		return strings.TrimPrefix(artifactRef, "refs/tags/"), nil
+	case reference.Tag != "":
+		return reference.Tag, nil
+	case reference.Branch != "":
+		return reference.Branch, nil
+	}
+
+	// Without a reference, source-controller checks out the branch reported in the artifact
+	if artifactRef != "" {
+		return strings.TrimPrefix(artifactRef, "refs/heads/"), nil
+	}
+	return defaultGitRevision, nil
+}
+
+// getOCIRepositorySourceRevision returns the target revision of an OCIRepository.
+// With --pin-revision, it is the digest of the artifact last fetched by source-controller.
+// The reference fields are used in the order of precedence of source-controller:
+// digest, semver and tag.
+func getOCIRepositorySourceRevision(source *sourcev1b2.OCIRepository) (string, error) {
+	artifactRef, artifactDigest := splitArtifactRevision(artifactRevision(source.GetArtifact()))
+
+	if generateAppFlags.pinRevision {
+		if artifactDigest == "" {
+			return "", fmt.Errorf("cannot pin the revision of OCIRepository %s/%s, it has no artifact", source.Namespace, source.Name)
+		}
+		// legacy artifact revisions carry the sha256 digest without its algorithm
+		if !strings.Contains(artifactDigest, ":") {
+			return "sha256:" + artifactDigest, nil
+		}
+		return artifactDigest, nil
+	}
+
+	reference := source.Spec.Reference
+	if reference == nil {
+		reference = &sourcev1b2.OCIRepositoryRef{}
+	}
+
+	switch {
+	case reference.Digest != "":
+		// Digests are kept with their algorithm, e.g. sha256:...
+		if !strings.Contains(reference.Digest, ":") {
+			return "", fmt.Errorf("invalid digest %q in OCIRepository %s/%s", reference.Digest, source.Namespace, source.Name)
+		}
+		return reference.Digest, nil
+	case reference.SemVer != "":
+		if artifactRef == "" {
+			logger.Warningf("OCIRepository %s/%s has no artifact to resolve the semver range %q, using the range as target revision", source.Namespace, source.Name, reference.SemVer)
+			return reference.SemVer, nil
+		}
+		return artifactRef, nil
+	case reference.Tag != "":
+		return reference.Tag, nil
+	}
+
+	return "latest", nil
+}
+
+func artifactRevision(artifact *sourcev1.Artifact) string {
+	if artifact == nil {
+		return ""
+	}
+	return artifact.Revision
+}
+
+// splitArtifactRevision splits an artifact revision into its reference and digest.
+// It supports the current format, <ref>@<algo>:<digest> or <algo>:<digest>,
+// and the legacy format, <ref>/<digest>.
+func splitArtifactRevision(revision string) (string, string) {
+	if revision == "" {
+		return "", ""
+	}
+	if i := strings.LastIndex(revision, "@"); i >= 0 {
+		return revision[:i], revision[i+1:]
+	}
+	if strings.Contains(revision, ":") {
+		return "", revision
+	}
+	if i := strings.LastIndex(revision, "/"); i >= 0 {
+		return revision[:i], revision[i+1:]
+	}
+	return "", revision
+}
+
+// digestValue strips the algorithm from a digest, e.g. sha1:abc becomes abc.
+func digestValue(digest string) string {
+	if _, value, found := strings.Cut(digest, ":"); found {
+		return value
+	}
+	return digest
+}
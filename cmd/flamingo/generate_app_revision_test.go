@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testGitCommit = "5b6f0ef7c3b1e2b1f8f7d4d2a6c3f6f4e1b2c3d4"
+	testOCIDigest = "sha256:2f5a9b3e1c4d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+)
+
+// withPinRevision sets --pin-revision for the duration of the test.
+func withPinRevision(t *testing.T, pin bool) {
+	t.Helper()
+	previous := generateAppFlags.pinRevision
+	generateAppFlags.pinRevision = pin
+	t.Cleanup(func() { generateAppFlags.pinRevision = previous })
+}
+
+func TestSplitArtifactRevision(t *testing.T) {
+	tests := []struct {
+		revision   string
+		wantRef    string
+		wantDigest string
+	}{
+		{revision: "", wantRef: "", wantDigest: ""},
+		{revision: "main@sha1:" + testGitCommit, wantRef: "main", wantDigest: "sha1:" + testGitCommit},
+		{revision: "refs/heads/main@sha1:" + testGitCommit, wantRef: "refs/heads/main", wantDigest: "sha1:" + testGitCommit},
+		{revision: "6.5.0@" + testOCIDigest, wantRef: "6.5.0", wantDigest: testOCIDigest},
+		{revision: "sha1:" + testGitCommit, wantRef: "", wantDigest: "sha1:" + testGitCommit},
+		{revision: "main/" + testGitCommit, wantRef: "main", wantDigest: testGitCommit},
+		{revision: "feature/x/" + testGitCommit, wantRef: "feature/x", wantDigest: testGitCommit},
+		{revision: testGitCommit, wantRef: "", wantDigest: testGitCommit},
+	}
+	for _, tt := range tests {
+		ref, digest := splitArtifactRevision(tt.revision)
+		if ref != tt.wantRef || digest != tt.wantDigest {
+			t.Errorf("splitArtifactRevision(%q) = %q, %q, want %q, %q", tt.revision, ref, digest, tt.wantRef, tt.wantDigest)
+		}
+	}
+}
+
+func TestGetGitRepositorySourceRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      *sourcev1.GitRepositoryRef
+		revision string
+		pin      bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "commit", ref: &sourcev1.GitRepositoryRef{Commit: testGitCommit, Branch: "main"}, want: testGitCommit},
+		{name: "name", ref: &sourcev1.GitRepositoryRef{Name: "refs/heads/release", Tag: "v1.0.0"}, want: "release"},
+		{name: "name tag", ref: &sourcev1.GitRepositoryRef{Name: "refs/tags/v1.0.0"}, want: "v1.0.0"},
+		{name: "semver", ref: &sourcev1.GitRepositoryRef{SemVer: ">=1.0.0", Tag: "v0.1.0"}, revision: "v1.2.0@sha1:" + testGitCommit, want: "v1.2.0"},
+		{name: "semver legacy", ref: &sourcev1.GitRepositoryRef{SemVer: ">=1.0.0"}, revision: "v1.2.0/" + testGitCommit, want: "v1.2.0"},
+		{name: "semver without artifact", ref: &sourcev1.GitRepositoryRef{SemVer: ">=1.0.0"}, want: ">=1.0.0"},
+		{name: "tag", ref: &sourcev1.GitRepositoryRef{Tag: "v1.0.0", Branch: "main"}, want: "v1.0.0"},
+		{name: "branch", ref: &sourcev1.GitRepositoryRef{Branch: "main"}, want: "main"},
+		{name: "no ref", revision: "refs/heads/develop@sha1:" + testGitCommit, want: "develop"},
+		{name: "no ref legacy", revision: "develop/" + testGitCommit, want: "develop"},
+		{name: "no ref without artifact", want: defaultGitRevision},
+		{name: "pin", ref: &sourcev1.GitRepositoryRef{Branch: "main"}, revision: "main@sha1:" + testGitCommit, pin: true, want: testGitCommit},
+		{name: "pin legacy", ref: &sourcev1.GitRepositoryRef{Branch: "main"}, revision: "main/" + testGitCommit, pin: true, want: testGitCommit},
+		{name: "pin without artifact", ref: &sourcev1.GitRepositoryRef{Branch: "main"}, pin: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPinRevision(t, tt.pin)
+			source := &sourcev1.GitRepository{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+				Spec:       sourcev1.GitRepositorySpec{Reference: tt.ref},
+			}
+			if tt.revision != "" {
+				source.Status.Artifact = &sourcev1.Artifact{Revision: tt.revision}
+			}
+
+			got, err := getGitRepositorySourceRevision(source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getGitRepositorySourceRevision() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getGitRepositorySourceRevision() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOCIRepositorySourceRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      *sourcev1b2.OCIRepositoryRef
+		revision string
+		pin      bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "digest", ref: &sourcev1b2.OCIRepositoryRef{Digest: testOCIDigest, SemVer: ">=6.0.0", Tag: "6.5.0"}, want: testOCIDigest},
+		{name: "digest without algorithm", ref: &sourcev1b2.OCIRepositoryRef{Digest: "2f5a9b3e"}, wantErr: true},
+		{name: "semver", ref: &sourcev1b2.OCIRepositoryRef{SemVer: ">=6.0.0", Tag: "6.5.0"}, revision: "6.6.0@" + testOCIDigest, want: "6.6.0"},
+		{name: "semver legacy", ref: &sourcev1b2.OCIRepositoryRef{SemVer: ">=6.0.0"}, revision: "6.6.0/" + digestValue(testOCIDigest), want: "6.6.0"},
+		{name: "semver without artifact", ref: &sourcev1b2.OCIRepositoryRef{SemVer: ">=6.0.0"}, want: ">=6.0.0"},
+		{name: "tag", ref: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, revision: "6.5.0@" + testOCIDigest, want: "6.5.0"},
+		{name: "no ref", want: "latest"},
+		{name: "pin", ref: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, revision: "6.5.0@" + testOCIDigest, pin: true, want: testOCIDigest},
+		{name: "pin digest only", ref: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, revision: testOCIDigest, pin: true, want: testOCIDigest},
+		{name: "pin legacy", ref: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, revision: "6.5.0/" + digestValue(testOCIDigest), pin: true, want: testOCIDigest},
+		{name: "pin without artifact", ref: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"}, pin: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPinRevision(t, tt.pin)
+			source := &sourcev1b2.OCIRepository{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+				Spec:       sourcev1b2.OCIRepositorySpec{Reference: tt.ref},
+			}
+			if tt.revision != "" {
+				source.Status.Artifact = &sourcev1.Artifact{Revision: tt.revision}
+			}
+
+			got, err := getOCIRepositorySourceRevision(source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getOCIRepositorySourceRevision() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getOCIRepositorySourceRevision() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
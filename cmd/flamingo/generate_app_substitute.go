@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// kustomizationSubstitutions resolves the postBuild variables of a Kustomization the way kustomize-controller does:
+// the substituteFrom references in order, then the inline substitute variables on top.
+// Variables from Secrets are only read when --include-secrets is set.
+func kustomizationSubstitutions(c client.Client, object *kustomizev1.Kustomization) (map[string]string, error) {
+	if object.Spec.PostBuild == nil {
+		return nil, nil
+	}
+
+	vars := map[string]string{}
+	for _, ref := range object.Spec.PostBuild.SubstituteFrom {
+		namespacedName := object.Namespace + "/" + ref.Name
+		key := client.ObjectKey{Namespace: object.Namespace, Name: ref.Name}
+		switch ref.Kind {
+		case "ConfigMap":
+			cm := &corev1.ConfigMap{}
+			err := c.Get(context.Background(), key, cm)
+			if apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get substitution variables from ConfigMap %s: %w", namespacedName, err)
+			}
+			for k, v := range cm.Data {
+				vars[k] = v
+			}
+		case "Secret":
+			if !generateAppFlags.includeSecrets {
+				logger.Warningf("substitution variables from Secret %s are not included in the application, use --include-secrets to include them", namespacedName)
+				continue
+			}
+			secret := &corev1.Secret{}
+			err := c.Get(context.Background(), key, secret)
+			if apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get substitution variables from Secret %s: %w", namespacedName, err)
+			}
+			logger.Warningf("substitution variables from Secret %s are written in plain text into the application", namespacedName)
+			for k, v := range secret.Data {
+				vars[k] = string(v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported substitution reference kind %q for %s", ref.Kind, namespacedName)
+		}
+	}
+
+	for k, v := range object.Spec.PostBuild.Substitute {
+		vars[k] = v
+	}
+
+	if len(vars) == 0 {
+		return nil, nil
+	}
+	return vars, nil
+}
+
+// substitutePlugin passes the postBuild variables to the config management plugin set with --post-build-plugin,
+// as Argo CD does not substitute variables itself. Argo CD exposes them to the plugin as ARGOCD_ENV_<name>.
+func substitutePlugin(object *kustomizev1.Kustomization, vars map[string]string) (*utils.ApplicationSourcePlugin, error) {
+	if generateAppFlags.postBuildPlugin == "" {
+		return nil, fmt.Errorf("Kustomization %s/%s has postBuild variables, which Argo CD does not substitute: use --post-build-plugin to render it with a config management plugin",
+			object.Namespace, object.Name)
+	}
+	if len(object.Spec.Images) > 0 {
+		return nil, fmt.Errorf("Kustomization %s/%s has both images and postBuild variables, an application source cannot use kustomize options with a plugin",
+			object.Namespace, object.Name)
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	plugin := &utils.ApplicationSourcePlugin{Name: generateAppFlags.postBuildPlugin}
+	for _, name := range names {
+		plugin.Env = append(plugin.Env, utils.EnvEntry{Name: name, Value: vars[name]})
+	}
+	return plugin, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/apis/kustomize"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKustomizationSubstitutions(t *testing.T) {
+	first := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "first"},
+		Data:       map[string]string{"cluster": "dev", "region": "eu"},
+	}
+	second := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "second"},
+		Data:       map[string]string{"region": "us"},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "secret"},
+		Data:       map[string][]byte{"region": []byte("ap"), "token": []byte("s3cr3t")},
+	}
+	ref := func(kind, name string, optional bool) kustomizev1.SubstituteReference {
+		return kustomizev1.SubstituteReference{Kind: kind, Name: name, Optional: optional}
+	}
+
+	tests := []struct {
+		name           string
+		refs           []kustomizev1.SubstituteReference
+		substitute     map[string]string
+		includeSecrets bool
+		want           map[string]string
+		wantErr        string
+	}{
+		{
+			name: "references in order",
+			refs: []kustomizev1.SubstituteReference{ref("ConfigMap", "first", false), ref("ConfigMap", "second", false)},
+			want: map[string]string{"cluster": "dev", "region": "us"},
+		},
+		{
+			name: "reversed references",
+			refs: []kustomizev1.SubstituteReference{ref("ConfigMap", "second", false), ref("ConfigMap", "first", false)},
+			want: map[string]string{"cluster": "dev", "region": "eu"},
+		},
+		{
+			name:       "inline variables on top",
+			refs:       []kustomizev1.SubstituteReference{ref("ConfigMap", "first", false)},
+			substitute: map[string]string{"cluster": "prod"},
+			want:       map[string]string{"cluster": "prod", "region": "eu"},
+		},
+		{
+			name: "missing optional reference",
+			refs: []kustomizev1.SubstituteReference{ref("ConfigMap", "missing", true), ref("Secret", "missing", true), ref("ConfigMap", "first", false)},
+			// the optional Secret is only looked up with --include-secrets
+			includeSecrets: true,
+			want:           map[string]string{"cluster": "dev", "region": "eu"},
+		},
+		{
+			name:    "missing reference",
+			refs:    []kustomizev1.SubstituteReference{ref("ConfigMap", "missing", false)},
+			wantErr: "ConfigMap flux-system/missing",
+		},
+		{
+			name: "secret without --include-secrets",
+			refs: []kustomizev1.SubstituteReference{ref("ConfigMap", "first", false), ref("Secret", "secret", false)},
+			want: map[string]string{"cluster": "dev", "region": "eu"},
+		},
+		{
+			name:           "secret with --include-secrets",
+			refs:           []kustomizev1.SubstituteReference{ref("ConfigMap", "first", false), ref("Secret", "secret", false)},
+			includeSecrets: true,
+			want:           map[string]string{"cluster": "dev", "region": "ap", "token": "s3cr3t"},
+		},
+		{
+			name:    "unsupported kind",
+			refs:    []kustomizev1.SubstituteReference{ref("Bucket", "vars", false)},
+			wantErr: `unsupported substitution reference kind "Bucket"`,
+		},
+		{
+			name: "no variables",
+			refs: []kustomizev1.SubstituteReference{ref("ConfigMap", "missing", true)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateAppFlags.includeSecrets = tt.includeSecrets
+			t.Cleanup(func() { generateAppFlags.includeSecrets = false })
+
+			ks := newTestKustomization("podinfo")
+			ks.Spec.PostBuild = &kustomizev1.PostBuild{Substitute: tt.substitute, SubstituteFrom: tt.refs}
+			c := fake.NewClientBuilder().
+				WithScheme(utils.NewScheme()).
+				WithObjects(first, second, secret).
+				Build()
+
+			got, err := kustomizationSubstitutions(c, ks)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("kustomizationSubstitutions() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kustomizationSubstitutions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstitutePlugin(t *testing.T) {
+	vars := map[string]string{"region": "eu", "cluster": "dev"}
+
+	tests := []struct {
+		name    string
+		plugin  string
+		images  []kustomize.Image
+		want    *utils.ApplicationSourcePlugin
+		wantErr string
+	}{
+		{
+			name:   "variables sorted by name",
+			plugin: "envsubst",
+			want: &utils.ApplicationSourcePlugin{
+				Name: "envsubst",
+				Env:  []utils.EnvEntry{{Name: "cluster", Value: "dev"}, {Name: "region", Value: "eu"}},
+			},
+		},
+		{
+			name:    "no plugin",
+			wantErr: "use --post-build-plugin",
+		},
+		{
+			name:    "images",
+			plugin:  "envsubst",
+			images:  []kustomize.Image{{Name: "podinfo", NewTag: "6.5.0"}},
+			wantErr: "both images and postBuild variables",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateAppFlags.postBuildPlugin = tt.plugin
+			t.Cleanup(func() { generateAppFlags.postBuildPlugin = "" })
+
+			ks := newTestKustomization("podinfo")
+			ks.Spec.Images = tt.images
+			got, err := substitutePlugin(ks, vars)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("substitutePlugin() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("substitutePlugin() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/fluxcd/pkg/apis/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestResolveKubeConfigDestination(t *testing.T) {
+	leafCluster := &utils.Cluster{
+		Name:        "dev-1",
+		Server:      "https://dev-1.example.com",
+		Annotations: map[string]string{utils.FluxKubeconfigAnnotation: "flux-system/dev-1-kubeconfig"},
+	}
+	secret, err := leafCluster.Secret(rootArgs.applicationNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data = map[string][]byte{}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+	c := fake.NewClientBuilder().WithScheme(utils.NewScheme()).WithObjects(secret).Build()
+
+	kubeConfig := func(name string) *meta.KubeConfigReference {
+		return &meta.KubeConfigReference{SecretRef: meta.SecretKeyReference{Name: name}}
+	}
+
+	tests := []struct {
+		name        string
+		kubeConfig  *meta.KubeConfigReference
+		serverFlag  string
+		clusterName string
+		wantCluster string
+		wantServer  string
+		wantErr     string
+	}{
+		{
+			name:        "no kubeConfig",
+			clusterName: utils.InClusterName,
+			wantServer:  utils.InClusterServer,
+		},
+		{
+			name:        "registered kubeConfig secret",
+			kubeConfig:  kubeConfig("dev-1-kubeconfig"),
+			clusterName: utils.InClusterName,
+			wantCluster: "dev-1",
+			wantServer:  "https://dev-1.example.com",
+		},
+		{
+			name:        "server flag",
+			kubeConfig:  kubeConfig("dev-1-kubeconfig"),
+			serverFlag:  "https://other.example.com",
+			clusterName: utils.InClusterName,
+			wantServer:  utils.InClusterServer,
+		},
+		{
+			name:        "object on a leaf cluster",
+			kubeConfig:  kubeConfig("dev-1-kubeconfig"),
+			clusterName: "dev-2",
+			wantServer:  utils.InClusterServer,
+		},
+		{
+			name:        "unregistered kubeConfig secret",
+			kubeConfig:  kubeConfig("dev-2-kubeconfig"),
+			clusterName: utils.InClusterName,
+			wantErr:     "no Flamingo cluster registered for the kubeconfig secret flux-system/dev-2-kubeconfig",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateAppFlags.server = tt.serverFlag
+			t.Cleanup(func() { generateAppFlags.server = "" })
+
+			gotCluster, gotServer, err := resolveKubeConfigDestination(c, "flux-system", tt.kubeConfig, tt.clusterName, utils.InClusterServer)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolveKubeConfigDestination() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCluster != tt.wantCluster || gotServer != tt.wantServer {
+				t.Errorf("resolveKubeConfigDestination() = %q, %q, want %q, %q", gotCluster, gotServer, tt.wantCluster, tt.wantServer)
+			}
+		})
+	}
+}
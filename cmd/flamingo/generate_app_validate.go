@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+)
+
+var appValidator struct {
+	once      sync.Once
+	validator *utils.ApplicationValidator
+}
+
+// applicationValidator returns the validator of the Application CRD installed in the cluster running Flamingo,
+// or nil when the schema cannot be read, in which case only the required fields are validated.
+func applicationValidator() *utils.ApplicationValidator {
+	appValidator.once.Do(func() {
+		if isOffline() {
+			return
+		}
+		c, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+		if err == nil {
+			appValidator.validator, err = utils.NewApplicationValidator(context.Background(), c)
+		}
+		if err != nil {
+			logger.Warningf("applications are not validated against the %s schema: %v", utils.ApplicationCRDName, err)
+		}
+	})
+	return appValidator.validator
+}
+
+// validateApp checks the required fields of an application, then validates it against the Application CRD schema.
+func validateApp(obj map[string]interface{}) error {
+	app, err := utils.ApplicationFromUnstructured(obj)
+	if err != nil {
+		return fmt.Errorf("invalid application: %w", err)
+	}
+	errs := app.Validate()
+	if validator := applicationValidator(); validator != nil {
+		errs = append(errs, validator.Validate(obj)...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid application %s: %w", app.Name, errs.ToAggregate())
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// helmReleaseValues merges the values of a HelmRelease the way helm-controller does:
+// the valuesFrom references in order, then the inline values on top.
+// Values from Secrets are only read when --include-secrets is set.
+func helmReleaseValues(c client.Client, object *helmv2b1.HelmRelease) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	for _, ref := range object.Spec.ValuesFrom {
+		var data map[string][]byte
+		namespacedName := object.Namespace + "/" + ref.Name
+		switch ref.Kind {
+		case "ConfigMap":
+			cm := &corev1.ConfigMap{}
+			err := c.Get(context.Background(), client.ObjectKey{Namespace: object.Namespace, Name: ref.Name}, cm)
+			if apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get values from ConfigMap %s: %w", namespacedName, err)
+			}
+			data = map[string][]byte{}
+			for k, v := range cm.Data {
+				data[k] = []byte(v)
+			}
+		case "Secret":
+			if !generateAppFlags.includeSecrets {
+				logger.Warningf("values from Secret %s are not included in the application, use --include-secrets to include them", namespacedName)
+				continue
+			}
+			secret := &corev1.Secret{}
+			err := c.Get(context.Background(), client.ObjectKey{Namespace: object.Namespace, Name: ref.Name}, secret)
+			if apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get values from Secret %s: %w", namespacedName, err)
+			}
+			logger.Warningf("values from Secret %s are written in plain text into the application", namespacedName)
+			data = secret.Data
+		default:
+			return nil, fmt.Errorf("unsupported values reference kind %q", ref.Kind)
+		}
+
+		value, found := data[ref.GetValuesKey()]
+		if !found {
+			if ref.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("missing key %q in %s %s", ref.GetValuesKey(), ref.Kind, namespacedName)
+		}
+
+		if ref.TargetPath != "" {
+			if err := setValueAtPath(result, ref.TargetPath, string(value)); err != nil {
+				return nil, fmt.Errorf("unable to set %s at targetPath %q: %w", ref.Kind, ref.TargetPath, err)
+			}
+			continue
+		}
+
+		values := map[string]interface{}{}
+		if err := yaml.Unmarshal(value, &values); err != nil {
+			return nil, fmt.Errorf("unable to read values from key %q in %s %s: %w", ref.GetValuesKey(), ref.Kind, namespacedName, err)
+		}
+		result = mergeValues(result, values)
+	}
+
+	return mergeValues(result, object.GetValues()), nil
+}
+
+// mergeValues deep merges the maps, values of b win over values of a.
+func mergeValues(a, b map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if v, ok := v.(map[string]interface{}); ok {
+			if bv, ok := out[k].(map[string]interface{}); ok {
+				out[k] = mergeValues(bv, v)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// maxValueListIndex is the largest list index of a targetPath, the same limit as Helm, so a typo in an index
+// cannot grow a list to an arbitrary size.
+const maxValueListIndex = 65536
+
+// setValueAtPath sets the value at a Helm --set style path, e.g. "a.b\.c[0].d".
+// Like Helm, the value is turned into a boolean, an integer or null when it looks like one.
+func setValueAtPath(values map[string]interface{}, path string, value string) error {
+	keys, err := splitValuePath(path)
+	if err != nil {
+		return err
+	}
+
+	var typed interface{} = value
+	switch {
+	case value == "true":
+		typed = true
+	case value == "false":
+		typed = false
+	case value == "null":
+		typed = nil
+	default:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil && (value == "0" || !strings.HasPrefix(value, "0")) {
+			typed = i
+		}
+	}
+
+	_, err = setValue(values, keys, typed)
+	return err
+}
+
+// setValue sets the value under the keys of current, creating the missing maps and lists,
+// and returns the updated current value.
+func setValue(current interface{}, keys []interface{}, value interface{}) (interface{}, error) {
+	if len(keys) == 0 {
+		return value, nil
+	}
+
+	switch k := keys[0].(type) {
+	case string:
+		m, ok := current.(map[string]interface{})
+		if current == nil {
+			m = map[string]interface{}{}
+		} else if !ok {
+			return nil, fmt.Errorf("%q cannot be set on a non map value", k)
+		}
+		child, err := setValue(m[k], keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = child
+		return m, nil
+	case int:
+		list, ok := current.([]interface{})
+		if current != nil && !ok {
+			return nil, fmt.Errorf("index %d cannot be set on a non list value", k)
+		}
+		if k > maxValueListIndex {
+			return nil, fmt.Errorf("index %d is greater than the maximum supported index %d", k, maxValueListIndex)
+		}
+		for len(list) <= k {
+			list = append(list, nil)
+		}
+		child, err := setValue(list[k], keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		list[k] = child
+		return list, nil
+	}
+	return current, nil
+}
+
+// splitValuePath splits a Helm --set style path into map keys (string) and list indexes (int).
+func splitValuePath(path string) ([]interface{}, error) {
+	var keys []interface{}
+	var key strings.Builder
+	flush := func() {
+		if key.Len() > 0 {
+			keys = append(keys, key.String())
+			key.Reset()
+		}
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch ch := path[i]; ch {
+		case '\\':
+			if i+1 < len(path) {
+				i++
+				key.WriteByte(path[i])
+			}
+		case '.':
+			flush()
+		case '[':
+			flush()
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", path)
+			}
+			index, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid list index in %q", path)
+			}
+			keys = append(keys, index)
+			i += end
+		default:
+			key.WriteByte(ch)
+		}
+	}
+	flush()
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	if _, ok := keys[0].(string); !ok {
+		return nil, fmt.Errorf("path %q must start with a key", path)
+	}
+	return keys, nil
+}
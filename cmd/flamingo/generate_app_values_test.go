@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSetValueAtPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]interface{}
+		path    string
+		value   string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:  "nested keys",
+			path:  "image.tag",
+			value: "6.5.0",
+			want:  map[string]interface{}{"image": map[string]interface{}{"tag": "6.5.0"}},
+		},
+		{
+			name:  "escaped dots",
+			path:  `podAnnotations.prometheus\.io/scrape`,
+			value: "true",
+			want:  map[string]interface{}{"podAnnotations": map[string]interface{}{"prometheus.io/scrape": true}},
+		},
+		{
+			name:  "list index",
+			path:  "ingress.hosts[1].host",
+			value: "podinfo.example.com",
+			want: map[string]interface{}{"ingress": map[string]interface{}{"hosts": []interface{}{
+				nil,
+				map[string]interface{}{"host": "podinfo.example.com"},
+			}}},
+		},
+		{
+			name:   "existing list item",
+			values: map[string]interface{}{"args": []interface{}{"--debug", "--port=80"}},
+			path:   "args[1]",
+			value:  "--port=8080",
+			want:   map[string]interface{}{"args": []interface{}{"--debug", "--port=8080"}},
+		},
+		{
+			name:   "existing keys are kept",
+			values: map[string]interface{}{"image": map[string]interface{}{"repository": "podinfo"}},
+			path:   "image.tag",
+			value:  "6.5.0",
+			want:   map[string]interface{}{"image": map[string]interface{}{"repository": "podinfo", "tag": "6.5.0"}},
+		},
+		{name: "integer", path: "replicas", value: "3", want: map[string]interface{}{"replicas": int64(3)}},
+		{name: "zero", path: "replicas", value: "0", want: map[string]interface{}{"replicas": int64(0)}},
+		{name: "leading zero", path: "zone", value: "012", want: map[string]interface{}{"zone": "012"}},
+		{name: "false", path: "enabled", value: "false", want: map[string]interface{}{"enabled": false}},
+		{name: "null", path: "resources", value: "null", want: map[string]interface{}{"resources": nil}},
+		{
+			name:    "key on a non map value",
+			values:  map[string]interface{}{"image": "podinfo:6.5.0"},
+			path:    "image.tag",
+			value:   "6.5.0",
+			wantErr: `"tag" cannot be set on a non map value`,
+		},
+		{
+			name:    "index on a non list value",
+			values:  map[string]interface{}{"args": "--debug"},
+			path:    "args[0]",
+			value:   "--port=80",
+			wantErr: "index 0 cannot be set on a non list value",
+		},
+		{
+			name:    "index over the maximum",
+			path:    "args[65537]",
+			value:   "--debug",
+			wantErr: "greater than the maximum supported index",
+		},
+		{name: "negative index", path: "args[-1]", value: "--debug", wantErr: "invalid list index"},
+		{name: "unterminated index", path: "args[0", value: "--debug", wantErr: "missing ]"},
+		{name: "leading index", path: "[0].name", value: "podinfo", wantErr: "must start with a key"},
+		{name: "empty path", path: "", value: "podinfo", wantErr: "empty path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := tt.values
+			if values == nil {
+				values = map[string]interface{}{}
+			}
+			err := setValueAtPath(values, tt.path, tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("setValueAtPath() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("setValueAtPath() = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmReleaseValues(t *testing.T) {
+	defaults := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "defaults"},
+		Data: map[string]string{
+			"values.yaml": "replicaCount: 1\nimage:\n  repository: podinfo\n  tag: 6.4.0\n",
+			"tag":         "6.5.0",
+		},
+	}
+	prod := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "prod"},
+		Data:       map[string]string{"values.yaml": "replicaCount: 3\nimage:\n  tag: 6.4.1\n"},
+	}
+	ref := func(name, key, targetPath string, optional bool) helmv2b1.ValuesReference {
+		return helmv2b1.ValuesReference{Kind: "ConfigMap", Name: name, ValuesKey: key, TargetPath: targetPath, Optional: optional}
+	}
+
+	tests := []struct {
+		name    string
+		refs    []helmv2b1.ValuesReference
+		values  string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "references in order",
+			refs: []helmv2b1.ValuesReference{ref("defaults", "", "", false), ref("prod", "", "", false)},
+			want: map[string]interface{}{
+				"replicaCount": float64(3),
+				"image":        map[string]interface{}{"repository": "podinfo", "tag": "6.4.1"},
+			},
+		},
+		{
+			name: "targetPath after a values file",
+			refs: []helmv2b1.ValuesReference{ref("prod", "", "", false), ref("defaults", "tag", "image.tag", false)},
+			want: map[string]interface{}{
+				"replicaCount": float64(3),
+				"image":        map[string]interface{}{"tag": "6.5.0"},
+			},
+		},
+		{
+			name: "values file after a targetPath",
+			refs: []helmv2b1.ValuesReference{ref("defaults", "tag", "image.tag", false), ref("prod", "", "", false)},
+			want: map[string]interface{}{
+				"replicaCount": float64(3),
+				"image":        map[string]interface{}{"tag": "6.4.1"},
+			},
+		},
+		{
+			name:   "inline values on top",
+			refs:   []helmv2b1.ValuesReference{ref("defaults", "", "", false), ref("defaults", "tag", "image.tag", false)},
+			values: `{"image":{"tag":"6.6.0"}}`,
+			want: map[string]interface{}{
+				"replicaCount": float64(1),
+				"image":        map[string]interface{}{"repository": "podinfo", "tag": "6.6.0"},
+			},
+		},
+		{
+			name: "missing optional references and keys",
+			refs: []helmv2b1.ValuesReference{ref("missing", "", "", true), ref("prod", "missing.yaml", "", true), ref("prod", "", "", false)},
+			want: map[string]interface{}{
+				"replicaCount": float64(3),
+				"image":        map[string]interface{}{"tag": "6.4.1"},
+			},
+		},
+		{
+			name:    "missing key",
+			refs:    []helmv2b1.ValuesReference{ref("prod", "missing.yaml", "", false)},
+			wantErr: `missing key "missing.yaml" in ConfigMap flux-system/prod`,
+		},
+		{
+			name:    "targetPath type conflict",
+			refs:    []helmv2b1.ValuesReference{ref("defaults", "", "", false), ref("defaults", "tag", "replicaCount.tag", false)},
+			wantErr: `unable to set ConfigMap at targetPath "replicaCount.tag"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := &helmv2b1.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+				Spec:       helmv2b1.HelmReleaseSpec{ValuesFrom: tt.refs},
+			}
+			if tt.values != "" {
+				object.Spec.Values = &apiextensionsv1.JSON{Raw: []byte(tt.values)}
+			}
+			c := fake.NewClientBuilder().WithScheme(utils.NewScheme()).WithObjects(defaults, prod).Build()
+
+			got, err := helmReleaseValues(c, object)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("helmReleaseValues() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("helmReleaseValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
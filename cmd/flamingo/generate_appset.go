@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var generateAppSetCmd = &cobra.Command{
+	Use:     "generate-appset NAME",
+	Aliases: []string{"gen-appset"},
+	Args:    cobra.ExactArgs(1),
+	Short:   "Generate a Flamingo application set from a Flux resource present on many clusters",
+	Long: `
+# Generate an application set for the Flux Kustomization podinfo in the podinfo namespace of the dev-1 and dev-2 clusters.
+flamingo generate-appset -n podinfo ks/podinfo --clusters=dev-1,dev-2
+
+# Generate an application set for the HelmRelease podinfo on all clusters labelled with env=prod.
+flamingo generate-appset -n podinfo hr/podinfo --cluster-selector=env=prod
+`,
+	RunE: generateAppSetCmdRun,
+}
+
+var generateAppSetFlags struct {
+	appName         string
+	clusters        []string
+	clusterSelector string
+	export          bool
+	allowDrift      bool
+}
+
+func init() {
+	generateAppSetCmd.Flags().StringVar(&generateAppSetFlags.appName, "app-name", "", "name of the generated application set, the applications are named CLUSTER-NAME")
+	generateAppSetCmd.Flags().StringSliceVar(&generateAppSetFlags.clusters, "clusters", nil, "names of the clusters to generate applications for")
+	generateAppSetCmd.Flags().StringVar(&generateAppSetFlags.clusterSelector, "cluster-selector", "", "label selector of the clusters to generate applications for")
+	generateAppSetCmd.Flags().BoolVar(&generateAppSetFlags.export, "export", false, "export the generated application set to stdout")
+	generateAppSetCmd.Flags().BoolVar(&generateAppSetFlags.allowDrift, "allow-revision-drift", false, "generate the application set when the source revision differs across clusters, moving all clusters to the revision used by most of them")
+	addAppCustomizeFlags(generateAppSetCmd.Flags())
+
+	rootCmd.AddCommand(generateAppSetCmd)
+}
+
+// clusterApp is the application generated for the Flux object of one cluster.
+type clusterApp struct {
+	cluster  string
+	app      map[string]interface{}
+	source   string
+	revision string
+}
+
+func generateAppSetCmdRun(_ *cobra.Command, args []string) error {
+	if err := validateAppCustomizeFlags(); err != nil {
+		return err
+	}
+	if len(generateAppSetFlags.clusters) == 0 && generateAppSetFlags.clusterSelector == "" {
+		return fmt.Errorf("either --clusters or --cluster-selector is required")
+	}
+	if len(generateAppSetFlags.clusters) > 0 && generateAppSetFlags.clusterSelector != "" {
+		return fmt.Errorf("--clusters and --cluster-selector cannot be used together")
+	}
+
+	kindName, objectName, err := parseKindName(args[0])
+	if err != nil {
+		return err
+	}
+	appName := generateAppSetFlags.appName
+	if appName == "" {
+		appName = objectName
+	}
+
+	mgmtCli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+	registry := utils.NewClusterRegistry(mgmtCli, rootArgs.applicationNamespace)
+	clusters, err := selectClusters(registry)
+	if err != nil {
+		return err
+	}
+
+	var apps []*clusterApp
+	for _, cluster := range clusters {
+		app, err := generateClusterApp(registry, cluster.Name, kindName, objectName, appName)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", cluster.Name, err)
+		}
+		apps = append(apps, app)
+	}
+
+	reference, err := reportRevisionDrift(apps, generateAppSetFlags.allowDrift)
+	if err != nil {
+		return err
+	}
+	if err := checkFieldDrift(apps, reference); err != nil {
+		return err
+	}
+
+	appSet, err := buildAppSet(appName, kindName, objectName, reference)
+	if err != nil {
+		return err
+	}
+
+	if generateAppSetFlags.export {
+		fmt.Print(string(appSet))
+		return nil
+	}
+	logger.Actionf("applying generated application set %s in %s namespace", appName, rootArgs.applicationNamespace)
+	applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, appSet)
+	if err != nil {
+		return fmt.Errorf("install failed: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, applyOutput)
+	return nil
+}
+
+// selectClusters returns the registered clusters matching --clusters or --cluster-selector.
+func selectClusters(registry *utils.ClusterRegistry) ([]utils.Cluster, error) {
+	clusters, err := registry.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []utils.Cluster
+	if len(generateAppSetFlags.clusters) > 0 {
+		byName := map[string]utils.Cluster{}
+		for _, c := range clusters {
+			byName[c.Name] = c
+		}
+		for _, name := range generateAppSetFlags.clusters {
+			c, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("cluster %s not found, only clusters added with add-cluster can be used", name)
+			}
+			selected = append(selected, c)
+		}
+		return selected, nil
+	}
+
+	selector, err := labels.Parse(generateAppSetFlags.clusterSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster selector: %w", err)
+	}
+	for _, c := range clusters {
+		if selector.Matches(labels.Set(c.Labels)) {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no clusters match the selector %q", generateAppSetFlags.clusterSelector)
+	}
+	return selected, nil
+}
+
+// generateClusterApp generates the application of the Flux object on the given cluster.
+func generateClusterApp(registry *utils.ClusterRegistry, clusterName, kindName, objectName, appName string) (*clusterApp, error) {
+	leafCli, cluster, err := registry.ClientFor(context.Background(), clusterName, kubeclientOptions)
+	if err != nil {
+		return nil, err
+	}
+	logger.Actionf("connecting to cluster %s at %s", clusterName, cluster.CLIAddress())
+
+	var tpl bytes.Buffer
+	key := client.ObjectKey{Namespace: *kubeconfigArgs.Namespace, Name: objectName}
+	switch kindName {
+	case kustomizev1.KustomizationKind:
+		object := kustomizev1.Kustomization{}
+		if err := leafCli.Get(context.Background(), key, &object); err != nil {
+			return nil, fmt.Errorf("%w in namespace %q", err, key.Namespace)
+		}
+		err = generateKustomizationApp(leafCli, appName, &object, clusterName, cluster.Server, &tpl)
+	case helmv2b1.HelmReleaseKind:
+		object := helmv2b1.HelmRelease{}
+		if err := leafCli.Get(context.Background(), key, &object); err != nil {
+			return nil, fmt.Errorf("%w in namespace %q", err, key.Namespace)
+		}
+		err = generateHelmReleaseApp(leafCli, appName, &object, clusterName, cluster.Server, &tpl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	app := map[string]interface{}{}
+	if err := yaml.Unmarshal(tpl.Bytes(), &app); err != nil {
+		return nil, fmt.Errorf("unable to read the generated application: %w", err)
+	}
+
+	source, _ := app["spec"].(map[string]interface{})["source"].(map[string]interface{})
+	return &clusterApp{
+		cluster:  clusterName,
+		app:      app,
+		source:   fmt.Sprintf("%v %v %v", source["repoURL"], source["path"], source["chart"]),
+		revision: fmt.Sprintf("%v", source["targetRevision"]),
+	}, nil
+}
+
+// reportRevisionDrift prints the source revision of each cluster when they differ, and returns the application
+// of the revision used by most clusters. Drift fails unless it is allowed, as the drifted clusters would be
+// moved to that revision.
+func reportRevisionDrift(apps []*clusterApp, allowDrift bool) (*clusterApp, error) {
+	count := map[string]int{}
+	for _, a := range apps {
+		count[a.source+"@"+a.revision]++
+	}
+	if len(count) == 1 {
+		return apps[0], nil
+	}
+
+	reference := apps[0]
+	for _, a := range apps {
+		if count[a.source+"@"+a.revision] > count[reference.source+"@"+reference.revision] {
+			reference = a
+		}
+	}
+
+	var drifted []string
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tREVISION\tDRIFT")
+	for _, a := range apps {
+		drift := a.source != reference.source || a.revision != reference.revision
+		if drift {
+			drifted = append(drifted, a.cluster)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\n", a.cluster, a.revision, drift)
+	}
+	w.Flush()
+	sort.Strings(drifted)
+	if !allowDrift {
+		return nil, fmt.Errorf("the source revision differs across clusters, clusters %s drift from %s of cluster %s: align the Flux objects or use --allow-revision-drift to move them to it",
+			strings.Join(drifted, ","), reference.revision, reference.cluster)
+	}
+	logger.Warningf("the source revision differs across clusters, the application set uses %s of cluster %s, clusters %s will be moved to it",
+		reference.revision, reference.cluster, strings.Join(drifted, ","))
+	return reference, nil
+}
+
+// appSetClusterFields are the fields of the applications expected to differ across clusters:
+// the fields templated for each cluster, and the source compared by reportRevisionDrift.
+var appSetClusterFields = map[string]bool{
+	"metadata.labels.flamingo/cluster-name": true,
+	"metadata.labels." + workloadUIDLabel:   true,
+	"spec.destination.server":               true,
+	"spec.source.repoURL":                   true,
+	"spec.source.path":                      true,
+	"spec.source.chart":                     true,
+	"spec.source.targetRevision":            true,
+}
+
+// checkFieldDrift prints the fields of the applications of each cluster which differ from the reference application,
+// other than the templated fields and the source revision, and fails if any does, as the application set would
+// copy the values of the reference cluster to all clusters.
+func checkFieldDrift(apps []*clusterApp, reference *clusterApp) error {
+	referenceFields := appSetFields(reference)
+
+	var drifted []string
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	for _, a := range apps {
+		if a == reference {
+			continue
+		}
+		fields := appSetFields(a)
+		for _, path := range appFieldDiffs(referenceFields, fields) {
+			if len(drifted) == 0 {
+				fmt.Fprintf(w, "CLUSTER\tFIELD\tVALUE\tVALUE ON %s\n", reference.cluster)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.cluster, path, fieldValue(fields, path), fieldValue(referenceFields, path))
+			drifted = append(drifted, a.cluster+" "+path)
+		}
+	}
+	w.Flush()
+	if len(drifted) > 0 {
+		return fmt.Errorf("the applications differ across clusters in %s, an application set would apply the values of cluster %s everywhere: "+
+			"align the Flux objects or use generate-app for each cluster", strings.Join(drifted, ", "), reference.cluster)
+	}
+	return nil
+}
+
+// appSetFields flattens the metadata and spec of the application of a cluster by field path.
+func appSetFields(a *clusterApp) map[string]string {
+	fields := map[string]string{}
+	for _, key := range []string{"metadata", "spec"} {
+		flattenFields(key, a.app[key], fields)
+	}
+	return fields
+}
+
+// fieldValue returns the value of a flattened field, or <none> when it is not set.
+func fieldValue(fields map[string]string, path string) string {
+	if value, found := fields[path]; found {
+		return value
+	}
+	return "<none>"
+}
+
+// appFieldDiffs returns the sorted paths of the fields set to different values, except appSetClusterFields.
+func appFieldDiffs(reference, fields map[string]string) []string {
+	var paths []string
+	for path, value := range fields {
+		if ref, found := reference[path]; (!found || ref != value) && !appSetClusterFields[path] {
+			paths = append(paths, path)
+		}
+	}
+	for path := range reference {
+		if _, found := fields[path]; !found && !appSetClusterFields[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// buildAppSet turns the application of one cluster into an application set with a cluster generator
+// over the Flamingo cluster secrets, templating the cluster name and server.
+func buildAppSet(appName, kindName, objectName string, reference *clusterApp) ([]byte, error) {
+	app := reference.app
+
+	metadata, _ := app["metadata"].(map[string]interface{})
+	appLabels, _ := metadata["labels"].(map[string]interface{})
+	appLabels["flamingo/cluster-name"] = "{{name}}"
+	// the Flux objects of each cluster have their own UID
+	delete(appLabels, workloadUIDLabel)
+	templateMetadata := map[string]interface{}{
+		"name":   "{{name}}-" + appName,
+		"labels": appLabels,
+	}
+	if annotations, ok := metadata["annotations"]; ok {
+		templateMetadata["annotations"] = annotations
+	}
+
+	spec, _ := app["spec"].(map[string]interface{})
+	destination, _ := spec["destination"].(map[string]interface{})
+	destination["server"] = "{{server}}"
+
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			utils.ClusterLabel: "true",
+		},
+	}
+	if len(generateAppSetFlags.clusters) > 0 {
+		selector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      utils.ClusterNameLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   generateAppSetFlags.clusters,
+		}}
+	} else {
+		userSelector, err := metav1.ParseToLabelSelector(generateAppSetFlags.clusterSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster selector: %w", err)
+		}
+		for k, v := range userSelector.MatchLabels {
+			selector.MatchLabels[k] = v
+		}
+		selector.MatchExpressions = userSelector.MatchExpressions
+	}
+
+	appSet := map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "ApplicationSet",
+		"metadata": map[string]interface{}{
+			"name":      appName,
+			"namespace": rootArgs.applicationNamespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/managed-by": "flamingo",
+				"flamingo/workload-name":       objectName,
+				"flamingo/workload-type":       kindName,
+			},
+		},
+		"spec": map[string]interface{}{
+			"generators": []interface{}{
+				map[string]interface{}{
+					"clusters": map[string]interface{}{
+						"selector": selector,
+					},
+				},
+			},
+			"template": map[string]interface{}{
+				"metadata": templateMetadata,
+				"spec":     spec,
+			},
+		},
+	}
+
+	data, err := yaml.Marshal(appSet)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), data...), nil
+}
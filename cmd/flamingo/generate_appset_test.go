@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// newTestClusterApp returns the application of the podinfo HelmRelease on a cluster.
+func newTestClusterApp(cluster string, modify func(app map[string]interface{})) *clusterApp {
+	app := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name": "podinfo",
+			"labels": map[string]interface{}{
+				"flamingo/cluster-name": cluster,
+				workloadUIDLabel:        cluster + "-uid",
+			},
+			"annotations": map[string]interface{}{
+				"argocd.argoproj.io/sync-wave": "1",
+			},
+		},
+		"spec": map[string]interface{}{
+			"destination": map[string]interface{}{
+				"server":    "https://" + cluster + ".example.com",
+				"namespace": "podinfo",
+			},
+			"source": map[string]interface{}{
+				"repoURL":        "https://stefanprodan.github.io/podinfo",
+				"chart":          "podinfo",
+				"targetRevision": "6.5.0",
+				"helm": map[string]interface{}{
+					"valuesObject": map[string]interface{}{"replicaCount": int64(2)},
+				},
+			},
+		},
+	}
+	if modify != nil {
+		modify(app)
+	}
+	return &clusterApp{cluster: cluster, app: app}
+}
+
+func TestCheckFieldDrift(t *testing.T) {
+	set := func(value interface{}, fields ...string) func(app map[string]interface{}) {
+		return func(app map[string]interface{}) {
+			m := app
+			for _, field := range fields[:len(fields)-1] {
+				m = m[field].(map[string]interface{})
+			}
+			m[fields[len(fields)-1]] = value
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(app map[string]interface{})
+		want   string
+	}{
+		{name: "templated fields only"},
+		{
+			name:   "source revision",
+			modify: set("6.6.0", "spec", "source", "targetRevision"),
+		},
+		{
+			name:   "sync wave",
+			modify: set("2", "metadata", "annotations", "argocd.argoproj.io/sync-wave"),
+			want:   "dev-2 metadata.annotations.argocd.argoproj.io/sync-wave",
+		},
+		{
+			name: "postBuild variables",
+			modify: set(map[string]interface{}{
+				"name": "envsubst",
+				"env":  []interface{}{map[string]interface{}{"name": "cluster", "value": "dev-2"}},
+			}, "spec", "source", "plugin"),
+			want: "dev-2 spec.source.plugin.env[0].value",
+		},
+		{
+			name:   "helm values",
+			modify: set(int64(3), "spec", "source", "helm", "valuesObject", "replicaCount"),
+			want:   "dev-2 spec.source.helm.valuesObject.replicaCount",
+		},
+		{
+			name:   "destination namespace",
+			modify: set("podinfo-dev", "spec", "destination", "namespace"),
+			want:   "dev-2 spec.destination.namespace",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reference := newTestClusterApp("dev-1", nil)
+			apps := []*clusterApp{reference, newTestClusterApp("dev-2", tt.modify)}
+
+			err := checkFieldDrift(apps, reference)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkFieldDrift() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkFieldDrift() error = %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportRevisionDrift(t *testing.T) {
+	withRevision := func(cluster, revision string) *clusterApp {
+		app := newTestClusterApp(cluster, nil)
+		app.source, app.revision = "https://stefanprodan.github.io/podinfo/podinfo", revision
+		return app
+	}
+
+	tests := []struct {
+		name          string
+		revisions     []string
+		allowDrift    bool
+		wantReference string
+		wantErr       string
+	}{
+		{name: "same revision", revisions: []string{"6.5.0", "6.5.0"}, wantReference: "dev-1"},
+		{name: "drift refused", revisions: []string{"6.5.0", "6.6.0", "6.6.0"}, wantErr: "clusters dev-1 drift from 6.6.0 of cluster dev-2"},
+		{name: "drift allowed", revisions: []string{"6.5.0", "6.6.0", "6.6.0"}, allowDrift: true, wantReference: "dev-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apps []*clusterApp
+			for i, revision := range tt.revisions {
+				apps = append(apps, withRevision(fmt.Sprintf("dev-%d", i+1), revision))
+			}
+
+			reference, err := reportRevisionDrift(apps, tt.allowDrift)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("reportRevisionDrift() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reference.cluster != tt.wantReference {
+				t.Errorf("reference = %s, want %s", reference.cluster, tt.wantReference)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// tenantLabel is the label Flux uses to mark the objects and namespaces of a tenant.
+const tenantLabel = "toolkit.fluxcd.io/tenant"
+
+// autoProject makes the generated applications use the project of their Flux tenant.
+const autoProject = "auto"
+
+var generateProjectCmd = &cobra.Command{
+	Use:     "generate-project [TENANT]",
+	Aliases: []string{"gen-project"},
+	Args:    cobra.MaximumNArgs(1),
+	Short:   "Generate Argo CD projects for Flux tenants",
+	Long: `
+# Generate a project for every Flux tenant found in all namespaces.
+flamingo generate-project --all-namespaces
+
+# Generate the project of the dev-team tenant of the dev-1 cluster.
+flamingo generate-project -A dev-team --cluster=dev-1
+
+# Generate applications in the project of their Flux tenant.
+flamingo generate-app -n apps ks/podinfo --project=auto
+`,
+	RunE: generateProjectCmdRun,
+}
+
+var generateProjectFlags struct {
+	allNamespaces bool
+	cluster       string
+	export        bool
+	unrestricted  bool
+}
+
+func init() {
+	generateProjectCmd.Flags().BoolVarP(&generateProjectFlags.allNamespaces, "all-namespaces", "A", false, "look for Flux tenants in all namespaces")
+	generateProjectCmd.Flags().StringVar(&generateProjectFlags.cluster, "cluster", "", "name of the cluster to look for Flux tenants in")
+	generateProjectCmd.Flags().BoolVar(&generateProjectFlags.export, "export", false, "export the generated projects to stdout")
+	generateProjectCmd.Flags().BoolVar(&generateProjectFlags.unrestricted, "allow-unrestricted", false, "allow all namespaced resources in the projects of tenants with Flux objects without a service account")
+
+	rootCmd.AddCommand(generateProjectCmd)
+}
+
+// tenant collects what the Flux objects of a tenant use.
+type tenant struct {
+	name            string
+	sourceRepos     sets.Set[string]
+	namespaces      sets.Set[string]
+	serviceAccounts sets.Set[string]
+	// the Flux objects without a service account, which may write any resource
+	unrestricted []string
+}
+
+func generateProjectCmdRun(_ *cobra.Command, args []string) error {
+	if len(args) == 1 {
+		if _, err := projectName(args[0]); err != nil {
+			return err
+		}
+	}
+	clusterName := generateProjectFlags.cluster
+	if clusterName == "" {
+		clusterName = utils.InClusterName
+	}
+	leafCli, cluster, err := clientForCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	var opts []client.ListOption
+	if !generateProjectFlags.allNamespaces {
+		opts = append(opts, client.InNamespace(*kubeconfigArgs.Namespace))
+	}
+	ksList := &kustomizev1.KustomizationList{}
+	if err := leafCli.List(context.Background(), ksList, opts...); err != nil {
+		return fmt.Errorf("listing Kustomizations failed: %w", err)
+	}
+	hrList := &helmv2b1.HelmReleaseList{}
+	if err := leafCli.List(context.Background(), hrList, opts...); err != nil {
+		return fmt.Errorf("listing HelmReleases failed: %w", err)
+	}
+
+	tenants := map[string]*tenant{}
+	tenantOf := func(object client.Object) *tenant {
+		name := fluxTenant(leafCli, object)
+		if name == "" || (len(args) == 1 && name != args[0]) {
+			return nil
+		}
+		if _, err := projectName(name); err != nil {
+			logger.Warningf("skipping %s/%s: %v", object.GetNamespace(), object.GetName(), err)
+			return nil
+		}
+		if _, ok := tenants[name]; !ok {
+			tenants[name] = &tenant{
+				name:            name,
+				sourceRepos:     sets.New[string](),
+				namespaces:      sets.New[string](),
+				serviceAccounts: sets.New[string](),
+			}
+		}
+		return tenants[name]
+	}
+
+	for i := range ksList.Items {
+		object := &ksList.Items[i]
+		t := tenantOf(object)
+		if t == nil {
+			continue
+		}
+		if repoURL, _, err := resolveKustomizationSource(leafCli, object); err != nil {
+			logger.Warningf("could not resolve the source of Kustomization %s/%s: %v", object.Namespace, object.Name, err)
+		} else {
+			t.sourceRepos.Insert(repoURL)
+		}
+		t.addWorkload(kustomizev1.KustomizationKind, object.Namespace, object.Name, object.Spec.TargetNamespace, object.Spec.ServiceAccountName)
+	}
+	for i := range hrList.Items {
+		object := &hrList.Items[i]
+		t := tenantOf(object)
+		if t == nil {
+			continue
+		}
+		if chart, err := resolveHelmReleaseChart(leafCli, object); err != nil {
+			logger.Warningf("could not resolve the chart of HelmRelease %s/%s: %v", object.Namespace, object.Name, err)
+		} else {
+			t.sourceRepos.Insert(chart.RepoURL)
+		}
+		t.addWorkload(helmv2b1.HelmReleaseKind, object.Namespace, object.Name, object.Spec.TargetNamespace, object.Spec.ServiceAccountName)
+	}
+
+	if len(tenants) == 0 {
+		if len(args) == 1 {
+			return fmt.Errorf("no Kustomizations or HelmReleases found for tenant %s", args[0])
+		}
+		logger.Warningf("no Kustomizations or HelmReleases labelled with %s found", tenantLabel)
+		return nil
+	}
+
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var all bytes.Buffer
+	for _, name := range names {
+		project, err := buildAppProject(leafCli, tenants[name], cluster.Server)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		all.Write(project)
+	}
+
+	if generateProjectFlags.export {
+		fmt.Print(all.String())
+		return nil
+	}
+	logger.Actionf("applying generated projects in %s namespace", rootArgs.applicationNamespace)
+	applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, all.Bytes())
+	if err != nil {
+		return fmt.Errorf("install failed: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, applyOutput)
+	return nil
+}
+
+func (t *tenant) addWorkload(kind, namespace, name, targetNamespace, serviceAccountName string) {
+	t.namespaces.Insert(namespace)
+	if targetNamespace != "" {
+		t.namespaces.Insert(targetNamespace)
+	}
+	if serviceAccountName == "" {
+		t.unrestricted = append(t.unrestricted, fmt.Sprintf("%s %s/%s", kind, namespace, name))
+		return
+	}
+	t.serviceAccounts.Insert(namespace + "/" + serviceAccountName)
+}
+
+// appProject returns the project of the application generated from a Flux object.
+func appProject(c client.Client, object client.Object) (string, error) {
+	switch appCustomizeFlags.project {
+	case "":
+		return "default", nil
+	case autoProject:
+		if name := fluxTenant(c, object); name != "" {
+			return projectName(name)
+		}
+		logger.Warningf("%s/%s does not belong to a Flux tenant, using the default project", object.GetNamespace(), object.GetName())
+		return "default", nil
+	default:
+		return appCustomizeFlags.project, nil
+	}
+}
+
+// projectName returns the name of the project of a tenant, the tenant name, which must be a valid object name.
+func projectName(tenant string) (string, error) {
+	if errs := validation.IsDNS1123Subdomain(tenant); len(errs) > 0 {
+		return "", fmt.Errorf("tenant %q is not a valid project name: %s", tenant, strings.Join(errs, "; "))
+	}
+	return tenant, nil
+}
+
+// fluxTenant returns the tenant of a Flux object, from its label or from the label of its namespace.
+func fluxTenant(c client.Client, object client.Object) string {
+	if name := object.GetLabels()[tenantLabel]; name != "" {
+		return name
+	}
+	namespace := &corev1.Namespace{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: object.GetNamespace()}, namespace); err != nil {
+		return ""
+	}
+	return namespace.Labels[tenantLabel]
+}
+
+// buildAppProject restricts the project of a tenant to its sources, its namespaces,
+// and the resources its service accounts may write.
+func buildAppProject(c client.Client, t *tenant, server string) ([]byte, error) {
+	namespaceList := &corev1.NamespaceList{}
+	if err := c.List(context.Background(), namespaceList, client.MatchingLabels{tenantLabel: t.name}); err != nil {
+		return nil, fmt.Errorf("listing namespaces failed: %w", err)
+	}
+	for _, ns := range namespaceList.Items {
+		t.namespaces.Insert(ns.Name)
+	}
+
+	namespaced := sets.New[metav1.GroupKind]()
+	clusterScoped := sets.New[metav1.GroupKind]()
+	if len(t.unrestricted) > 0 {
+		sort.Strings(t.unrestricted)
+		if !generateProjectFlags.unrestricted {
+			return nil, fmt.Errorf("%s have no service account and would allow all namespaced resources: set their spec.serviceAccountName, or use --allow-unrestricted",
+				strings.Join(t.unrestricted, ", "))
+		}
+		logger.Warningf("tenant %s allows all namespaced resources, as %s have no service account", t.name, strings.Join(t.unrestricted, ", "))
+		namespaced.Insert(metav1.GroupKind{Group: "*", Kind: "*"})
+	}
+	if t.serviceAccounts.Len() > 0 {
+		if err := serviceAccountResources(c, t, namespaced, clusterScoped); err != nil {
+			return nil, err
+		}
+	}
+
+	var destinations []interface{}
+	for _, ns := range sets.List(t.namespaces) {
+		destinations = append(destinations, map[string]interface{}{
+			"server":    server,
+			"namespace": ns,
+		})
+	}
+
+	spec := map[string]interface{}{
+		"description":  fmt.Sprintf("Flux tenant %s", t.name),
+		"sourceRepos":  sets.List(t.sourceRepos),
+		"destinations": destinations,
+	}
+	if namespaced.Len() > 0 {
+		spec["namespaceResourceWhitelist"] = sortedGroupKinds(namespaced)
+	} else {
+		// An empty whitelist allows every namespaced resource in Argo CD
+		logger.Warningf("the service accounts of tenant %s may not write any namespaced resource", t.name)
+		spec["namespaceResourceBlacklist"] = []metav1.GroupKind{{Group: "*", Kind: "*"}}
+	}
+	if clusterScoped.Len() > 0 {
+		spec["clusterResourceWhitelist"] = sortedGroupKinds(clusterScoped)
+	}
+
+	project := map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "AppProject",
+		"metadata": map[string]interface{}{
+			"name":      t.name,
+			"namespace": rootArgs.applicationNamespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/managed-by": "flamingo",
+				"flamingo/tenant":              t.name,
+			},
+		},
+		"spec": spec,
+	}
+	data, err := yaml.Marshal(project)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), data...), nil
+}
+
+// serviceAccountResources collects the kinds the service accounts of a tenant may write,
+// and adds the namespaces they are bound in to the tenant.
+func serviceAccountResources(c client.Client, t *tenant, namespaced, clusterScoped sets.Set[metav1.GroupKind]) error {
+	roleBindings := &rbacv1.RoleBindingList{}
+	if err := c.List(context.Background(), roleBindings); err != nil {
+		return fmt.Errorf("listing role bindings failed: %w", err)
+	}
+	clusterRoleBindings := &rbacv1.ClusterRoleBindingList{}
+	if err := c.List(context.Background(), clusterRoleBindings); err != nil {
+		return fmt.Errorf("listing cluster role bindings failed: %w", err)
+	}
+
+	for _, rb := range roleBindings.Items {
+		if !bindsServiceAccount(rb.Subjects, rb.Namespace, t.serviceAccounts) {
+			continue
+		}
+		t.namespaces.Insert(rb.Namespace)
+		rules, err := roleRules(c, rb.RoleRef, rb.Namespace)
+		if err != nil {
+			logger.Warningf("could not read %s %s of role binding %s/%s: %v", rb.RoleRef.Kind, rb.RoleRef.Name, rb.Namespace, rb.Name, err)
+			continue
+		}
+		// Role bindings only grant namespaced resources
+		addRuleKinds(c.RESTMapper(), rules, namespaced, nil)
+	}
+	for _, crb := range clusterRoleBindings.Items {
+		if !bindsServiceAccount(crb.Subjects, "", t.serviceAccounts) {
+			continue
+		}
+		rules, err := roleRules(c, crb.RoleRef, "")
+		if err != nil {
+			logger.Warningf("could not read ClusterRole %s of cluster role binding %s: %v", crb.RoleRef.Name, crb.Name, err)
+			continue
+		}
+		addRuleKinds(c.RESTMapper(), rules, namespaced, clusterScoped)
+	}
+	return nil
+}
+
+func bindsServiceAccount(subjects []rbacv1.Subject, bindingNamespace string, serviceAccounts sets.Set[string]) bool {
+	for _, s := range subjects {
+		if s.Kind != rbacv1.ServiceAccountKind {
+			continue
+		}
+		namespace := s.Namespace
+		if namespace == "" {
+			namespace = bindingNamespace
+		}
+		if serviceAccounts.Has(namespace + "/" + s.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func roleRules(c client.Client, ref rbacv1.RoleRef, namespace string) ([]rbacv1.PolicyRule, error) {
+	if ref.Kind == "Role" {
+		role := &rbacv1.Role{}
+		if err := c.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: ref.Name}, role); err != nil {
+			return nil, err
+		}
+		return role.Rules, nil
+	}
+	clusterRole := &rbacv1.ClusterRole{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: ref.Name}, clusterRole); err != nil {
+		return nil, err
+	}
+	return clusterRole.Rules, nil
+}
+
+// addRuleKinds adds the kinds the rules allow to write, split by scope.
+// Cluster-scoped kinds are dropped when clusterScoped is nil.
+func addRuleKinds(mapper apimeta.RESTMapper, rules []rbacv1.PolicyRule, namespaced, clusterScoped sets.Set[metav1.GroupKind]) {
+	for _, rule := range rules {
+		if !allowsWrite(rule.Verbs) {
+			continue
+		}
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if resource == "*" {
+					gk := metav1.GroupKind{Group: group, Kind: "*"}
+					namespaced.Insert(gk)
+					if clusterScoped != nil {
+						clusterScoped.Insert(gk)
+					}
+					continue
+				}
+				for _, gk := range resourceKinds(mapper, group, resource) {
+					mapping, err := mapper.RESTMapping(schema.GroupKind{Group: gk.Group, Kind: gk.Kind})
+					if err != nil {
+						continue
+					}
+					if mapping.Scope.Name() == apimeta.RESTScopeNameNamespace {
+						namespaced.Insert(gk)
+					} else if clusterScoped != nil {
+						clusterScoped.Insert(gk)
+					}
+				}
+			}
+		}
+	}
+}
+
+// resourceKinds returns the kinds of a resource of an RBAC rule, a * group matching every group.
+func resourceKinds(mapper apimeta.RESTMapper, group, resource string) []metav1.GroupKind {
+	lookup := group
+	if group == "*" {
+		lookup = ""
+	}
+	gvks, err := mapper.KindsFor(schema.GroupVersionResource{Group: lookup, Resource: resource})
+	if err != nil {
+		return nil
+	}
+	found := sets.New[metav1.GroupKind]()
+	for _, gvk := range gvks {
+		// The empty group is the core group in RBAC rules
+		if group != "*" && gvk.Group != group {
+			continue
+		}
+		found.Insert(metav1.GroupKind{Group: gvk.Group, Kind: gvk.Kind})
+	}
+	return sortedGroupKinds(found)
+}
+
+func allowsWrite(verbs []string) bool {
+	for _, verb := range verbs {
+		switch verb {
+		case "*", "create", "update", "patch":
+			return true
+		}
+	}
+	return false
+}
+
+func sortedGroupKinds(s sets.Set[metav1.GroupKind]) []metav1.GroupKind {
+	list := s.UnsortedList()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group != list[j].Group {
+			return list[i].Group < list[j].Group
+		}
+		return list[i].Kind < list[j].Kind
+	})
+	return list
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func TestProjectName(t *testing.T) {
+	tests := []struct {
+		tenant  string
+		wantErr bool
+	}{
+		{tenant: "dev-team"},
+		{tenant: "dev.team"},
+		{tenant: "Dev_Team", wantErr: true},
+		{tenant: "-dev", wantErr: true},
+		{tenant: strings.Repeat("a", 254), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			got, err := projectName(tt.tenant)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("projectName() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.tenant {
+				t.Errorf("projectName() = %s, want %s", got, tt.tenant)
+			}
+		})
+	}
+}
+
+// newProjectRESTMapper maps the kinds the RBAC rules of the tests refer to, with their scope.
+func newProjectRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{corev1.SchemeGroupVersion, appsv1.SchemeGroupVersion, rbacv1.SchemeGroupVersion})
+	for _, gvk := range []schema.GroupVersionKind{
+		corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+		corev1.SchemeGroupVersion.WithKind("Secret"),
+		appsv1.SchemeGroupVersion.WithKind("Deployment"),
+		rbacv1.SchemeGroupVersion.WithKind("Role"),
+		rbacv1.SchemeGroupVersion.WithKind("RoleBinding"),
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	for _, gvk := range []schema.GroupVersionKind{
+		corev1.SchemeGroupVersion.WithKind("Namespace"),
+		rbacv1.SchemeGroupVersion.WithKind("ClusterRole"),
+		rbacv1.SchemeGroupVersion.WithKind("ClusterRoleBinding"),
+	} {
+		mapper.Add(gvk, meta.RESTScopeRoot)
+	}
+	return mapper
+}
+
+func TestBuildAppProject(t *testing.T) {
+	deployer := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "deployer"},
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"create", "update"}},
+			// read-only rules grant nothing to write
+			{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "list"}},
+		},
+	}
+	namespaces := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "namespaces"},
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"namespaces", "configmaps"}, Verbs: []string{"patch"}},
+		},
+	}
+	admin := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "admin"},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+	}
+	subject := func(namespace, name string) []rbacv1.Subject {
+		return []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: name}}
+	}
+	objects := []client.Object{
+		deployer, namespaces, admin,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Labels: map[string]string{tenantLabel: "dev-team"}}},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "deployer"},
+			Subjects:   subject("flux-system", "dev-team"),
+			RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "deployer"},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "namespaces"},
+			Subjects:   subject("flux-system", "ops"),
+			RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "namespaces"},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin"},
+			Subjects:   subject("flux-system", "admin"),
+			RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "admin"},
+		},
+		// bindings of a missing role are skipped
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "missing"},
+			Subjects:   subject("flux-system", "dev-team"),
+			RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "missing"},
+		},
+	}
+
+	groupKinds := func(gks ...string) []interface{} {
+		var list []interface{}
+		for _, gk := range gks {
+			group, kind, _ := strings.Cut(gk, "/")
+			list = append(list, map[string]interface{}{"group": group, "kind": kind})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name            string
+		serviceAccounts []string
+		unrestricted    []string
+		allow           bool
+		wantNamespaces  []string
+		wantNamespaced  []interface{}
+		wantCluster     []interface{}
+		wantBlacklist   bool
+		wantErr         string
+	}{
+		{
+			name:            "role binding",
+			serviceAccounts: []string{"dev-team"},
+			wantNamespaces:  []string{"apps", "flux-system", "team"},
+			wantNamespaced:  groupKinds("apps/Deployment"),
+		},
+		{
+			name:            "cluster role binding",
+			serviceAccounts: []string{"ops"},
+			wantNamespaces:  []string{"flux-system", "team"},
+			wantNamespaced:  groupKinds("/ConfigMap"),
+			wantCluster:     groupKinds("/Namespace"),
+		},
+		{
+			name:            "all resources of a group",
+			serviceAccounts: []string{"admin"},
+			wantNamespaces:  []string{"flux-system", "team"},
+			wantNamespaced:  groupKinds("apps/*"),
+			wantCluster:     groupKinds("apps/*"),
+		},
+		{
+			name:            "several service accounts",
+			serviceAccounts: []string{"dev-team", "ops"},
+			wantNamespaces:  []string{"apps", "flux-system", "team"},
+			wantNamespaced:  groupKinds("/ConfigMap", "apps/Deployment"),
+			wantCluster:     groupKinds("/Namespace"),
+		},
+		{
+			name:            "no binding",
+			serviceAccounts: []string{"unbound"},
+			wantNamespaces:  []string{"flux-system", "team"},
+			wantBlacklist:   true,
+		},
+		{
+			name:         "no service account",
+			unrestricted: []string{"podinfo", "redis"},
+			wantErr:      "Kustomization flux-system/podinfo, Kustomization flux-system/redis have no service account",
+		},
+		{
+			name:           "no service account allowed",
+			unrestricted:   []string{"podinfo"},
+			allow:          true,
+			wantNamespaces: []string{"flux-system", "team"},
+			wantNamespaced: groupKinds("*/*"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generateProjectFlags.unrestricted = tt.allow
+			t.Cleanup(func() { generateProjectFlags.unrestricted = false })
+
+			c := fake.NewClientBuilder().
+				WithScheme(utils.NewScheme()).
+				WithRESTMapper(newProjectRESTMapper()).
+				WithObjects(objects...).
+				Build()
+			tn := &tenant{
+				name:            "dev-team",
+				sourceRepos:     sets.New("https://github.com/stefanprodan/podinfo"),
+				namespaces:      sets.New[string](),
+				serviceAccounts: sets.New[string](),
+			}
+			for _, sa := range tt.serviceAccounts {
+				tn.addWorkload("Kustomization", "flux-system", sa+"-apps", "", sa)
+			}
+			for _, name := range tt.unrestricted {
+				tn.addWorkload("Kustomization", "flux-system", name, "", "")
+			}
+
+			data, err := buildAppProject(c, tn, utils.InClusterServer)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("buildAppProject() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			project := map[string]interface{}{}
+			if err := yaml.Unmarshal(data, &project); err != nil {
+				t.Fatal(err)
+			}
+			spec := project["spec"].(map[string]interface{})
+
+			var gotNamespaces []string
+			for _, d := range spec["destinations"].([]interface{}) {
+				gotNamespaces = append(gotNamespaces, d.(map[string]interface{})["namespace"].(string))
+			}
+			if !reflect.DeepEqual(gotNamespaces, tt.wantNamespaces) {
+				t.Errorf("destination namespaces = %v, want %v", gotNamespaces, tt.wantNamespaces)
+			}
+			if got := spec["namespaceResourceWhitelist"]; !reflect.DeepEqual(got, nilIfEmpty(tt.wantNamespaced)) {
+				t.Errorf("namespaceResourceWhitelist = %v, want %v", got, tt.wantNamespaced)
+			}
+			if got := spec["clusterResourceWhitelist"]; !reflect.DeepEqual(got, nilIfEmpty(tt.wantCluster)) {
+				t.Errorf("clusterResourceWhitelist = %v, want %v", got, tt.wantCluster)
+			}
+			if _, found := spec["namespaceResourceBlacklist"]; found != tt.wantBlacklist {
+				t.Errorf("namespaceResourceBlacklist set = %v, want %v", found, tt.wantBlacklist)
+			}
+		})
+	}
+}
+
+// nilIfEmpty returns nil for an empty list, like an unset field of the project.
+func nilIfEmpty(list []interface{}) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
@@ -49,11 +49,7 @@ func getCmdRun(cmd *cobra.Command, args []string) error {
 
 	namespace := *kubeconfigArgs.Namespace
 	labelSelector := map[string]string{
-		"app.kubernetes.io/managed-by":   "flamingo",
-		"flamingo/destination-namespace": namespace,
-	}
-	if getCmdFlags.all {
-		delete(labelSelector, "flamingo/destination-namespace")
+		"app.kubernetes.io/managed-by": "flamingo",
 	}
 
 	list := &unstructured.UnstructuredList{}
@@ -66,11 +62,15 @@ func getCmdRun(cmd *cobra.Command, args []string) error {
 	fmt.Fprintln(w, "NAMESPACE\tAPP-NS\tAPP\tFLUX-TYPE\tSOURCE-TYPE\tCLUSTER\tSTATUS\tMESSAGE")
 	for _, item := range list.Items {
 		labels := item.GetLabels()
+		// Applications are listed by the namespace of their Flux object
+		objectNs := appWorkloadNamespace(labels)
+		if !getCmdFlags.all && objectNs != namespace {
+			continue
+		}
 		// Extract the necessary fields from the Unstructured object
 		// This is just an example, you'll need to adjust based on the actual structure of your Argo CD objects
 		appType := labels["flamingo/workload-type"]
 		sourceType := labels["flamingo/source-type"]
-		objectNs := labels["flamingo/destination-namespace"]
 		clusterName := labels["flamingo/cluster-name"]
 		status, err := extractStatus(&item)
 		if err != nil {
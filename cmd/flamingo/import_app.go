@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	"github.com/spf13/cobra"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var importAppCmd = &cobra.Command{
+	Use:   "import-app APP_NAME",
+	Args:  cobra.ExactArgs(1),
+	Short: "Import an Argo CD application as Flux objects",
+	Long: `
+# Convert the Argo CD application podinfo into Flux objects in the current namespace (flux-system),
+# and turn the application into a Flamingo application.
+flamingo import-app podinfo
+
+# Print the Flux objects and the relabelled application of podinfo, created in the apps namespace.
+flamingo import-app -n apps podinfo --export
+`,
+	RunE: importAppCmdRun,
+}
+
+var importAppFlags struct {
+	export   bool
+	interval time.Duration
+}
+
+func init() {
+	importAppCmd.Flags().BoolVar(&importAppFlags.export, "export", false, "export the Flux objects and the relabelled application to stdout")
+	importAppCmd.Flags().DurationVar(&importAppFlags.interval, "interval", 10*time.Minute, "reconciliation interval of the generated Flux objects")
+
+	rootCmd.AddCommand(importAppCmd)
+}
+
+var (
+	commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	tagPattern    = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+)*([-+].*)?$`)
+)
+
+// importedApp is the result of the conversion of an application.
+type importedApp struct {
+	source     client.Object
+	workload   client.Object
+	sourceKind string
+	kind       string
+	// destinationCluster is the Flamingo cluster the Flux objects target through spec.kubeConfig, if any
+	destinationCluster string
+}
+
+func importAppCmdRun(_ *cobra.Command, args []string) error {
+	cli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+
+	app := &unstructured.Unstructured{}
+	app.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Application",
+	})
+	if err := cli.Get(context.Background(), client.ObjectKey{Namespace: rootArgs.applicationNamespace, Name: args[0]}, app); err != nil {
+		return err
+	}
+	if app.GetLabels()["app.kubernetes.io/managed-by"] == "flamingo" {
+		return fmt.Errorf("application %s is already managed by Flamingo", app.GetName())
+	}
+
+	registry := utils.NewClusterRegistry(cli, rootArgs.applicationNamespace)
+	imported, err := convertApp(context.Background(), registry, app, *kubeconfigArgs.Namespace)
+	if err != nil {
+		return fmt.Errorf("application %s: %w", app.GetName(), err)
+	}
+
+	fluxObjects, err := importedFluxObjects(imported)
+	if err != nil {
+		return err
+	}
+
+	patched := app.DeepCopy()
+	relabelImportedApp(patched, imported, *kubeconfigArgs.Namespace)
+
+	if importAppFlags.export {
+		fmt.Print(string(fluxObjects))
+		cleanAppForExport(patched)
+		data, err := utils.ToYAML(patched)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+		return nil
+	}
+
+	logger.Actionf("applying Flux objects of application %s in %s namespace", app.GetName(), *kubeconfigArgs.Namespace)
+	applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, fluxObjects)
+	if err != nil {
+		return fmt.Errorf("install failed: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, applyOutput)
+
+	logger.Actionf("relabelling application %s as a Flamingo application", app.GetName())
+	if err := cli.Patch(context.Background(), patched, client.MergeFrom(app)); err != nil {
+		return fmt.Errorf("relabelling application failed: %w", err)
+	}
+	logger.Successf("application %s imported as %s %s/%s", app.GetName(), imported.kind, *kubeconfigArgs.Namespace, app.GetName())
+	return nil
+}
+
+// convertApp converts an application with a Git, Helm or OCI source into a Flux source
+// and a Kustomization or a HelmRelease in the given namespace.
+func convertApp(ctx context.Context, registry *utils.ClusterRegistry, app *unstructured.Unstructured, namespace string) (*importedApp, error) {
+	if _, found, _ := unstructured.NestedSlice(app.Object, "spec", "sources"); found {
+		return nil, fmt.Errorf("applications with multiple sources are not supported")
+	}
+	source, found, err := unstructured.NestedMap(app.Object, "spec", "source")
+	if err != nil || !found {
+		return nil, fmt.Errorf("application has no source")
+	}
+	repoURL, _, _ := unstructured.NestedString(source, "repoURL")
+	revision, _, _ := unstructured.NestedString(source, "targetRevision")
+	chart, _, _ := unstructured.NestedString(source, "chart")
+	sourcePath, _, _ := unstructured.NestedString(source, "path")
+	helm, isHelm, _ := unstructured.NestedMap(source, "helm")
+	if repoURL == "" {
+		return nil, fmt.Errorf("application has no repoURL")
+	}
+	if _, found, _ := unstructured.NestedMap(source, "plugin"); found {
+		return nil, fmt.Errorf("applications with a config management plugin are not supported")
+	}
+
+	name := app.GetName()
+	interval := metav1.Duration{Duration: importAppFlags.interval}
+	objectMeta := metav1.ObjectMeta{Name: name, Namespace: namespace}
+
+	imported := &importedApp{}
+	kubeConfig, err := importDestination(ctx, registry, app, imported)
+	if err != nil {
+		return nil, err
+	}
+	destinationNamespace, _, _ := unstructured.NestedString(app.Object, "spec", "destination", "namespace")
+	prune, _, _ := unstructured.NestedBool(app.Object, "spec", "syncPolicy", "automated", "prune")
+
+	switch {
+	case chart != "":
+		// A Helm chart from a Helm repository, Argo CD keeps OCI repositories without scheme
+		repo := &sourcev1b2.HelmRepository{
+			TypeMeta:   metav1.TypeMeta{APIVersion: sourcev1b2.GroupVersion.String(), Kind: sourcev1b2.HelmRepositoryKind},
+			ObjectMeta: objectMeta,
+			Spec:       sourcev1b2.HelmRepositorySpec{URL: repoURL, Interval: interval},
+		}
+		if !strings.Contains(repoURL, "://") || strings.HasPrefix(repoURL, "oci://") {
+			repo.Spec.Type = sourcev1b2.HelmRepositoryTypeOCI
+			repo.Spec.URL = "oci://" + strings.TrimPrefix(repoURL, "oci://")
+		}
+		imported.source = repo
+		imported.sourceKind = sourcev1b2.HelmRepositoryKind
+		hr, err := importHelmRelease(objectMeta, interval, chart, revision, sourcev1b2.HelmRepositoryKind, helm)
+		if err != nil {
+			return nil, err
+		}
+		imported.workload = hr
+	case strings.HasPrefix(repoURL, "oci://"):
+		repo := &sourcev1b2.OCIRepository{
+			TypeMeta:   metav1.TypeMeta{APIVersion: sourcev1b2.GroupVersion.String(), Kind: sourcev1b2.OCIRepositoryKind},
+			ObjectMeta: objectMeta,
+			Spec: sourcev1b2.OCIRepositorySpec{
+				URL:       repoURL,
+				Reference: importOCIReference(revision),
+				Interval:  interval,
+			},
+		}
+		imported.source = repo
+		imported.sourceKind = sourcev1b2.OCIRepositoryKind
+	default:
+		repo := &sourcev1.GitRepository{
+			TypeMeta:   metav1.TypeMeta{APIVersion: sourcev1.GroupVersion.String(), Kind: sourcev1.GitRepositoryKind},
+			ObjectMeta: objectMeta,
+			Spec: sourcev1.GitRepositorySpec{
+				URL:       repoURL,
+				Reference: importGitReference(name, revision),
+				Interval:  interval,
+			},
+		}
+		imported.source = repo
+		imported.sourceKind = sourcev1.GitRepositoryKind
+	}
+
+	if imported.workload == nil && isHelm {
+		// A Helm chart stored in a path of a Git repository
+		if imported.sourceKind != sourcev1.GitRepositoryKind {
+			return nil, fmt.Errorf("Helm charts in a path of an OCI repository are not supported by HelmRelease v2beta1")
+		}
+		hr, err := importHelmRelease(objectMeta, interval, "./"+strings.TrimPrefix(sourcePath, "./"), "", imported.sourceKind, helm)
+		if err != nil {
+			return nil, err
+		}
+		imported.workload = hr
+	}
+
+	if hr, ok := imported.workload.(*helmv2b1.HelmRelease); ok {
+		imported.kind = helmv2b1.HelmReleaseKind
+		hr.Spec.TargetNamespace = destinationNamespace
+		hr.Spec.KubeConfig = kubeConfig
+		return imported, nil
+	}
+
+	ks := &kustomizev1.Kustomization{
+		TypeMeta:   metav1.TypeMeta{APIVersion: kustomizev1.GroupVersion.String(), Kind: kustomizev1.KustomizationKind},
+		ObjectMeta: objectMeta,
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:        interval,
+			Path:            "./" + strings.TrimPrefix(sourcePath, "./"),
+			Prune:           prune,
+			TargetNamespace: destinationNamespace,
+			KubeConfig:      kubeConfig,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Kind: imported.sourceKind,
+				Name: name,
+			},
+		},
+	}
+	if kustomizeOpts, found, _ := unstructured.NestedMap(source, "kustomize"); found {
+		images, _, _ := unstructured.NestedStringSlice(kustomizeOpts, "images")
+		for _, image := range images {
+			ks.Spec.Images = append(ks.Spec.Images, importImage(image))
+		}
+		for _, field := range []string{"namePrefix", "nameSuffix", "commonLabels", "commonAnnotations", "patches", "components"} {
+			if _, found := kustomizeOpts[field]; found {
+				logger.Warningf("kustomize option %s of application %s is not supported by Flux Kustomizations, it is ignored", field, name)
+			}
+		}
+	}
+	if _, found, _ := unstructured.NestedMap(source, "directory"); found {
+		logger.Warningf("directory options of application %s are not supported by Flux Kustomizations, they are ignored", name)
+	}
+	imported.workload = ks
+	imported.kind = kustomizev1.KustomizationKind
+	return imported, nil
+}
+
+// importedFluxObjects renders the Flux source and workload of an imported application as YAML.
+func importedFluxObjects(imported *importedApp) ([]byte, error) {
+	var out bytes.Buffer
+	for _, obj := range []client.Object{imported.source, imported.workload} {
+		data, err := utils.ToYAML(obj)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(data)
+	}
+	return out.Bytes(), nil
+}
+
+// importHelmRelease converts the Helm options of an application into a HelmRelease.
+func importHelmRelease(objectMeta metav1.ObjectMeta, interval metav1.Duration, chart, version, sourceKind string, helm map[string]interface{}) (*helmv2b1.HelmRelease, error) {
+	hr := &helmv2b1.HelmRelease{
+		TypeMeta:   metav1.TypeMeta{APIVersion: helmv2b1.GroupVersion.String(), Kind: helmv2b1.HelmReleaseKind},
+		ObjectMeta: objectMeta,
+		Spec: helmv2b1.HelmReleaseSpec{
+			Interval: interval,
+			Chart: helmv2b1.HelmChartTemplate{
+				Spec: helmv2b1.HelmChartTemplateSpec{
+					Chart:   chart,
+					Version: version,
+					SourceRef: helmv2b1.CrossNamespaceObjectReference{
+						Kind: sourceKind,
+						Name: objectMeta.Name,
+					},
+				},
+			},
+		},
+	}
+	if helm == nil {
+		return hr, nil
+	}
+
+	hr.Spec.ReleaseName, _, _ = unstructured.NestedString(helm, "releaseName")
+
+	values := map[string]interface{}{}
+	if raw, found, _ := unstructured.NestedString(helm, "values"); found && raw != "" {
+		if err := yaml.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, fmt.Errorf("invalid helm values: %w", err)
+		}
+	}
+	if obj, found, _ := unstructured.NestedMap(helm, "valuesObject"); found {
+		values = mergeValues(values, obj)
+	}
+	parameters, _, _ := unstructured.NestedSlice(helm, "parameters")
+	for _, p := range parameters {
+		param, _ := p.(map[string]interface{})
+		paramName, _ := param["name"].(string)
+		paramValue, _ := param["value"].(string)
+		if err := setValueAtPath(values, paramName, paramValue); err != nil {
+			return nil, fmt.Errorf("invalid helm parameter %q: %w", paramName, err)
+		}
+	}
+	if files, _, _ := unstructured.NestedStringSlice(helm, "valueFiles"); len(files) > 0 {
+		logger.Warningf("helm value files %s are not supported, use spec.valuesFrom in the HelmRelease", strings.Join(files, ","))
+	}
+
+	if len(values) > 0 {
+		data, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		hr.Spec.Values = &apiextensionsv1.JSON{Raw: raw}
+	}
+	return hr, nil
+}
+
+// importGitReference maps an Argo CD target revision to a GitRepository reference.
+func importGitReference(name, revision string) *sourcev1.GitRepositoryRef {
+	switch {
+	case revision == "" || revision == "HEAD":
+		logger.Warningf("application %s follows the default branch, which Flux cannot express: the GitRepository uses the master branch, set spec.ref.branch if needed", name)
+		return nil
+	case commitPattern.MatchString(revision):
+		return &sourcev1.GitRepositoryRef{Commit: revision}
+	case strings.HasPrefix(revision, "refs/"):
+		return &sourcev1.GitRepositoryRef{Name: revision}
+	case strings.ContainsAny(revision, "*^~<>=") || strings.Contains(revision, ".x"):
+		return &sourcev1.GitRepositoryRef{SemVer: revision}
+	case tagPattern.MatchString(revision):
+		return &sourcev1.GitRepositoryRef{Tag: revision}
+	default:
+		return &sourcev1.GitRepositoryRef{Branch: revision}
+	}
+}
+
+// importOCIReference maps an Argo CD target revision to an OCIRepository reference.
+func importOCIReference(revision string) *sourcev1b2.OCIRepositoryRef {
+	switch {
+	case revision == "":
+		return nil
+	case strings.HasPrefix(revision, "sha256:"):
+		return &sourcev1b2.OCIRepositoryRef{Digest: revision}
+	case strings.ContainsAny(revision, "*^~<>=") || strings.Contains(revision, ".x"):
+		return &sourcev1b2.OCIRepositoryRef{SemVer: revision}
+	default:
+		return &sourcev1b2.OCIRepositoryRef{Tag: revision}
+	}
+}
+
+// importImage parses an Argo CD kustomize image override, name=newName:newTag or name=newName@digest.
+func importImage(image string) kustomize.Image {
+	name, override, found := strings.Cut(image, "=")
+	if !found {
+		name, override = "", image
+	}
+	result := kustomize.Image{}
+	if digestIndex := strings.Index(override, "@"); digestIndex >= 0 {
+		result.NewName, result.Digest = override[:digestIndex], override[digestIndex+1:]
+	} else if tagIndex := strings.LastIndex(override, ":"); tagIndex > strings.LastIndex(override, "/") {
+		result.NewName, result.NewTag = override[:tagIndex], override[tagIndex+1:]
+	} else {
+		result.NewName = override
+	}
+	if name == "" {
+		name = result.NewName
+	}
+	result.Name = name
+	if result.NewName == name {
+		result.NewName = ""
+	}
+	return result
+}
+
+// importDestination maps the destination cluster of an application to a Flux kubeconfig reference,
+// using the Flux kubeconfig secret of the matching Flamingo cluster.
+func importDestination(ctx context.Context, registry *utils.ClusterRegistry, app *unstructured.Unstructured, imported *importedApp) (*meta.KubeConfigReference, error) {
+	server, _, _ := unstructured.NestedString(app.Object, "spec", "destination", "server")
+	clusterName, _, _ := unstructured.NestedString(app.Object, "spec", "destination", "name")
+	if server == utils.InClusterServer || clusterName == utils.InClusterName || (server == "" && clusterName == "") {
+		return nil, nil
+	}
+
+	clusters, err := registry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clusters {
+		if (server != "" && c.Server == server) || (clusterName != "" && c.Name == clusterName) {
+			imported.destinationCluster = c.Name
+			logger.Warningf("the Flux objects target cluster %s with the %s secret, it must exist in their namespace, see add-cluster --flux-kubeconfig-namespace", c.Name, utils.FluxKubeconfigSecretName(c.Name))
+			return &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: utils.FluxKubeconfigSecretName(c.Name),
+					Key:  utils.FluxKubeconfigKey,
+				},
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("destination cluster %s%s is not a Flamingo cluster, add it with add-cluster first", clusterName, server)
+}
+
+// relabelImportedApp marks the application as generated by Flamingo from the imported Flux objects.
+func relabelImportedApp(app *unstructured.Unstructured, imported *importedApp, namespace string) {
+	labels := app.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["app.kubernetes.io/managed-by"] = "flamingo"
+	labels["flamingo/workload-name"] = imported.workload.GetName()
+	labels["flamingo/workload-type"] = imported.kind
+	labels["flamingo/source-type"] = imported.sourceKind
+	labels[workloadNamespaceLabel] = namespace
+	if destination, _, _ := unstructured.NestedString(app.Object, "spec", "destination", "namespace"); destination != "" {
+		labels[destinationNamespaceLabel] = destination
+	}
+	// the Flux objects are created on the cluster running Flamingo, and target the destination through spec.kubeConfig
+	labels["flamingo/cluster-name"] = utils.InClusterName
+	if imported.destinationCluster != "" {
+		labels[destinationClusterLabel] = imported.destinationCluster
+	} else {
+		delete(labels, destinationClusterLabel)
+	}
+	app.SetLabels(labels)
+
+	options, _, _ := unstructured.NestedSlice(app.Object, "spec", "syncPolicy", "syncOptions")
+	options = mergeSyncOptions(options, []string{"FluxSubsystem=true"})
+	_ = unstructured.SetNestedSlice(app.Object, options, "spec", "syncPolicy", "syncOptions")
+}
+
+// cleanAppForExport removes the server-side fields of an application.
+func cleanAppForExport(app *unstructured.Unstructured) {
+	for _, field := range []string{"resourceVersion", "uid", "generation", "managedFields", "selfLink"} {
+		unstructured.RemoveNestedField(app.Object, "metadata", field)
+	}
+}
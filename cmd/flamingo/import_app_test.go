@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestConvertApp converts the application.yaml of each testdata/import directory
+// and compares the Flux objects and the relabelled application with flux.golden.yaml.
+func TestConvertApp(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "import", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no import test cases found")
+	}
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(dir, "application.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := &unstructured.Unstructured{}
+			if err := yaml.Unmarshal(data, &app.Object); err != nil {
+				t.Fatal(err)
+			}
+
+			c := fake.NewClientBuilder().WithScheme(utils.NewScheme()).Build()
+			registry := utils.NewClusterRegistry(c, rootArgs.applicationNamespace)
+			imported, err := convertApp(context.Background(), registry, app, "flux-system")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := importedFluxObjects(imported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relabelImportedApp(app, imported, "flux-system")
+			cleanAppForExport(app)
+			appData, err := utils.ToYAML(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, appData...)
+
+			golden := filepath.Join(dir, "flux.golden.yaml")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("converted objects differ from %s, run go test -run TestConvertApp -update to review the changes:\n%s", golden, got)
+			}
+		})
+	}
+}
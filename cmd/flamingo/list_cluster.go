@@ -5,10 +5,9 @@ import (
 	"fmt"
 	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
 	"github.com/spf13/cobra"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"os"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
 	"text/tabwriter"
 )
 
@@ -34,25 +33,43 @@ func listClusterCmdRun(_ *cobra.Command, _ []string) error {
 		return err
 	}
 	// list clusters
-	list := &corev1.SecretList{}
-	opts := &client.ListOptions{
-		Namespace: rootArgs.applicationNamespace,
-		LabelSelector: labels.SelectorFromSet(map[string]string{
-			"flamingo/cluster": "true",
-		}),
-	}
-	if err := cli.List(ctx.Background(), list, opts); err != nil {
+	registry := utils.NewClusterRegistry(cli, rootArgs.applicationNamespace)
+	clusters, err := registry.List(ctx.Background())
+	if err != nil {
 		return err
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "NAME\tEXTERNAL ADDRESS\tINTERNAL ADDRESS")
+	fmt.Fprintln(w, "NAME\tEXTERNAL ADDRESS\tINTERNAL ADDRESS\tPROJECT\tNAMESPACES\tCLUSTER RESOURCES\tLABELS")
 	// hard code in-cluster info
-	fmt.Fprintf(w, "%s\t%s\t%s\n", "in-cluster", "-", "https://kubernetes.default.svc")
-	for _, s := range list.Items {
-		fmt.Fprintf(w, "%s\t%s\t%s\n", string(s.Data["name"]), s.Annotations["flamingo/external-address"], s.Annotations["flamingo/internal-address"])
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", utils.InClusterName, "-", utils.InClusterServer, "-", "-", "-", "-")
+	for _, c := range clusters {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n",
+			c.Name,
+			c.ExternalAddress,
+			c.InternalAddress,
+			orDash(c.Project),
+			orDash(strings.Join(c.Namespaces, ",")),
+			c.ClusterResources,
+			orDash(formatLabels(c.Labels)))
 	}
 	w.Flush()
 
 	return nil
 }
+
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
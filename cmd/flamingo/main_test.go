@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// applications are only validated against their required fields, not against the CRD of the current cluster
+	appValidator.once.Do(func() {})
+	os.Exit(m.Run())
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	"github.com/fluxcd/pkg/ssa"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	inSyncStatus   = "in-sync"
+	orphanedStatus = "orphaned"
+	missingStatus  = "missing"
+	driftedStatus  = "drifted"
+)
+
+// reconciledFields are the fields of an application compared with its Flux object,
+// the other fields may be customized with the generate-app flags.
+var reconciledFields = [][]string{
+	{"spec", "source"},
+	{"spec", "destination"},
+}
+
+var reconcileAppsCmd = &cobra.Command{
+	Use:   "reconcile-apps",
+	Args:  cobra.NoArgs,
+	Short: "Detect and fix Flamingo applications out of sync with their Flux objects",
+	Long: `
+# Report the orphaned, missing and drifted applications of the Flux objects in the current namespace (flux-system).
+flamingo reconcile-apps --check
+
+# Regenerate the missing and drifted applications, and delete the orphaned applications, of all namespaces of the dev-1 cluster.
+flamingo reconcile-apps --fix --all-namespaces --cluster=dev-1
+`,
+	RunE: reconcileAppsCmdRun,
+}
+
+var reconcileAppsFlags struct {
+	check         bool
+	fix           bool
+	allNamespaces bool
+	cluster       string
+}
+
+func init() {
+	reconcileAppsCmd.Flags().BoolVar(&reconcileAppsFlags.check, "check", false, "report the orphaned, missing and drifted applications, and fail if there are any (default)")
+	reconcileAppsCmd.Flags().BoolVar(&reconcileAppsFlags.fix, "fix", false, "regenerate the missing and drifted applications, and delete the orphaned applications")
+	reconcileAppsCmd.Flags().BoolVarP(&reconcileAppsFlags.allNamespaces, "all-namespaces", "A", false, "reconcile the applications of Flux objects in all namespaces")
+	reconcileAppsCmd.Flags().StringVar(&reconcileAppsFlags.cluster, "cluster", "", "name of the cluster of the Flux objects")
+	reconcileAppsCmd.Flags().BoolVar(&generateAppFlags.includeSecrets, "include-secrets", false, "include values read from Secrets in the regenerated applications, the values are written in plain text")
+	reconcileAppsCmd.Flags().StringVar(&generateAppFlags.postBuildPlugin, "post-build-plugin", "", "name of the Argo CD config management plugin substituting the postBuild variables of Kustomizations")
+	reconcileAppsCmd.Flags().BoolVar(&generateAppFlags.pinRevision, "pin-revision", false, "use the exact revision of the last artifact fetched by the Flux sources as target revision")
+	reconcileAppsCmd.Flags().StringVar(&generateAppFlags.nameStrategy, "name-strategy", nameStrategyName, "how missing applications are named after their Flux object: name, namespace-name, cluster-namespace-name, or a Go template like '{{ .Namespace }}-{{ .Name }}'")
+
+	rootCmd.AddCommand(reconcileAppsCmd)
+}
+
+// appCheck is the outcome of comparing an application with its Flux object.
+type appCheck struct {
+	kind      string
+	namespace string
+	name      string
+	appName   string
+	status    string
+	message   string
+
+	app      *unstructured.Unstructured
+	expected *unstructured.Unstructured
+	diffs    []fieldDiff
+	workload *workload
+}
+
+// fieldDiff is a field of an application which differs from the freshly generated application.
+type fieldDiff struct {
+	path     string
+	current  string
+	expected string
+}
+
+func reconcileAppsCmdRun(_ *cobra.Command, _ []string) error {
+	if reconcileAppsFlags.check && reconcileAppsFlags.fix {
+		return fmt.Errorf("--check and --fix cannot be used together")
+	}
+	if err := validateNameStrategy(); err != nil {
+		return err
+	}
+
+	clusterName := reconcileAppsFlags.cluster
+	if clusterName == "" {
+		clusterName = utils.InClusterName
+	}
+	leafCli, cluster, err := clientForCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	mgmtCli, err := utils.KubeClient(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+
+	workloads, err := listWorkloads(leafCli, reconcileAppsFlags.allNamespaces, "")
+	if err != nil {
+		return err
+	}
+	apps, err := listClusterApps(mgmtCli, clusterName)
+	if err != nil {
+		return err
+	}
+
+	checks := checkApps(leafCli, clusterName, cluster.Server, workloads, apps)
+	if err := printReconcileReport(checks); err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, c := range checks {
+		counts[c.status]++
+	}
+	summary := fmt.Sprintf("%d orphaned, %d missing, %d drifted, %d failed", counts[orphanedStatus], counts[missingStatus], counts[driftedStatus], counts[failedStatus])
+	if counts[orphanedStatus]+counts[missingStatus]+counts[driftedStatus]+counts[failedStatus] == 0 {
+		logger.Successf("all %d applications are in sync with their Flux objects", counts[inSyncStatus])
+		return nil
+	}
+	if !reconcileAppsFlags.fix {
+		return fmt.Errorf("applications are out of sync with their Flux objects: %s", summary)
+	}
+
+	if err := fixApps(mgmtCli, leafCli, clusterName, cluster.Server, checks); err != nil {
+		return err
+	}
+	if counts[failedStatus] > 0 {
+		return fmt.Errorf("some applications could not be checked: %s", summary)
+	}
+	return nil
+}
+
+// listClusterApps returns the applications generated by Flamingo from the Flux objects of the given cluster,
+// except the applications of application sets, which are owned by their application set.
+func listClusterApps(c client.Client, clusterName string) ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Application",
+	})
+	if err := c.List(context.Background(), list,
+		client.InNamespace(rootArgs.applicationNamespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/managed-by": "flamingo",
+			"flamingo/cluster-name":        clusterName,
+		}); err != nil {
+		return nil, fmt.Errorf("listing applications failed: %w", err)
+	}
+
+	var apps []unstructured.Unstructured
+	for _, app := range list.Items {
+		ownedBySet := false
+		for _, ref := range app.GetOwnerReferences() {
+			if ref.Kind == "ApplicationSet" {
+				ownedBySet = true
+			}
+		}
+		if !ownedBySet {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+// checkApps compares every application with the application freshly generated from its Flux object,
+// and reports the Flux objects without an application.
+func checkApps(c client.Client, clusterName, server string, workloads []*workload, apps []unstructured.Unstructured) []*appCheck {
+	byKey := map[string]*workload{}
+	for _, w := range workloads {
+		byKey[w.kind+"/"+w.namespace+"/"+w.name] = w
+	}
+
+	var checks []*appCheck
+	found := map[*workload]bool{}
+	for i := range apps {
+		app := &apps[i]
+		labels := app.GetLabels()
+		namespace := appWorkloadNamespace(labels)
+		if !reconcileAppsFlags.allNamespaces && namespace != *kubeconfigArgs.Namespace {
+			continue
+		}
+
+		check := &appCheck{
+			kind:      labels["flamingo/workload-type"],
+			namespace: namespace,
+			name:      labels["flamingo/workload-name"],
+			appName:   app.GetName(),
+			app:       app,
+		}
+		checks = append(checks, check)
+
+		w, ok := byKey[check.kind+"/"+check.namespace+"/"+check.name]
+		if !ok {
+			check.status, check.message = orphanedStatus, fmt.Sprintf("%s %s/%s not found", check.kind, check.namespace, check.name)
+			continue
+		}
+		found[w] = true
+		if uid := labels[workloadUIDLabel]; uid != "" && uid != string(w.object().GetUID()) {
+			check.status, check.message = orphanedStatus, fmt.Sprintf("%s %s/%s was recreated", check.kind, check.namespace, check.name)
+			continue
+		}
+
+		expected, err := generateExpectedApp(c, w, app.GetName(), clusterName, server)
+		if err != nil {
+			check.status, check.message = failedStatus, err.Error()
+			continue
+		}
+		check.expected = expected
+		check.diffs = diffAppFields(app.Object, expected.Object)
+		check.status = inSyncStatus
+		if len(check.diffs) > 0 {
+			check.status = driftedStatus
+			check.message = fmt.Sprintf("%d fields differ", len(check.diffs))
+		}
+	}
+
+	for _, w := range workloads {
+		if found[w] {
+			continue
+		}
+		checks = append(checks, &appCheck{
+			kind:      w.kind,
+			namespace: w.namespace,
+			name:      w.name,
+			status:    missingStatus,
+			message:   "no application",
+			workload:  w,
+		})
+	}
+	return checks
+}
+
+// generateExpectedApp generates the application of the workload under the given name.
+func generateExpectedApp(c client.Client, w *workload, appName, clusterName, server string) (*unstructured.Unstructured, error) {
+	w.appName = appName
+	var tpl bytes.Buffer
+	if err := w.generate(c, clusterName, server, &tpl); err != nil {
+		return nil, err
+	}
+	objects, err := ssa.ReadObjects(bytes.NewReader(tpl.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return objects[0], nil
+}
+
+// diffAppFields returns the reconciled fields which differ between two applications, by field path.
+func diffAppFields(current, expected map[string]interface{}) []fieldDiff {
+	currentFields := map[string]string{}
+	expectedFields := map[string]string{}
+	for _, path := range reconciledFields {
+		value, _, _ := unstructured.NestedFieldNoCopy(current, path...)
+		flattenFields(strings.Join(path, "."), value, currentFields)
+		value, _, _ = unstructured.NestedFieldNoCopy(expected, path...)
+		flattenFields(strings.Join(path, "."), value, expectedFields)
+	}
+
+	paths := map[string]bool{}
+	for path := range currentFields {
+		paths[path] = true
+	}
+	for path := range expectedFields {
+		paths[path] = true
+	}
+	var diffs []fieldDiff
+	for path := range paths {
+		c, inCurrent := currentFields[path]
+		e, inExpected := expectedFields[path]
+		if c == e && inCurrent == inExpected {
+			continue
+		}
+		if !inCurrent {
+			c = "<none>"
+		}
+		if !inExpected {
+			e = "<none>"
+		}
+		diffs = append(diffs, fieldDiff{path: path, current: c, expected: e})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].path < diffs[j].path })
+	return diffs
+}
+
+// flattenFields collects the leaf values of an object by field path, like spec.source.helm.valuesObject.replicas.
+func flattenFields(path string, value interface{}, fields map[string]string) {
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, child := range v {
+			flattenFields(path+"."+k, child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenFields(fmt.Sprintf("%s[%d]", path, i), child, fields)
+		}
+	default:
+		fields[path] = fmt.Sprint(v)
+	}
+}
+
+// printReconcileReport prints the status of each application, then the fields of the drifted applications.
+func printReconcileReport(checks []*appCheck) error {
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tAPP\tSTATUS\tMESSAGE")
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.kind, c.namespace, c.name, c.appName, c.status, c.message)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	var drifted []*appCheck
+	for _, c := range checks {
+		if c.status == driftedStatus {
+			drifted = append(drifted, c)
+		}
+	}
+	if len(drifted) == 0 {
+		return nil
+	}
+	fmt.Fprintln(os.Stderr)
+	w = tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "APP\tFIELD\tCURRENT\tEXPECTED")
+	for _, c := range drifted {
+		for _, d := range c.diffs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.appName, d.path, d.current, d.expected)
+		}
+	}
+	return w.Flush()
+}
+
+// fixApps deletes the orphaned applications, sets the reconciled fields of the drifted applications
+// to their expected values, keeping their other fields, and generates the missing applications.
+// It fails after fixing all it can when some applications could not be fixed.
+func fixApps(mgmtCli, leafCli client.Client, clusterName, server string, checks []*appCheck) error {
+	unfixed := fixExistingApps(mgmtCli, checks)
+
+	var missing []*workload
+	for _, c := range checks {
+		if c.status == missingStatus {
+			missing = append(missing, c.workload)
+		}
+	}
+	if len(missing) > 0 {
+		all, failed, err := generateMissingApps(mgmtCli, leafCli, clusterName, server, missing)
+		if err != nil {
+			return err
+		}
+		unfixed = append(unfixed, failed...)
+		if len(all) > 0 {
+			logger.Actionf("applying missing applications in %s namespace", rootArgs.applicationNamespace)
+			applyOutput, err := utils.Apply(context.Background(), kubeconfigArgs, kubeclientOptions, all)
+			if err != nil {
+				return fmt.Errorf("install failed: %w", err)
+			}
+			fmt.Fprintln(os.Stderr, applyOutput)
+		}
+	}
+
+	if len(unfixed) > 0 {
+		return fmt.Errorf("%d applications could not be fixed: %s", len(unfixed), strings.Join(unfixed, "; "))
+	}
+	return nil
+}
+
+// fixExistingApps deletes the orphaned applications and updates the drifted applications,
+// and returns the applications it could not fix.
+func fixExistingApps(mgmtCli client.Client, checks []*appCheck) []string {
+	var unfixed []string
+	for _, c := range checks {
+		switch c.status {
+		case orphanedStatus:
+			if err := mgmtCli.Delete(context.Background(), c.app); client.IgnoreNotFound(err) != nil {
+				logger.Failuref("deleting application %s failed: %v", c.appName, err)
+				unfixed = append(unfixed, fmt.Sprintf("%s: %v", c.appName, err))
+				continue
+			}
+			logger.Successf("application %s deleted, %s", c.appName, c.message)
+		case driftedStatus:
+			if err := updateDriftedApp(mgmtCli, c); err != nil {
+				logger.Failuref("updating application %s failed: %v", c.appName, err)
+				unfixed = append(unfixed, fmt.Sprintf("%s: %v", c.appName, err))
+				continue
+			}
+			logger.Successf("application %s updated from %s %s/%s", c.appName, c.kind, c.namespace, c.name)
+		}
+	}
+	return unfixed
+}
+
+// updateDriftedApp sets the reconciled fields of the application to their expected values.
+func updateDriftedApp(mgmtCli client.Client, c *appCheck) error {
+	patch := client.MergeFrom(c.app.DeepCopy())
+	for _, path := range reconciledFields {
+		value, found, _ := unstructured.NestedFieldCopy(c.expected.Object, path...)
+		if !found {
+			unstructured.RemoveNestedField(c.app.Object, path...)
+			continue
+		}
+		if err := unstructured.SetNestedField(c.app.Object, value, path...); err != nil {
+			return err
+		}
+	}
+	return mgmtCli.Patch(context.Background(), c.app, patch)
+}
+
+// generateMissingApps generates the applications of the Flux objects without one, and returns them
+// with the Flux objects whose application could not be generated or whose name is taken.
+func generateMissingApps(mgmtCli, leafCli client.Client, clusterName, server string, missing []*workload) ([]byte, []string, error) {
+	if err := assignAppNames(missing, clusterName); err != nil {
+		return nil, nil, err
+	}
+	all := generateWorkloads(leafCli, mgmtCli, clusterName, server, missing)
+
+	var unfixed []string
+	for _, w := range missing {
+		switch w.status {
+		case failedStatus:
+			logger.Failuref("generating application for %s %s/%s failed: %s", w.kind, w.namespace, w.name, w.message)
+		case skippedStatus:
+			logger.Warningf("skipping %s %s/%s: %s", w.kind, w.namespace, w.name, w.message)
+		default:
+			continue
+		}
+		unfixed = append(unfixed, fmt.Sprintf("%s %s/%s: %s", w.kind, w.namespace, w.name, w.message))
+	}
+	return all, unfixed, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestReconciledApp returns the podinfo application with the given source.
+func newTestReconciledApp(name string, source map[string]interface{}) *unstructured.Unstructured {
+	app := newTestApp(name, map[string]string{"app.kubernetes.io/managed-by": "flamingo"})
+	app.Object["spec"] = map[string]interface{}{
+		"source": source,
+		"destination": map[string]interface{}{
+			"server":    utils.InClusterServer,
+			"namespace": "podinfo",
+		},
+		"syncPolicy": map[string]interface{}{
+			"automated": map[string]interface{}{"prune": true},
+		},
+	}
+	return app
+}
+
+func TestDiffAppFields(t *testing.T) {
+	source := func(modify func(source map[string]interface{})) map[string]interface{} {
+		source := map[string]interface{}{
+			"repoURL":        "https://github.com/stefanprodan/podinfo",
+			"path":           "./kustomize",
+			"targetRevision": "master",
+		}
+		if modify != nil {
+			modify(source)
+		}
+		return source
+	}
+
+	tests := []struct {
+		name    string
+		current func(app *unstructured.Unstructured)
+		want    []fieldDiff
+	}{
+		{name: "in sync"},
+		{
+			name: "changed field",
+			current: func(app *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(app.Object, "6.5.0", "spec", "source", "targetRevision")
+			},
+			want: []fieldDiff{{path: "spec.source.targetRevision", current: "6.5.0", expected: "master"}},
+		},
+		{
+			name: "missing and extra fields",
+			current: func(app *unstructured.Unstructured) {
+				unstructured.RemoveNestedField(app.Object, "spec", "source", "path")
+				_ = unstructured.SetNestedField(app.Object, "podinfo", "spec", "source", "chart")
+			},
+			want: []fieldDiff{
+				{path: "spec.source.chart", current: "podinfo", expected: "<none>"},
+				{path: "spec.source.path", current: "<none>", expected: "./kustomize"},
+			},
+		},
+		{
+			name: "list items",
+			current: func(app *unstructured.Unstructured) {
+				_ = unstructured.SetNestedStringSlice(app.Object, []string{"podinfo=podinfo:6.4.0"}, "spec", "source", "kustomize", "images")
+			},
+			want: []fieldDiff{{path: "spec.source.kustomize.images[0]", current: "podinfo=podinfo:6.4.0", expected: "<none>"}},
+		},
+		{
+			name: "destination",
+			current: func(app *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(app.Object, "default", "spec", "destination", "namespace")
+			},
+			want: []fieldDiff{{path: "spec.destination.namespace", current: "default", expected: "podinfo"}},
+		},
+		{
+			name: "customized fields are not reconciled",
+			current: func(app *unstructured.Unstructured) {
+				_ = unstructured.SetNestedField(app.Object, "team", "spec", "project")
+				_ = unstructured.SetNestedField(app.Object, false, "spec", "syncPolicy", "automated", "prune")
+				app.SetAnnotations(map[string]string{"team": "dev"})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := newTestReconciledApp("podinfo", source(nil))
+			current := newTestReconciledApp("podinfo", source(nil))
+			if tt.current != nil {
+				tt.current(current)
+			}
+
+			got := diffAppFields(current.Object, expected.Object)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffAppFields() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixExistingApps(t *testing.T) {
+	oldSource := map[string]interface{}{"repoURL": "https://github.com/stefanprodan/podinfo", "targetRevision": "6.4.0", "chart": "podinfo"}
+	newSource := map[string]interface{}{"repoURL": "https://github.com/stefanprodan/podinfo", "targetRevision": "master", "path": "./kustomize"}
+
+	tests := []struct {
+		name string
+		// the applications on the management cluster
+		existing []string
+		status   string
+		// the applications left on the management cluster
+		wantApps    []string
+		wantUnfixed string
+	}{
+		{name: "orphaned", existing: []string{"podinfo", "redis"}, status: orphanedStatus, wantApps: []string{"redis"}},
+		{name: "orphaned already deleted", existing: []string{"redis"}, status: orphanedStatus, wantApps: []string{"redis"}},
+		{name: "drifted", existing: []string{"podinfo", "redis"}, status: driftedStatus, wantApps: []string{"podinfo", "redis"}},
+		{name: "drifted deleted meanwhile", existing: []string{"redis"}, status: driftedStatus, wantApps: []string{"redis"}, wantUnfixed: "podinfo: "},
+		{name: "in sync", existing: []string{"podinfo"}, status: inSyncStatus, wantApps: []string{"podinfo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := newTestRESTMapper(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+			builder := fake.NewClientBuilder().WithRESTMapper(mapper)
+			for _, name := range tt.existing {
+				builder = builder.WithObjects(newTestReconciledApp(name, oldSource))
+			}
+			c := builder.Build()
+
+			app := newTestReconciledApp("podinfo", oldSource)
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(app), app); client.IgnoreNotFound(err) != nil {
+				t.Fatal(err)
+			}
+			expected := newTestReconciledApp("podinfo", newSource)
+			_ = unstructured.SetNestedField(expected.Object, false, "spec", "syncPolicy", "automated", "prune")
+			checks := []*appCheck{{
+				kind:      kustomizev1.KustomizationKind,
+				namespace: "flux-system",
+				name:      "podinfo",
+				appName:   "podinfo",
+				status:    tt.status,
+				app:       app,
+				expected:  expected,
+			}}
+
+			unfixed := fixExistingApps(c, checks)
+			if tt.wantUnfixed == "" && len(unfixed) > 0 {
+				t.Errorf("unfixed = %v, want none", unfixed)
+			}
+			if tt.wantUnfixed != "" && (len(unfixed) != 1 || !strings.HasPrefix(unfixed[0], tt.wantUnfixed)) {
+				t.Errorf("unfixed = %v, want %s", unfixed, tt.wantUnfixed)
+			}
+
+			for _, name := range []string{"podinfo", "redis"} {
+				got := newTestApp(name, nil)
+				err := c.Get(context.Background(), client.ObjectKeyFromObject(got), got)
+				if err != nil && !apierrors.IsNotFound(err) {
+					t.Fatal(err)
+				}
+				found := err == nil
+				want := false
+				for _, n := range tt.wantApps {
+					want = want || n == name
+				}
+				if found != want {
+					t.Errorf("application %s found = %v, want %v", name, found, want)
+				}
+				if !found || name != "podinfo" {
+					continue
+				}
+
+				source, _, _ := unstructured.NestedMap(got.Object, "spec", "source")
+				wantSource := oldSource
+				if tt.status == driftedStatus {
+					wantSource = newSource
+				}
+				if !reflect.DeepEqual(source, wantSource) {
+					t.Errorf("source = %v, want %v", source, wantSource)
+				}
+				// the sync policy is not reconciled
+				if prune, _, _ := unstructured.NestedBool(got.Object, "spec", "syncPolicy", "automated", "prune"); !prune {
+					t.Errorf("automated prune changed")
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateMissingApps(t *testing.T) {
+	repo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+		Spec: sourcev1.GitRepositorySpec{
+			URL:       "https://github.com/stefanprodan/podinfo",
+			Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+		},
+	}
+	podinfo := newTestKustomization("podinfo")
+	broken := newTestKustomization("broken")
+	broken.Spec.SourceRef.Name = "missing"
+	taken := newTestKustomization("taken")
+	leafCli := fake.NewClientBuilder().
+		WithScheme(utils.NewScheme()).
+		WithObjects(repo, podinfo, broken, taken).
+		Build()
+
+	mapper := newTestRESTMapper(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+	mgmtCli := fake.NewClientBuilder().
+		WithRESTMapper(mapper).
+		WithObjects(newTestApp("taken", map[string]string{"team": "dev"})).
+		Build()
+
+	var missing []*workload
+	for _, ks := range []*kustomizev1.Kustomization{podinfo, broken, taken} {
+		missing = append(missing, &workload{kind: kustomizev1.KustomizationKind, namespace: ks.Namespace, name: ks.Name, kustomization: ks})
+	}
+
+	all, unfixed, err := generateMissingApps(mgmtCli, leafCli, utils.InClusterName, utils.InClusterServer, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(all), "name: podinfo\n") {
+		t.Errorf("application podinfo not generated:\n%s", all)
+	}
+	for _, name := range []string{"broken", "taken"} {
+		if strings.Contains(string(all), "name: "+name+"\n") {
+			t.Errorf("application %s generated", name)
+		}
+	}
+	want := []string{"Kustomization flux-system/broken: ", "Kustomization flux-system/taken: application taken exists and is not managed by Flamingo"}
+	if len(unfixed) != len(want) {
+		t.Fatalf("unfixed = %v, want %d entries", unfixed, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(unfixed[i], want[i]) {
+			t.Errorf("unfixed[%d] = %s, want %s", i, unfixed[i], want[i])
+		}
+	}
+}
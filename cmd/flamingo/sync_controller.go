@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/pkg/ssa"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// syncedLabel marks the applications created by the sync controller,
+// only those are deleted when their Flux object goes away.
+const syncedLabel = "flamingo/synced"
+
+var syncControllerCmd = &cobra.Command{
+	Use:   "sync-controller",
+	Args:  cobra.NoArgs,
+	Short: "Keep Flamingo applications in sync with Flux Kustomizations and HelmReleases",
+	Long: `
+# Keep the applications of all Kustomizations and HelmReleases in the current namespace (flux-system) in sync.
+flamingo sync-controller
+
+# Keep the applications of all Kustomizations and HelmReleases labelled with team=dev in all namespaces in sync.
+flamingo sync-controller --all-namespaces --selector=team=dev
+
+# The same controller can be started from generate-app.
+flamingo generate-app --watch --all-namespaces
+`,
+	RunE: syncControllerCmdRun,
+}
+
+var syncControllerFlags struct {
+	allNamespaces bool
+	selector      string
+}
+
+func init() {
+	syncControllerCmd.Flags().BoolVarP(&syncControllerFlags.allNamespaces, "all-namespaces", "A", false, "watch Kustomizations and HelmReleases in all namespaces")
+	syncControllerCmd.Flags().StringVar(&syncControllerFlags.selector, "selector", "", "label selector to filter Kustomizations and HelmReleases")
+
+	syncControllerCmd.Flags().BoolVar(&generateAppFlags.includeSecrets, "include-secrets", false, "include values read from Secrets in the generated applications, the values are written in plain text")
+	syncControllerCmd.Flags().StringVar(&generateAppFlags.postBuildPlugin, "post-build-plugin", "", "name of the Argo CD config management plugin substituting the postBuild variables of Kustomizations")
+	addAppCustomizeFlags(syncControllerCmd.Flags())
+	syncControllerCmd.Flags().StringVar(&generateAppFlags.nameStrategy, "name-strategy", nameStrategyName, "how applications are named after their Flux object: name, namespace-name, cluster-namespace-name, or a Go template like '{{ .Namespace }}-{{ .Name }}'")
+	syncControllerCmd.Flags().BoolVar(&generateAppFlags.annotateSource, "annotate-source", false, "annotate the Flux objects with the namespace/name of their application")
+	syncControllerCmd.Flags().BoolVar(&generateAppFlags.pinRevision, "pin-revision", false, "use the exact revision of the last artifact fetched by the Flux sources as target revision")
+
+	rootCmd.AddCommand(syncControllerCmd)
+}
+
+func syncControllerCmdRun(_ *cobra.Command, _ []string) error {
+	if err := validateAppCustomizeFlags(); err != nil {
+		return err
+	}
+	if err := validateNameStrategy(); err != nil {
+		return err
+	}
+	return runSyncController(syncControllerFlags.allNamespaces, syncControllerFlags.selector)
+}
+
+// runSyncController watches Flux Kustomizations and HelmReleases, and their sources, and creates,
+// updates or deletes the matching Flamingo applications until the process is interrupted.
+func runSyncController(allNamespaces bool, selectorExpr string) error {
+	selector := labels.Everything()
+	if selectorExpr != "" {
+		var err error
+		selector, err = labels.Parse(selectorExpr)
+		if err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+	}
+
+	cfg, err := utils.KubeConfig(kubeconfigArgs, kubeclientOptions)
+	if err != nil {
+		return err
+	}
+
+	namespace := *kubeconfigArgs.Namespace
+	if allNamespaces {
+		namespace = ""
+	}
+	server := utils.InClusterServer
+	if generateAppFlags.server != "" {
+		server = generateAppFlags.server
+	}
+
+	mgr, err := newSyncManager(cfg, namespace, selector, server)
+	if err != nil {
+		return err
+	}
+
+	scope := namespace + " namespace"
+	if allNamespaces {
+		scope = "all namespaces"
+	}
+	logger.Actionf("watching Kustomizations and HelmReleases in %s", scope)
+
+	return mgr.Start(ctrl.SetupSignalHandler())
+}
+
+// newSyncManager returns a manager running the sync controllers of the Kustomizations and HelmReleases
+// in the given namespace, or in all namespaces when the namespace is empty.
+func newSyncManager(cfg *rest.Config, namespace string, selector labels.Selector, server string) (ctrl.Manager, error) {
+	cacheOpts := cache.Options{}
+	if namespace != "" {
+		cacheOpts.Namespaces = []string{namespace}
+	}
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme: utils.NewScheme(),
+		Cache:  cacheOpts,
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				// values are read from Secrets and ConfigMaps when generating, instead of caching them all
+				DisableFor: []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
+			},
+		},
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Flux objects are read from the cache, applications are unstructured objects, which are not cached
+	cli := utils.NewFluxClient(&namespacedClient{
+		Client:    mgr.GetClient(),
+		apiReader: mgr.GetAPIReader(),
+		namespace: namespace,
+	})
+
+	for _, kind := range []string{kustomizev1.KustomizationKind, helmv2b1.HelmReleaseKind} {
+		r := &appSyncReconciler{
+			client:    cli,
+			kind:      kind,
+			namespace: namespace,
+			selector:  selector,
+			server:    server,
+		}
+		if err := r.setupWithManager(mgr); err != nil {
+			return nil, err
+		}
+	}
+	return mgr, nil
+}
+
+// namespacedClient reads the objects of the watched namespace from the cache of the manager,
+// and the objects of other namespaces, like sources referenced across namespaces, from the API server.
+type namespacedClient struct {
+	client.Client
+	apiReader client.Reader
+	// namespace is the watched namespace, empty when all namespaces are watched
+	namespace string
+}
+
+func (c *namespacedClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if c.namespace != "" && key.Namespace != c.namespace {
+		return c.apiReader.Get(ctx, key, obj, opts...)
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c *namespacedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if listOpts := (&client.ListOptions{}).ApplyOptions(opts); c.namespace != "" && listOpts.Namespace != c.namespace {
+		return c.apiReader.List(ctx, list, opts...)
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+// appSyncReconciler keeps the application of each Flux object of one kind in sync.
+type appSyncReconciler struct {
+	client    client.Client
+	kind      string
+	namespace string
+	selector  labels.Selector
+	server    string
+}
+
+func (r *appSyncReconciler) setupWithManager(mgr ctrl.Manager) error {
+	var object client.Object
+	var sources []client.Object
+	switch r.kind {
+	case kustomizev1.KustomizationKind:
+		object = &kustomizev1.Kustomization{}
+		sources = []client.Object{&sourcev1.GitRepository{}, &sourcev1b2.OCIRepository{}}
+	case helmv2b1.HelmReleaseKind:
+		object = &helmv2b1.HelmRelease{}
+		sources = []client.Object{&sourcev1b2.HelmRepository{}, &sourcev1.GitRepository{}, &sourcev1b2.OCIRepository{}, &sourcev1b2.HelmChart{}}
+	}
+
+	// Kinds not served in the version of the Flamingo scheme are watched in their served version
+	object, err := utils.ServedObject(mgr.GetRESTMapper(), mgr.GetScheme(), object)
+	if err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("flamingo-"+r.kind).
+		For(object, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{})))
+	for _, source := range sources {
+		source, err := utils.ServedObject(mgr.GetRESTMapper(), mgr.GetScheme(), source)
+		if err != nil {
+			return err
+		}
+		b = b.Watches(source,
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSource),
+			builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, artifactRevisionChangedPredicate())))
+	}
+	return b.Complete(r)
+}
+
+// artifactRevisionChangedPredicate passes the updates of a source fetching a new artifact.
+// Pinned revisions, semver ranges and sources without a reference are resolved from the artifact,
+// which changes without a new generation of the source.
+func artifactRevisionChangedPredicate() predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return false
+			}
+			return sourceArtifactRevision(e.ObjectOld) != sourceArtifactRevision(e.ObjectNew)
+		},
+	}
+}
+
+// sourceArtifactRevision returns the status.artifact.revision of a typed or unstructured Flux source.
+func sourceArtifactRevision(source client.Object) string {
+	switch s := source.(type) {
+	case interface{ GetArtifact() *sourcev1.Artifact }:
+		return artifactRevision(s.GetArtifact())
+	case *unstructured.Unstructured:
+		revision, _, _ := unstructured.NestedString(s.Object, "status", "artifact", "revision")
+		return revision
+	}
+	return ""
+}
+
+// requestsForSource enqueues the Flux objects referencing a changed source.
+func (r *appSyncReconciler) requestsForSource(ctx context.Context, source client.Object) []reconcile.Request {
+	kind := source.GetObjectKind().GroupVersionKind().Kind
+	if kind == "" {
+		gvks, _, err := r.client.Scheme().ObjectKinds(source)
+		if err != nil || len(gvks) == 0 {
+			return nil
+		}
+		kind = gvks[0].Kind
+	}
+
+	var requests []reconcile.Request
+	add := func(namespace, name, refKind, refName, refNamespace string) {
+		if refNamespace == "" {
+			refNamespace = namespace
+		}
+		if refKind == kind && refName == source.GetName() && refNamespace == source.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}})
+		}
+	}
+
+	switch r.kind {
+	case kustomizev1.KustomizationKind:
+		list := &kustomizev1.KustomizationList{}
+		if err := r.client.List(ctx, list, client.InNamespace(r.namespace)); err != nil {
+			return nil
+		}
+		for _, item := range list.Items {
+			ref := item.Spec.SourceRef
+			add(item.Namespace, item.Name, ref.Kind, ref.Name, ref.Namespace)
+		}
+	case helmv2b1.HelmReleaseKind:
+		// spec.chartRef is only known to the HelmRelease API versions newer than v2beta1,
+		// the HelmReleases are listed in the version served by the cluster
+		gvk, err := utils.ServedGVK(r.client.RESTMapper(), helmv2b1.GroupVersion.WithKind(helmv2b1.HelmReleaseKind))
+		if err != nil {
+			return nil
+		}
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := r.client.List(ctx, list, client.InNamespace(r.namespace)); err != nil {
+			return nil
+		}
+		for _, item := range list.Items {
+			ref, _, _ := unstructured.NestedStringMap(item.Object, "spec", "chart", "spec", "sourceRef")
+			add(item.GetNamespace(), item.GetName(), ref["kind"], ref["name"], ref["namespace"])
+			ref, _, _ = unstructured.NestedStringMap(item.Object, "spec", "chartRef")
+			add(item.GetNamespace(), item.GetName(), ref["kind"], ref["name"], ref["namespace"])
+		}
+	}
+	return requests
+}
+
+func (r *appSyncReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var object client.Object
+	switch r.kind {
+	case kustomizev1.KustomizationKind:
+		object = &kustomizev1.Kustomization{}
+	case helmv2b1.HelmReleaseKind:
+		object = &helmv2b1.HelmRelease{}
+	}
+
+	err := r.client.Get(ctx, req.NamespacedName, object)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if apierrors.IsNotFound(err) || !r.selector.Matches(labels.Set(object.GetLabels())) {
+		return ctrl.Result{}, r.deleteApps(ctx, req)
+	}
+
+	appName, err := r.appName(ctx, req)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var tpl bytes.Buffer
+	switch o := object.(type) {
+	case *kustomizev1.Kustomization:
+		err = generateKustomizationApp(r.client, appName, o, utils.InClusterName, r.server, &tpl)
+	case *helmv2b1.HelmRelease:
+		err = generateHelmReleaseApp(r.client, appName, o, utils.InClusterName, r.server, &tpl)
+	}
+	if err != nil {
+		logger.Failuref("generating application for %s %s failed: %v", r.kind, req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+
+	objs, err := ssa.ReadObjects(bytes.NewReader(tpl.Bytes()))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, u := range objs {
+		conflict, err := appNameConflict(r.client, u)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// retrying cannot resolve a name conflict, the object is synced again once it changes
+		if conflict != "" {
+			logger.Failuref("application for %s %s not synced: %s", r.kind, req.NamespacedName, conflict)
+			return ctrl.Result{}, nil
+		}
+		u.SetLabels(mergeLabels(u.GetLabels(), map[string]string{syncedLabel: "true"}))
+		if err := r.client.Patch(ctx, u, client.Apply, client.FieldOwner("flamingo"), client.ForceOwnership); err != nil {
+			return ctrl.Result{}, err
+		}
+		if generateAppFlags.annotateSource {
+			if err := annotateSource(r.client, u); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	logger.Successf("application %s synced with %s %s", appName, r.kind, req.NamespacedName)
+
+	return ctrl.Result{}, nil
+}
+
+// findApps returns the applications generated from the given Flux object on this cluster.
+func (r *appSyncReconciler) findApps(ctx context.Context, req ctrl.Request) ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Application",
+	})
+	if err := r.client.List(ctx, list,
+		client.InNamespace(rootArgs.applicationNamespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/managed-by": "flamingo",
+			"flamingo/workload-name":       req.Name,
+			"flamingo/workload-type":       r.kind,
+		}); err != nil {
+		return nil, err
+	}
+
+	var apps []unstructured.Unstructured
+	for _, app := range list.Items {
+		if appWorkloadNamespace(app.GetLabels()) != req.Namespace {
+			continue
+		}
+		// applications generated from leaf clusters share the same labels
+		if app.GetLabels()[syncedLabel] == "true" || app.GetLabels()["flamingo/cluster-name"] == utils.InClusterName {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+// appName reuses the name of an existing application of the Flux object, or names it according to --name-strategy.
+// With the default strategy, the namespace is added when the object name is already used by another application.
+func (r *appSyncReconciler) appName(ctx context.Context, req ctrl.Request) (string, error) {
+	apps, err := r.findApps(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if len(apps) > 0 {
+		return apps[0].GetName(), nil
+	}
+
+	appName, err := appNameFor(utils.InClusterName, req.Namespace, req.Name, r.kind)
+	if err != nil {
+		return "", err
+	}
+	if generateAppFlags.nameStrategy != nameStrategyName {
+		return appName, nil
+	}
+
+	app := &unstructured.Unstructured{}
+	app.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "argoproj.io",
+		Version: "v1alpha1",
+		Kind:    "Application",
+	})
+	err = r.client.Get(ctx, client.ObjectKey{Namespace: rootArgs.applicationNamespace, Name: appName}, app)
+	if apierrors.IsNotFound(err) {
+		return appName, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return toAppName(req.Name + "-" + req.Namespace), nil
+}
+
+// deleteApps deletes the applications the sync controller created for the given Flux object.
+func (r *appSyncReconciler) deleteApps(ctx context.Context, req ctrl.Request) error {
+	apps, err := r.findApps(ctx, req)
+	if err != nil {
+		return err
+	}
+	for i := range apps {
+		if apps[i].GetLabels()[syncedLabel] != "true" {
+			continue
+		}
+		if err := r.client.Delete(ctx, &apps[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		logger.Successf("application %s deleted, %s %s is gone", apps[i].GetName(), r.kind, req.NamespacedName)
+	}
+	return nil
+}
+
+func mergeLabels(labels map[string]string, extra map[string]string) map[string]string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
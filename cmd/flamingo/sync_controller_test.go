@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/flux-subsystem-argo/flamingo/pkg/utils"
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// newTestRESTMapper returns a REST mapper serving only the given versions of the kinds.
+func newTestRESTMapper(gvks ...schema.GroupVersionKind) meta.RESTMapper {
+	var versions []schema.GroupVersion
+	for _, gvk := range gvks {
+		versions = append(versions, gvk.GroupVersion())
+	}
+	mapper := meta.NewDefaultRESTMapper(versions)
+	for _, gvk := range gvks {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	return mapper
+}
+
+// newHelmReleaseV2 returns a HelmRelease of the v2 API, unknown to the Flamingo scheme.
+func newHelmReleaseV2(namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetGroupVersionKind(schema.GroupVersionKind{Group: helmv2b1.GroupVersion.Group, Version: "v2", Kind: helmv2b1.HelmReleaseKind})
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func TestRequestsForSource(t *testing.T) {
+	mapper := newTestRESTMapper(
+		kustomizev1.GroupVersion.WithKind(kustomizev1.KustomizationKind),
+		schema.GroupVersionKind{Group: helmv2b1.GroupVersion.Group, Version: "v2", Kind: helmv2b1.HelmReleaseKind},
+		sourcev1.GroupVersion.WithKind(sourcev1.GitRepositoryKind),
+		sourcev1b2.GroupVersion.WithKind(sourcev1b2.HelmRepositoryKind),
+		sourcev1b2.GroupVersion.WithKind(sourcev1b2.OCIRepositoryKind),
+		sourcev1b2.GroupVersion.WithKind(sourcev1b2.HelmChartKind),
+	)
+	objects := []client.Object{
+		&kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "apps"},
+			Spec: kustomizev1.KustomizationSpec{
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{Kind: sourcev1.GitRepositoryKind, Name: "flux-system"},
+			},
+		},
+		newHelmReleaseV2("flux-system", "podinfo", map[string]interface{}{
+			"chart": map[string]interface{}{"spec": map[string]interface{}{
+				"chart":     "podinfo",
+				"sourceRef": map[string]interface{}{"kind": sourcev1b2.HelmRepositoryKind, "name": "podinfo"},
+			}},
+		}),
+		newHelmReleaseV2("flux-system", "podinfo-oci", map[string]interface{}{
+			"chartRef": map[string]interface{}{"kind": sourcev1b2.OCIRepositoryKind, "name": "podinfo"},
+		}),
+		newHelmReleaseV2("flux-system", "podinfo-chart", map[string]interface{}{
+			"chartRef": map[string]interface{}{"kind": sourcev1b2.HelmChartKind, "name": "podinfo", "namespace": "charts"},
+		}),
+		newHelmReleaseV2("team", "podinfo-oci", map[string]interface{}{
+			"chartRef": map[string]interface{}{"kind": sourcev1b2.OCIRepositoryKind, "name": "podinfo", "namespace": "flux-system"},
+		}),
+	}
+	c := utils.NewFluxClient(fake.NewClientBuilder().
+		WithScheme(utils.NewScheme()).
+		WithRESTMapper(mapper).
+		WithObjects(objects...).
+		Build())
+
+	tests := []struct {
+		name      string
+		kind      string
+		namespace string
+		source    client.Object
+		want      []string
+	}{
+		{
+			name:      "Kustomization sourceRef",
+			kind:      kustomizev1.KustomizationKind,
+			namespace: "flux-system",
+			source:    &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "flux-system"}},
+			want:      []string{"flux-system/apps"},
+		},
+		{
+			name:      "HelmRelease chart sourceRef",
+			kind:      helmv2b1.HelmReleaseKind,
+			namespace: "flux-system",
+			source:    &sourcev1b2.HelmRepository{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"}},
+			want:      []string{"flux-system/podinfo"},
+		},
+		{
+			name:      "HelmRelease chartRef to an OCIRepository in the watched namespace",
+			kind:      helmv2b1.HelmReleaseKind,
+			namespace: "flux-system",
+			source:    &sourcev1b2.OCIRepository{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"}},
+			want:      []string{"flux-system/podinfo-oci"},
+		},
+		{
+			name:   "HelmRelease chartRef to an OCIRepository in all namespaces",
+			kind:   helmv2b1.HelmReleaseKind,
+			source: &sourcev1b2.OCIRepository{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"}},
+			want:   []string{"flux-system/podinfo-oci", "team/podinfo-oci"},
+		},
+		{
+			name:      "HelmRelease chartRef to a HelmChart in another namespace",
+			kind:      helmv2b1.HelmReleaseKind,
+			namespace: "flux-system",
+			source:    &sourcev1b2.HelmChart{ObjectMeta: metav1.ObjectMeta{Namespace: "charts", Name: "podinfo"}},
+			want:      []string{"flux-system/podinfo-chart"},
+		},
+		{
+			name:      "unrelated source",
+			kind:      helmv2b1.HelmReleaseKind,
+			namespace: "flux-system",
+			source:    &sourcev1.GitRepository{ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &appSyncReconciler{client: c, kind: tt.kind, namespace: tt.namespace}
+			var got []string
+			for _, req := range r.requestsForSource(context.Background(), tt.source) {
+				got = append(got, req.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestsForSource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSyncController runs the sync controller against a test API server, provisioned by:
+//
+//	make test
+func TestSyncController(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set")
+	}
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("testdata", "crds")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = env.Stop() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c, err := client.New(cfg, client.Options{Scheme: utils.NewScheme()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"flux-system", rootArgs.applicationNamespace} {
+		if err := c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mgr, err := newSyncManager(cfg, "flux-system", labels.Everything(), utils.InClusterServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	t.Run("Kustomization follows its GitRepository", func(t *testing.T) {
+		repo := &sourcev1.GitRepository{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+			Spec: sourcev1.GitRepositorySpec{
+				URL:       "https://github.com/stefanprodan/podinfo",
+				Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+				Interval:  metav1.Duration{Duration: time.Minute},
+			},
+		}
+		if err := c.Create(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		ks := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+			Spec: kustomizev1.KustomizationSpec{
+				Path:      "./kustomize",
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{Kind: sourcev1.GitRepositoryKind, Name: "podinfo"},
+				Interval:  metav1.Duration{Duration: time.Minute},
+			},
+		}
+		if err := c.Create(ctx, ks); err != nil {
+			t.Fatal(err)
+		}
+		waitForAppField(t, c, "podinfo", "master", "spec", "source", "targetRevision")
+
+		repo.Spec.Reference.Branch = "main"
+		if err := c.Update(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		waitForAppField(t, c, "podinfo", "main", "spec", "source", "targetRevision")
+
+		if err := c.Delete(ctx, ks); err != nil {
+			t.Fatal(err)
+		}
+		waitForApp(t, c, "podinfo", func(app *unstructured.Unstructured) bool { return app == nil })
+	})
+
+	t.Run("HelmRelease follows its chartRef OCIRepository", func(t *testing.T) {
+		repo := &sourcev1b2.OCIRepository{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+			Spec: sourcev1b2.OCIRepositorySpec{
+				URL:       "oci://ghcr.io/stefanprodan/charts/podinfo",
+				Reference: &sourcev1b2.OCIRepositoryRef{Tag: "6.5.0"},
+				Interval:  metav1.Duration{Duration: time.Minute},
+			},
+		}
+		if err := c.Create(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		hr := newHelmReleaseV2("flux-system", "podinfo-helm", map[string]interface{}{
+			"interval": "1m",
+			"chartRef": map[string]interface{}{"kind": sourcev1b2.OCIRepositoryKind, "name": "podinfo"},
+		})
+		if err := c.Create(ctx, hr); err != nil {
+			t.Fatal(err)
+		}
+		waitForAppField(t, c, "podinfo-helm", "6.5.0", "spec", "source", "targetRevision")
+
+		repo.Spec.Reference.Tag = "6.6.0"
+		if err := c.Update(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		waitForAppField(t, c, "podinfo-helm", "6.6.0", "spec", "source", "targetRevision")
+	})
+
+	t.Run("Kustomization follows the artifact of its semver GitRepository", func(t *testing.T) {
+		repo := &sourcev1.GitRepository{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo-semver"},
+			Spec: sourcev1.GitRepositorySpec{
+				URL:       "https://github.com/stefanprodan/podinfo",
+				Reference: &sourcev1.GitRepositoryRef{SemVer: ">=6.0.0"},
+				Interval:  metav1.Duration{Duration: time.Minute},
+			},
+		}
+		if err := c.Create(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		setArtifact := func(revision string) {
+			t.Helper()
+			repo.Status.Artifact = &sourcev1.Artifact{Path: "podinfo.tar.gz", URL: "http://source-controller/podinfo.tar.gz", Revision: revision, LastUpdateTime: metav1.Now()}
+			if err := c.Status().Update(ctx, repo); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setArtifact("6.5.0@sha1:" + testGitCommit)
+		ks := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo-semver"},
+			Spec: kustomizev1.KustomizationSpec{
+				Path:      "./kustomize",
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{Kind: sourcev1.GitRepositoryKind, Name: "podinfo-semver"},
+				Interval:  metav1.Duration{Duration: time.Minute},
+			},
+		}
+		if err := c.Create(ctx, ks); err != nil {
+			t.Fatal(err)
+		}
+		waitForAppField(t, c, "podinfo-semver", "6.5.0", "spec", "source", "targetRevision")
+
+		// a new artifact does not change the generation of the source
+		setArtifact("6.6.0@sha1:" + testGitCommit)
+		waitForAppField(t, c, "podinfo-semver", "6.6.0", "spec", "source", "targetRevision")
+	})
+}
+
+func TestArtifactRevisionChangedPredicate(t *testing.T) {
+	typed := func(revision string) client.Object {
+		repo := &sourcev1.GitRepository{}
+		if revision != "" {
+			repo.Status.Artifact = &sourcev1.Artifact{Revision: revision}
+		}
+		return repo
+	}
+	untyped := func(revision string) client.Object {
+		repo := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		if revision != "" {
+			_ = unstructured.SetNestedField(repo.Object, revision, "status", "artifact", "revision")
+		}
+		return repo
+	}
+
+	tests := []struct {
+		name     string
+		old, new client.Object
+		want     bool
+	}{
+		{name: "same revision", old: typed("main@sha1:a"), new: typed("main@sha1:a"), want: false},
+		{name: "new revision", old: typed("main@sha1:a"), new: typed("main@sha1:b"), want: true},
+		{name: "first artifact", old: typed(""), new: typed("main@sha1:a"), want: true},
+		{name: "same unstructured revision", old: untyped("6.5.0@sha256:a"), new: untyped("6.5.0@sha256:a"), want: false},
+		{name: "new unstructured revision", old: untyped("6.5.0@sha256:a"), new: untyped("6.6.0@sha256:b"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := artifactRevisionChangedPredicate().Update(event.UpdateEvent{ObjectOld: tt.old, ObjectNew: tt.new}); got != tt.want {
+				t.Errorf("Update() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// waitForAppField waits until the field of the application has the expected value.
+func waitForAppField(t *testing.T, c client.Client, name, want string, fields ...string) {
+	t.Helper()
+	waitForApp(t, c, name, func(app *unstructured.Unstructured) bool {
+		if app == nil {
+			return false
+		}
+		got, _, _ := unstructured.NestedString(app.Object, fields...)
+		return got == want
+	})
+}
+
+// waitForApp waits until the condition holds for the application, nil when it does not exist.
+func waitForApp(t *testing.T, c client.Client, name string, condition func(app *unstructured.Unstructured) bool) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		app := &unstructured.Unstructured{}
+		app.SetGroupVersionKind(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"})
+		err := c.Get(context.Background(), client.ObjectKey{Namespace: rootArgs.applicationNamespace, Name: name}, app)
+		if client.IgnoreNotFound(err) != nil {
+			t.Fatal(err)
+		}
+		if err != nil {
+			app = nil
+		}
+		if condition(app) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for application %s, last seen: %v", name, app)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestReconcileNameConflict(t *testing.T) {
+	repo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "podinfo"},
+		Spec: sourcev1.GitRepositorySpec{
+			URL:       "https://github.com/stefanprodan/podinfo",
+			Reference: &sourcev1.GitRepositoryRef{Branch: "master"},
+		},
+	}
+	ks := newTestKustomization("podinfo")
+	// both candidate names are taken by applications not managed by Flamingo
+	taken := newTestApp("podinfo", map[string]string{"team": "dev"})
+	takenToo := newTestApp("podinfo-flux-system", map[string]string{"team": "dev"})
+	mapper := newTestRESTMapper(
+		schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Application"},
+		kustomizev1.GroupVersion.WithKind(kustomizev1.KustomizationKind),
+		sourcev1.GroupVersion.WithKind(sourcev1.GitRepositoryKind),
+	)
+	c := fake.NewClientBuilder().
+		WithScheme(utils.NewScheme()).
+		WithRESTMapper(mapper).
+		WithObjects(repo, ks, taken, takenToo).
+		Build()
+
+	r := &appSyncReconciler{
+		client:   c,
+		kind:     kustomizev1.KustomizationKind,
+		selector: labels.Everything(),
+		server:   utils.InClusterServer,
+	}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ks)})
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v, want no retry on name conflicts", err)
+	}
+	if result.Requeue || result.RequeueAfter > 0 {
+		t.Errorf("Reconcile() = %+v, want no requeue", result)
+	}
+
+	for _, app := range []*unstructured.Unstructured{taken, takenToo} {
+		got := newTestApp(app.GetName(), nil)
+		if err := c.Get(context.Background(), client.ObjectKeyFromObject(got), got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.GetLabels(), app.GetLabels()) {
+			t.Errorf("application %s labels = %v, want %v", app.GetName(), got.GetLabels(), app.GetLabels())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiservervalidation "k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ApplicationAPIVersion is the API version of Argo CD Applications.
+	ApplicationAPIVersion = "argoproj.io/v1alpha1"
+	// ApplicationKind is the kind of Argo CD Applications.
+	ApplicationKind = "Application"
+	// ApplicationCRDName is the name of the Argo CD Application CRD.
+	ApplicationCRDName = "applications.argoproj.io"
+)
+
+// Application is the part of an Argo CD Application generated by Flamingo.
+type Application struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec ApplicationSpec `json:"spec"`
+}
+
+// ApplicationSpec is the spec of an Argo CD Application.
+type ApplicationSpec struct {
+	Destination ApplicationDestination `json:"destination"`
+	Project     string                 `json:"project"`
+	Source      *ApplicationSource     `json:"source,omitempty"`
+	SyncPolicy  *SyncPolicy            `json:"syncPolicy,omitempty"`
+}
+
+// ApplicationDestination is the cluster and namespace an Argo CD Application deploys to.
+type ApplicationDestination struct {
+	Server    string `json:"server,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// ApplicationSource is the repository an Argo CD Application deploys from.
+type ApplicationSource struct {
+	RepoURL        string                      `json:"repoURL"`
+	Path           string                      `json:"path,omitempty"`
+	TargetRevision string                      `json:"targetRevision,omitempty"`
+	Chart          string                      `json:"chart,omitempty"`
+	Helm           *ApplicationSourceHelm      `json:"helm,omitempty"`
+	Kustomize      *ApplicationSourceKustomize `json:"kustomize,omitempty"`
+	Plugin         *ApplicationSourcePlugin    `json:"plugin,omitempty"`
+}
+
+// ApplicationSourceHelm holds the Helm options of an Argo CD Application.
+type ApplicationSourceHelm struct {
+	ReleaseName  string                 `json:"releaseName,omitempty"`
+	ValueFiles   []string               `json:"valueFiles,omitempty"`
+	ValuesObject map[string]interface{} `json:"valuesObject,omitempty"`
+	SkipCrds     bool                   `json:"skipCrds,omitempty"`
+}
+
+// ApplicationSourceKustomize holds the kustomize options of an Argo CD Application.
+type ApplicationSourceKustomize struct {
+	Images []string `json:"images,omitempty"`
+}
+
+// ApplicationSourcePlugin renders an Argo CD Application with a config management plugin.
+type ApplicationSourcePlugin struct {
+	Name string     `json:"name,omitempty"`
+	Env  []EnvEntry `json:"env,omitempty"`
+}
+
+// EnvEntry is an environment variable passed to a config management plugin.
+type EnvEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SyncPolicy is the sync policy of an Argo CD Application.
+type SyncPolicy struct {
+	Automated   *SyncPolicyAutomated `json:"automated,omitempty"`
+	SyncOptions []string             `json:"syncOptions,omitempty"`
+}
+
+// SyncPolicyAutomated enables the automated sync of an Argo CD Application.
+type SyncPolicyAutomated struct {
+	Prune    bool `json:"prune"`
+	SelfHeal bool `json:"selfHeal,omitempty"`
+}
+
+// NewApplication returns an empty Argo CD Application.
+func NewApplication(name, namespace string) *Application {
+	return &Application{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: ApplicationAPIVersion,
+			Kind:       ApplicationKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+		},
+	}
+}
+
+// ApplicationFromUnstructured converts an unstructured object into an Application.
+func ApplicationFromUnstructured(obj map[string]interface{}) (*Application, error) {
+	app := &Application{}
+	if err := apiruntime.DefaultUnstructuredConverter.FromUnstructured(obj, app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// ToUnstructured converts the Application into an unstructured object, without the empty creationTimestamp.
+func (a *Application) ToUnstructured() (map[string]interface{}, error) {
+	obj, err := apiruntime.DefaultUnstructuredConverter.ToUnstructured(a)
+	if err != nil {
+		return nil, err
+	}
+	unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+	return obj, nil
+}
+
+// Validate checks the fields Argo CD requires to sync the Application.
+// It does not need the Application CRD, and is the only validation when its schema cannot be read.
+func (a *Application) Validate() field.ErrorList {
+	var errs field.ErrorList
+
+	metadata := field.NewPath("metadata")
+	if a.Name == "" {
+		errs = append(errs, field.Required(metadata.Child("name"), ""))
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(a.Name) {
+			errs = append(errs, field.Invalid(metadata.Child("name"), a.Name, msg))
+		}
+	}
+	if a.Namespace == "" {
+		errs = append(errs, field.Required(metadata.Child("namespace"), ""))
+	}
+	for k, v := range a.Labels {
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, field.Invalid(metadata.Child("labels").Key(k), v, msg))
+		}
+	}
+
+	spec := field.NewPath("spec")
+	if a.Spec.Project == "" {
+		errs = append(errs, field.Required(spec.Child("project"), ""))
+	}
+	if a.Spec.Destination.Server == "" && a.Spec.Destination.Name == "" {
+		errs = append(errs, field.Required(spec.Child("destination", "server"), "either server or name is required"))
+	}
+
+	source := spec.Child("source")
+	if a.Spec.Source == nil {
+		return append(errs, field.Required(source, ""))
+	}
+	if a.Spec.Source.RepoURL == "" {
+		errs = append(errs, field.Required(source.Child("repoURL"), ""))
+	}
+	if a.Spec.Source.Helm != nil && a.Spec.Source.Chart == "" && a.Spec.Source.Path == "" {
+		errs = append(errs, field.Required(source.Child("chart"), "either chart or path is required for Helm sources"))
+	}
+	return errs
+}
+
+// ApplicationValidator validates Applications against the OpenAPI schema of the Application CRD installed in a cluster.
+type ApplicationValidator struct {
+	validator *validate.SchemaValidator
+}
+
+// NewApplicationValidator reads the schema of the Application CRD from the cluster.
+// It returns an error when the CRD is not installed, cannot be read, or does not serve ApplicationAPIVersion.
+func NewApplicationValidator(ctx context.Context, c client.Client) (*ApplicationValidator, error) {
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := c.Get(ctx, client.ObjectKey{Name: ApplicationCRDName}, crd); err != nil {
+		return nil, err
+	}
+
+	for _, version := range crd.Spec.Versions {
+		if crd.Spec.Group+"/"+version.Name != ApplicationAPIVersion {
+			continue
+		}
+		if version.Schema == nil {
+			return nil, fmt.Errorf("CRD %s has no schema for version %s", ApplicationCRDName, version.Name)
+		}
+		internal := &apiextensions.CustomResourceValidation{}
+		if err := apiextensionsv1.Convert_v1_CustomResourceValidation_To_apiextensions_CustomResourceValidation(version.Schema, internal, nil); err != nil {
+			return nil, err
+		}
+		validator, _, err := apiservervalidation.NewSchemaValidator(internal)
+		if err != nil {
+			return nil, err
+		}
+		return &ApplicationValidator{validator: validator}, nil
+	}
+	return nil, fmt.Errorf("CRD %s does not serve %s", ApplicationCRDName, ApplicationAPIVersion)
+}
+
+// Validate validates an unstructured Application against the CRD schema.
+func (v *ApplicationValidator) Validate(obj map[string]interface{}) field.ErrorList {
+	return apiservervalidation.ValidateCustomResource(nil, obj, v.validator)
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestApplication() *Application {
+	app := NewApplication("podinfo", "argocd")
+	app.Labels["flamingo/workload-name"] = "podinfo"
+	app.Spec = ApplicationSpec{
+		Project:     "default",
+		Destination: ApplicationDestination{Server: InClusterServer, Namespace: "podinfo"},
+		Source:      &ApplicationSource{RepoURL: "https://github.com/stefanprodan/podinfo", Path: "kustomize"},
+	}
+	return app
+}
+
+func TestApplicationValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(app *Application)
+		wantErrs []string
+	}{
+		{name: "valid"},
+		{
+			name:   "destination name",
+			modify: func(app *Application) { app.Spec.Destination = ApplicationDestination{Name: "dev-1"} },
+		},
+		{
+			name:     "missing name",
+			modify:   func(app *Application) { app.Name = "" },
+			wantErrs: []string{"metadata.name: Required value"},
+		},
+		{
+			name:     "name too long",
+			modify:   func(app *Application) { app.Name = strings.Repeat("a", 254) },
+			wantErrs: []string{"metadata.name: Invalid value", "must be no more than 253 characters"},
+		},
+		{
+			name:     "invalid name",
+			modify:   func(app *Application) { app.Name = "Podinfo_Flux" },
+			wantErrs: []string{"metadata.name: Invalid value"},
+		},
+		{
+			name:     "label value too long",
+			modify:   func(app *Application) { app.Labels["flamingo/workload-name"] = strings.Repeat("a", 64) },
+			wantErrs: []string{"metadata.labels[flamingo/workload-name]: Invalid value", "must be no more than 63 characters"},
+		},
+		{
+			name:     "invalid label value",
+			modify:   func(app *Application) { app.Labels["team"] = "team a" },
+			wantErrs: []string{"metadata.labels[team]: Invalid value"},
+		},
+		{
+			name: "missing required fields",
+			modify: func(app *Application) {
+				app.Namespace = ""
+				app.Spec.Project = ""
+				app.Spec.Destination = ApplicationDestination{}
+			},
+			wantErrs: []string{"metadata.namespace: Required value", "spec.project: Required value", "spec.destination.server: Required value"},
+		},
+		{
+			name:     "missing source",
+			modify:   func(app *Application) { app.Spec.Source = nil },
+			wantErrs: []string{"spec.source: Required value"},
+		},
+		{
+			name: "Helm source without chart",
+			modify: func(app *Application) {
+				app.Spec.Source = &ApplicationSource{Helm: &ApplicationSourceHelm{ReleaseName: "podinfo"}}
+			},
+			wantErrs: []string{"spec.source.repoURL: Required value", "spec.source.chart: Required value"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			if tt.modify != nil {
+				tt.modify(app)
+			}
+			errs := app.Validate()
+			if len(tt.wantErrs) == 0 {
+				if len(errs) > 0 {
+					t.Errorf("Validate() = %v, want no error", errs)
+				}
+				return
+			}
+			got := errs.ToAggregate()
+			if got == nil {
+				t.Fatalf("Validate() = no error, want %v", tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(got.Error(), want) {
+					t.Errorf("Validate() = %v, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewApplicationValidator(t *testing.T) {
+	newCRD := func(version string, schema *apiextensionsv1.CustomResourceValidation) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: ApplicationCRDName},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Group:    "argoproj.io",
+				Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{Name: version, Served: true, Schema: schema}},
+			},
+		}
+	}
+	schema := &apiextensionsv1.CustomResourceValidation{
+		OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+			Type: "object",
+			Properties: map[string]apiextensionsv1.JSONSchemaProps{
+				"spec": {
+					Type: "object",
+					Properties: map[string]apiextensionsv1.JSONSchemaProps{
+						"project": {Type: "string"},
+					},
+				},
+			},
+		},
+	}
+
+	t.Run("missing CRD", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(NewScheme()).Build()
+		if _, err := NewApplicationValidator(context.Background(), c); err == nil {
+			t.Error("NewApplicationValidator() error = nil, want not found")
+		}
+	})
+
+	t.Run("version not served", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(newCRD("v1beta1", schema)).Build()
+		if _, err := NewApplicationValidator(context.Background(), c); err == nil || !strings.Contains(err.Error(), "does not serve") {
+			t.Errorf("NewApplicationValidator() error = %v, want does not serve", err)
+		}
+	})
+
+	t.Run("no schema", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(newCRD("v1alpha1", nil)).Build()
+		if _, err := NewApplicationValidator(context.Background(), c); err == nil || !strings.Contains(err.Error(), "has no schema") {
+			t.Errorf("NewApplicationValidator() error = %v, want has no schema", err)
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(newCRD("v1alpha1", schema)).Build()
+		validator, err := NewApplicationValidator(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := newTestApplication().ToUnstructured()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := validator.Validate(obj); len(errs) > 0 {
+			t.Errorf("Validate() = %v, want no error", errs)
+		}
+		obj["spec"].(map[string]interface{})["project"] = int64(1)
+		if errs := validator.Validate(obj); len(errs) == 0 || !strings.Contains(errs.ToAggregate().Error(), "spec.project") {
+			t.Errorf("Validate() = %v, want an invalid spec.project", errs)
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	runclient "github.com/fluxcd/pkg/runtime/client"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SecretTypeLabel is the label Argo CD uses to discover cluster secrets.
+	SecretTypeLabel = "argocd.argoproj.io/secret-type"
+	// ClusterLabel marks a cluster secret as managed by Flamingo.
+	ClusterLabel = "flamingo/cluster"
+	// ClusterNameLabel holds the name of the cluster, so that ApplicationSets can select clusters by name.
+	ClusterNameLabel = "flamingo/cluster-name"
+
+	// ExternalAddressAnnotation is the address the CLI uses to reach the cluster.
+	ExternalAddressAnnotation = "flamingo/external-address"
+	// InternalAddressAnnotation is the address Argo CD uses to reach the cluster.
+	InternalAddressAnnotation = "flamingo/internal-address"
+
+	// InClusterName is the name Argo CD gives to the cluster it runs in.
+	InClusterName = "in-cluster"
+	// InClusterServer is the server address of the cluster Argo CD runs in.
+	InClusterServer = "https://kubernetes.default.svc"
+)
+
+// TLSClientConfig is the TLS part of an Argo CD cluster config.
+// Certificates and keys are base64 encoded.
+type TLSClientConfig struct {
+	Insecure   bool   `json:"insecure"`
+	CertData   string `json:"certData"`
+	KeyData    string `json:"keyData"`
+	CAData     string `json:"caData,omitempty"`
+	ServerName string `json:"serverName"`
+}
+
+// AWSAuthConfig configures IAM authentication against an EKS cluster.
+type AWSAuthConfig struct {
+	ClusterName string `json:"clusterName,omitempty"`
+	RoleARN     string `json:"roleARN,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+}
+
+// ExecProviderConfig configures an exec based credential plugin.
+type ExecProviderConfig struct {
+	Command     string            `json:"command,omitempty"`
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	APIVersion  string            `json:"apiVersion,omitempty"`
+	InstallHint string            `json:"installHint,omitempty"`
+}
+
+// SecretConfig is the content of the config key of an Argo CD cluster secret.
+type SecretConfig struct {
+	Username           string              `json:"username,omitempty"`
+	Password           string              `json:"password,omitempty"`
+	BearerToken        string              `json:"bearerToken,omitempty"`
+	TLSClientConfig    TLSClientConfig     `json:"tlsClientConfig"`
+	AWSAuthConfig      *AWSAuthConfig      `json:"awsAuthConfig,omitempty"`
+	ExecProviderConfig *ExecProviderConfig `json:"execProviderConfig,omitempty"`
+	ProxyURL           string              `json:"proxyUrl,omitempty"`
+}
+
+// Cluster is a leaf cluster registered to Flamingo.
+// It is stored as an Argo CD cluster secret.
+type Cluster struct {
+	Name             string
+	Server           string
+	ExternalAddress  string
+	InternalAddress  string
+	Config           SecretConfig
+	Namespaces       []string
+	ClusterResources bool
+	Project          string
+	Labels           map[string]string
+	Annotations      map[string]string
+}
+
+// ClusterSecretName returns the name of the secret holding the cluster.
+func ClusterSecretName(name string) string {
+	return fmt.Sprintf("%s-cluster", name)
+}
+
+// ValidateClusterName checks that a cluster can be registered under the given name,
+// which is part of the name of its secret and the value of its ClusterNameLabel.
+func ValidateClusterName(name string) error {
+	if e := validation.IsDNS1123Subdomain(ClusterSecretName(name)); len(e) > 0 {
+		return fmt.Errorf("invalid cluster name %q: %s", name, strings.Join(e, "; "))
+	}
+	if e := validation.IsValidLabelValue(name); len(e) > 0 {
+		return fmt.Errorf("invalid cluster name %q: %s", name, strings.Join(e, "; "))
+	}
+	return nil
+}
+
+// Secret converts the cluster into an Argo CD cluster secret in the given namespace.
+func (c *Cluster) Secret(namespace string) (*corev1.Secret, error) {
+	config, err := json.MarshalIndent(c.Config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	labels[SecretTypeLabel] = "cluster"
+	labels[ClusterLabel] = "true"
+	labels[ClusterNameLabel] = c.Name
+
+	annotations := map[string]string{}
+	for k, v := range c.Annotations {
+		annotations[k] = v
+	}
+	annotations[ExternalAddressAnnotation] = c.ExternalAddress
+	annotations[InternalAddressAnnotation] = c.InternalAddress
+
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ClusterSecretName(c.Name),
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			"name":   c.Name,
+			"server": c.Server,
+			"config": string(config),
+		},
+	}
+	if len(c.Namespaces) > 0 {
+		secret.StringData["namespaces"] = strings.Join(c.Namespaces, ",")
+	}
+	if c.ClusterResources {
+		secret.StringData["clusterResources"] = "true"
+	}
+	if c.Project != "" {
+		secret.StringData["project"] = c.Project
+	}
+
+	return secret, nil
+}
+
+// ClusterFromSecret reads a cluster from an Argo CD cluster secret.
+func ClusterFromSecret(secret *corev1.Secret) (*Cluster, error) {
+	// Parse the config block from the secret
+	configData, ok := secret.Data["config"]
+	if !ok {
+		return nil, fmt.Errorf("config block not found in secret %s", secret.Name)
+	}
+
+	cluster := &Cluster{
+		Name:            string(secret.Data["name"]),
+		Server:          string(secret.Data["server"]),
+		ExternalAddress: secret.Annotations[ExternalAddressAnnotation],
+		InternalAddress: secret.Annotations[InternalAddressAnnotation],
+		Project:         string(secret.Data["project"]),
+	}
+	if err := json.Unmarshal(configData, &cluster.Config); err != nil {
+		return nil, fmt.Errorf("invalid config block in secret %s: %w", secret.Name, err)
+	}
+
+	if namespaces := string(secret.Data["namespaces"]); namespaces != "" {
+		for _, ns := range strings.Split(namespaces, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				cluster.Namespaces = append(cluster.Namespaces, ns)
+			}
+		}
+	}
+	if clusterResources := string(secret.Data["clusterResources"]); clusterResources != "" {
+		cluster.ClusterResources, _ = strconv.ParseBool(clusterResources)
+	}
+
+	for k, v := range secret.Labels {
+		if k == SecretTypeLabel || k == ClusterLabel || k == ClusterNameLabel {
+			continue
+		}
+		if cluster.Labels == nil {
+			cluster.Labels = map[string]string{}
+		}
+		cluster.Labels[k] = v
+	}
+	for k, v := range secret.Annotations {
+		if k == ExternalAddressAnnotation || k == InternalAddressAnnotation {
+			continue
+		}
+		if cluster.Annotations == nil {
+			cluster.Annotations = map[string]string{}
+		}
+		cluster.Annotations[k] = v
+	}
+
+	return cluster, nil
+}
+
+// CLIAddress returns the address the CLI dials to reach the cluster.
+func (c *Cluster) CLIAddress() string {
+	if c.ExternalAddress != "" {
+		return c.ExternalAddress
+	}
+	return c.Server
+}
+
+// ArgoCDAddress returns the address Argo CD dials to reach the cluster.
+func (c *Cluster) ArgoCDAddress() string {
+	return c.Server
+}
+
+// tlsData decodes the certificates and the key of the cluster.
+func (c *Cluster) tlsData() (certData, keyData, caData []byte, err error) {
+	tlsConfig := c.Config.TLSClientConfig
+	certData, err = base64.StdEncoding.DecodeString(tlsConfig.CertData)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid certData: %w", err)
+	}
+	keyData, err = base64.StdEncoding.DecodeString(tlsConfig.KeyData)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid keyData: %w", err)
+	}
+	caData, err = base64.StdEncoding.DecodeString(tlsConfig.CAData)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid caData: %w", err)
+	}
+	// client-go refuses a root CA together with the insecure flag
+	if tlsConfig.Insecure {
+		caData = nil
+	}
+	return certData, keyData, caData, nil
+}
+
+// execConfig converts the exec provider or the AWS auth config into a client-go exec config.
+func (c *Cluster) execConfig() *clientcmdapi.ExecConfig {
+	if exec := c.Config.ExecProviderConfig; exec != nil {
+		execConfig := &clientcmdapi.ExecConfig{
+			Command:         exec.Command,
+			Args:            exec.Args,
+			APIVersion:      exec.APIVersion,
+			InstallHint:     exec.InstallHint,
+			InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+		}
+		for k, v := range exec.Env {
+			execConfig.Env = append(execConfig.Env, clientcmdapi.ExecEnvVar{Name: k, Value: v})
+		}
+		sort.Slice(execConfig.Env, func(i, j int) bool {
+			return execConfig.Env[i].Name < execConfig.Env[j].Name
+		})
+		return execConfig
+	}
+
+	if aws := c.Config.AWSAuthConfig; aws != nil {
+		// Argo CD uses its own argocd-k8s-auth binary, the AWS CLI is the local equivalent
+		args := []string{"eks", "get-token", "--cluster-name", aws.ClusterName}
+		if aws.RoleARN != "" {
+			args = append(args, "--role-arn", aws.RoleARN)
+		}
+		var env []clientcmdapi.ExecEnvVar
+		if aws.Profile != "" {
+			env = append(env, clientcmdapi.ExecEnvVar{Name: "AWS_PROFILE", Value: aws.Profile})
+		}
+		return &clientcmdapi.ExecConfig{
+			Command:         "aws",
+			Args:            args,
+			Env:             env,
+			APIVersion:      "client.authentication.k8s.io/v1beta1",
+			InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+		}
+	}
+
+	return nil
+}
+
+// RESTConfig builds the configuration used by the CLI to connect to the cluster.
+func (c *Cluster) RESTConfig(opts *runclient.Options) (*rest.Config, error) {
+	certData, keyData, caData, err := c.tlsData()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &rest.Config{
+		Host:        c.CLIAddress(),
+		Username:    c.Config.Username,
+		Password:    c.Config.Password,
+		BearerToken: c.Config.BearerToken,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure:   c.Config.TLSClientConfig.Insecure,
+			CertData:   certData,
+			KeyData:    keyData,
+			CAData:     caData,
+			ServerName: c.Config.TLSClientConfig.ServerName,
+		},
+		ExecProvider: c.execConfig(),
+		QPS:          opts.QPS,
+		Burst:        opts.Burst,
+	}
+
+	if c.Config.ProxyURL != "" {
+		proxyURL, err := ParseProxyURL(c.Config.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return cfg, nil
+}
+
+// ParseProxyURL validates the URL of a proxy in front of a cluster.
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be http, https or socks5", proxyURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxyURL)
+	}
+	return u, nil
+}
+
+// ClusterRegistry stores Flamingo clusters as Argo CD cluster secrets.
+type ClusterRegistry struct {
+	client    client.Client
+	namespace string
+}
+
+// NewClusterRegistry returns a registry backed by the secrets in the given namespace.
+func NewClusterRegistry(c client.Client, namespace string) *ClusterRegistry {
+	return &ClusterRegistry{
+		client:    c,
+		namespace: namespace,
+	}
+}
+
+// Add creates or updates the secret of the given cluster.
+func (r *ClusterRegistry) Add(ctx context.Context, cluster *Cluster) error {
+	secret, err := cluster.Secret(r.namespace)
+	if err != nil {
+		return err
+	}
+
+	// A cluster read from its secret carries all of its labels and annotations, so they are replaced,
+	// which lets cluster label remove them.
+	return createOrUpdateSecret(ctx, r.client, secret, clusterDataKeys, true)
+}
+
+// clusterDataKeys are the keys of a cluster secret managed by Flamingo.
+// Other keys, like the shard Argo CD assigns the cluster to, are kept on updates.
+var clusterDataKeys = []string{"name", "server", "config", "namespaces", "clusterResources", "project"}
+
+// createOrUpdateSecret creates the secret, or updates the managed data keys of the existing one.
+// The other data keys, the owner references and the finalizers of the existing secret are kept.
+// Its labels and annotations are replaced by those of the secret when replaceMetadata is set,
+// or else the labels and annotations of the secret are added to them.
+func createOrUpdateSecret(ctx context.Context, c client.Client, secret *corev1.Secret, managedKeys []string, replaceMetadata bool) error {
+	data := map[string][]byte{}
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+	for k, v := range secret.StringData {
+		data[k] = []byte(v)
+	}
+
+	existing := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKeyFromObject(secret), existing)
+	if apierrors.IsNotFound(err) {
+		created := secret.DeepCopy()
+		created.Data, created.StringData = data, nil
+		return c.Create(ctx, created)
+	}
+	if err != nil {
+		return err
+	}
+
+	updated := existing.DeepCopy()
+	if replaceMetadata {
+		updated.Labels, updated.Annotations = secret.Labels, secret.Annotations
+	} else {
+		updated.Labels = mergeStringMaps(updated.Labels, secret.Labels)
+		updated.Annotations = mergeStringMaps(updated.Annotations, secret.Annotations)
+	}
+	if updated.Data == nil {
+		updated.Data = map[string][]byte{}
+	}
+	for _, k := range managedKeys {
+		if v, found := data[k]; found {
+			updated.Data[k] = v
+		} else {
+			delete(updated.Data, k)
+		}
+	}
+	return c.Update(ctx, updated)
+}
+
+// mergeStringMaps returns base with the entries of overrides added.
+func mergeStringMaps(base, overrides map[string]string) map[string]string {
+	if len(overrides) == 0 {
+		return base
+	}
+	if base == nil {
+		base = map[string]string{}
+	}
+	for k, v := range overrides {
+		base[k] = v
+	}
+	return base
+}
+
+// Get returns the cluster registered under the given name.
+func (r *ClusterRegistry) Get(ctx context.Context, name string) (*Cluster, error) {
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: r.namespace, Name: ClusterSecretName(name)}
+	if err := r.client.Get(ctx, key, secret); err != nil {
+		return nil, err
+	}
+	return ClusterFromSecret(secret)
+}
+
+// List returns all registered clusters sorted by name.
+func (r *ClusterRegistry) List(ctx context.Context) ([]Cluster, error) {
+	list := &corev1.SecretList{}
+	if err := r.client.List(ctx, list,
+		client.InNamespace(r.namespace),
+		client.MatchingLabels{ClusterLabel: "true"}); err != nil {
+		return nil, err
+	}
+
+	var clusters []Cluster
+	for i := range list.Items {
+		cluster, err := ClusterFromSecret(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, *cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	return clusters, nil
+}
+
+// Remove deletes the secret of the given cluster.
+func (r *ClusterRegistry) Remove(ctx context.Context, name string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ClusterSecretName(name),
+			Namespace: r.namespace,
+		},
+	}
+	return r.client.Delete(ctx, secret)
+}
+
+// ClientFor returns a client connected to the given cluster together with its registration.
+func (r *ClusterRegistry) ClientFor(ctx context.Context, name string, opts *runclient.Options) (client.Client, *Cluster, error) {
+	cluster, err := r.Get(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := cluster.RESTConfig(opts)
+	if err != nil {
+		return nil, cluster, err
+	}
+
+	k8sClient, err := client.New(cfg, client.Options{Scheme: NewScheme()})
+	if err != nil {
+		return nil, cluster, err
+	}
+
+	return NewFluxClient(k8sClient), cluster, nil
+}
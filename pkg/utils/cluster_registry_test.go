@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestCluster() *Cluster {
+	return &Cluster{
+		Name:            "dev-1",
+		Server:          "https://dev-1.example.com",
+		ExternalAddress: "https://127.0.0.1:6443",
+		InternalAddress: "https://dev-1.example.com",
+		Config: SecretConfig{
+			BearerToken:     "token",
+			TLSClientConfig: TLSClientConfig{CAData: "Y2E=", ServerName: "dev-1"},
+			ProxyURL:        "http://proxy.example.com:3128",
+		},
+		Namespaces:       []string{"podinfo", "podinfo-helm"},
+		ClusterResources: true,
+		Project:          "dev",
+		Labels:           map[string]string{"env": "dev"},
+		Annotations:      map[string]string{"team": "a"},
+	}
+}
+
+// secretData moves the stringData of a secret into its data, like the API server does.
+func secretData(secret *corev1.Secret) *corev1.Secret {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+	return secret
+}
+
+func TestClusterSecretRoundTrip(t *testing.T) {
+	cluster := newTestCluster()
+	secret, err := cluster.Secret("argocd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ClusterFromSecret(secretData(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cluster) {
+		t.Errorf("ClusterFromSecret() = %+v, want %+v", got, cluster)
+	}
+
+	again, err := got.Secret("argocd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData(again)
+	if !reflect.DeepEqual(again.Data, secret.Data) {
+		t.Errorf("Secret() data = %v, want %v", again.Data, secret.Data)
+	}
+	if !reflect.DeepEqual(again.Labels, secret.Labels) || !reflect.DeepEqual(again.Annotations, secret.Annotations) {
+		t.Errorf("Secret() metadata = %v %v, want %v %v", again.Labels, again.Annotations, secret.Labels, secret.Annotations)
+	}
+}
+
+func TestClusterRegistryAddKeepsUnmanagedFields(t *testing.T) {
+	cluster := newTestCluster()
+	secret, err := cluster.Secret("argocd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData(secret)
+	secret.Data["shard"] = []byte("2")
+	secret.Finalizers = []string{"example.com/finalizer"}
+	secret.OwnerReferences = []metav1.OwnerReference{{APIVersion: "cluster.x-k8s.io/v1beta1", Kind: "Cluster", Name: "dev-1", UID: "uid"}}
+	c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(secret).Build()
+	registry := NewClusterRegistry(c, "argocd")
+
+	ctx := context.Background()
+	cluster, err = registry.Get(ctx, "dev-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Project = ""
+	delete(cluster.Labels, "env")
+	cluster.Labels["tier"] = "edge"
+	if err := registry.Add(ctx, cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(secret), updated); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(updated.Data["shard"]); got != "2" {
+		t.Errorf("shard = %q, want 2", got)
+	}
+	if _, found := updated.Data["project"]; found {
+		t.Errorf("project kept after being cleared")
+	}
+	if !reflect.DeepEqual(updated.Finalizers, secret.Finalizers) || !reflect.DeepEqual(updated.OwnerReferences, secret.OwnerReferences) {
+		t.Errorf("finalizers %v and owner references %v not kept", updated.Finalizers, updated.OwnerReferences)
+	}
+	if _, found := updated.Labels["env"]; found || updated.Labels["tier"] != "edge" || updated.Labels[ClusterLabel] != "true" {
+		t.Errorf("labels = %v, want tier=edge without env", updated.Labels)
+	}
+
+	got, err := registry.Get(ctx, "dev-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Config.ProxyURL != cluster.Config.ProxyURL || !reflect.DeepEqual(got.Namespaces, cluster.Namespaces) || !got.ClusterResources {
+		t.Errorf("Get() = %+v, want %+v", got, cluster)
+	}
+}
+
+func TestAddFluxKubeconfigKeepsForeignLabels(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.Config = SecretConfig{BearerToken: "token"}
+	existing, err := cluster.FluxKubeconfigSecret("flux-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretData(existing)
+	existing.Labels["kustomize.toolkit.fluxcd.io/name"] = "flux-system"
+	c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(existing).Build()
+
+	cluster.Config.BearerToken = "rotated"
+	if err := NewClusterRegistry(c, "argocd").AddFluxKubeconfig(context.Background(), cluster, "flux-system"); err != nil {
+		t.Fatal(err)
+	}
+	updated := &corev1.Secret{}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(existing), updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Labels["kustomize.toolkit.fluxcd.io/name"] != "flux-system" {
+		t.Errorf("labels = %v, foreign label dropped", updated.Labels)
+	}
+	if reflect.DeepEqual(updated.Data[FluxKubeconfigKey], existing.Data[FluxKubeconfigKey]) {
+		t.Errorf("kubeconfig not updated")
+	}
+}
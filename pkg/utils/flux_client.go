@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// fluxClient reads and patches Flux objects through the API version served by the cluster
+// when it differs from the version of the Flamingo scheme, like HelmRelease v2 on Flux 2.3+
+// or Kustomization v1beta2 on older Flux. The objects are converted through their unstructured
+// form, so fields only known to the served version are dropped.
+type fluxClient struct {
+	client.Client
+
+	mu     sync.Mutex
+	served map[schema.GroupVersionKind]schema.GroupVersionKind
+}
+
+// NewFluxClient wraps a client to read and patch Flux objects of any served API version.
+func NewFluxClient(c client.Client) client.Client {
+	return &fluxClient{
+		Client: c,
+		served: map[schema.GroupVersionKind]schema.GroupVersionKind{},
+	}
+}
+
+func (c *fluxClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	served, fallback, err := c.servedGVK(obj, false)
+	if err != nil || !fallback {
+		return c.Client.Get(ctx, key, obj, opts...)
+	}
+
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(served)
+	if err := c.Client.Get(ctx, key, u, opts...); err != nil {
+		return err
+	}
+	return apiruntime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+}
+
+func (c *fluxClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	served, fallback, err := c.servedGVK(list, true)
+	if err != nil || !fallback {
+		return c.Client.List(ctx, list, opts...)
+	}
+
+	u := &unstructured.UnstructuredList{}
+	u.SetGroupVersionKind(served.GroupVersion().WithKind(served.Kind + "List"))
+	if err := c.Client.List(ctx, u, opts...); err != nil {
+		return err
+	}
+	return apiruntime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), list)
+}
+
+func (c *fluxClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	served, fallback, err := c.servedGVK(obj, false)
+	if err != nil || !fallback {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(served)
+	u.SetNamespace(obj.GetNamespace())
+	u.SetName(obj.GetName())
+	if err := c.Client.Patch(ctx, u, client.RawPatch(patch.Type(), data), opts...); err != nil {
+		return err
+	}
+	return apiruntime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+}
+
+// servedGVK returns the version of a Flux kind served by the cluster, and whether it differs from the version of the object.
+// Unstructured objects and other kinds are used as is.
+func (c *fluxClient) servedGVK(obj apiruntime.Object, isList bool) (schema.GroupVersionKind, bool, error) {
+	if _, ok := obj.(apiruntime.Unstructured); ok {
+		return schema.GroupVersionKind{}, false, nil
+	}
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return schema.GroupVersionKind{}, false, err
+	}
+	if isList {
+		gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	}
+	if !IsFluxGroup(gvk.Group) {
+		return gvk, false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	served, found := c.served[gvk]
+	if !found {
+		served, err = ServedGVK(c.RESTMapper(), gvk)
+		if err != nil {
+			return gvk, false, err
+		}
+		c.served[gvk] = served
+	}
+	return served, served != gvk, nil
+}
+
+// IsFluxGroup reports whether the API group belongs to Flux, like kustomize.toolkit.fluxcd.io.
+func IsFluxGroup(group string) bool {
+	return strings.HasSuffix(group, ".toolkit.fluxcd.io")
+}
+
+// ServedGVK returns the given version of the kind when the cluster serves it,
+// or else the version preferred by the cluster.
+func ServedGVK(mapper meta.RESTMapper, gvk schema.GroupVersionKind) (schema.GroupVersionKind, error) {
+	_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err == nil {
+		return gvk, nil
+	}
+	if !meta.IsNoMatchError(err) {
+		return gvk, err
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind())
+	if err != nil {
+		return gvk, err
+	}
+	return mapping.GroupVersionKind, nil
+}
+
+// SchemeGVK returns the version of the kind registered in the scheme, when the scheme does not recognize the given version.
+// It returns false when the scheme does not know the kind in any version.
+func SchemeGVK(scheme *apiruntime.Scheme, gvk schema.GroupVersionKind) (schema.GroupVersionKind, bool) {
+	if scheme.Recognizes(gvk) {
+		return gvk, true
+	}
+	for _, gv := range scheme.PrioritizedVersionsForGroup(gvk.Group) {
+		if candidate := gv.WithKind(gvk.Kind); scheme.Recognizes(candidate) {
+			return candidate, true
+		}
+	}
+	return gvk, false
+}
+
+// ServedObject returns an empty object of the version of its kind served by the cluster: the object itself
+// when its version is served, or else an unstructured object of the served version, to be watched in its place.
+func ServedObject(mapper meta.RESTMapper, scheme *apiruntime.Scheme, obj client.Object) (client.Object, error) {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return nil, err
+	}
+	served, err := ServedGVK(mapper, gvk)
+	if err != nil {
+		return nil, err
+	}
+	if served == gvk {
+		return obj, nil
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(served)
+	return u, nil
+}
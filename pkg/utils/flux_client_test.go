@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	helmv2b1 "github.com/fluxcd/helm-controller/api/v2beta1"
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// recordingClient records the version of the objects sent to the API server.
+type recordingClient struct {
+	client.Client
+	versions []schema.GroupVersionKind
+}
+
+func (c *recordingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	c.versions = append(c.versions, obj.GetObjectKind().GroupVersionKind())
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c *recordingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.versions = append(c.versions, list.GetObjectKind().GroupVersionKind())
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *recordingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.versions = append(c.versions, obj.GetObjectKind().GroupVersionKind())
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestFluxClientServedVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		served          schema.GroupVersionKind
+		object          func() client.Object
+		list            func() client.ObjectList
+		targetNamespace func(obj client.Object) string
+	}{
+		{
+			name:            "HelmRelease v2",
+			served:          schema.GroupVersionKind{Group: helmv2b1.GroupVersion.Group, Version: "v2", Kind: helmv2b1.HelmReleaseKind},
+			object:          func() client.Object { return &helmv2b1.HelmRelease{} },
+			list:            func() client.ObjectList { return &helmv2b1.HelmReleaseList{} },
+			targetNamespace: func(obj client.Object) string { return obj.(*helmv2b1.HelmRelease).Spec.TargetNamespace },
+		},
+		{
+			name:            "Kustomization v1beta2",
+			served:          schema.GroupVersionKind{Group: kustomizev1.GroupVersion.Group, Version: "v1beta2", Kind: kustomizev1.KustomizationKind},
+			object:          func() client.Object { return &kustomizev1.Kustomization{} },
+			list:            func() client.ObjectList { return &kustomizev1.KustomizationList{} },
+			targetNamespace: func(obj client.Object) string { return obj.(*kustomizev1.Kustomization).Spec.TargetNamespace },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{tt.served.GroupVersion()})
+			mapper.Add(tt.served, meta.RESTScopeNamespace)
+
+			existing := &unstructured.Unstructured{Object: map[string]interface{}{
+				"spec": map[string]interface{}{"targetNamespace": "podinfo"},
+			}}
+			existing.SetGroupVersionKind(tt.served)
+			existing.SetNamespace("flux-system")
+			existing.SetName("podinfo")
+
+			recorder := &recordingClient{Client: fake.NewClientBuilder().
+				WithScheme(NewScheme()).
+				WithRESTMapper(mapper).
+				WithObjects(existing).
+				Build()}
+			c := NewFluxClient(recorder)
+			ctx := context.Background()
+
+			obj := tt.object()
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "flux-system", Name: "podinfo"}, obj); err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if got := tt.targetNamespace(obj); got != "podinfo" {
+				t.Errorf("Get() targetNamespace = %q, want podinfo", got)
+			}
+
+			list := tt.list()
+			if err := c.List(ctx, list, client.InNamespace("flux-system")); err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if items, err := meta.ExtractList(list); err != nil || len(items) != 1 {
+				t.Errorf("List() = %d items, error %v, want 1 item", len(items), err)
+			}
+
+			patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+			obj.SetAnnotations(map[string]string{"flamingo/application": "argocd/podinfo"})
+			if err := c.Patch(ctx, obj, patch); err != nil {
+				t.Fatalf("Patch() error = %v", err)
+			}
+			patched := &unstructured.Unstructured{}
+			patched.SetGroupVersionKind(tt.served)
+			if err := recorder.Client.Get(ctx, client.ObjectKeyFromObject(existing), patched); err != nil {
+				t.Fatal(err)
+			}
+			if got := patched.GetAnnotations()["flamingo/application"]; got != "argocd/podinfo" {
+				t.Errorf("Patch() annotation = %q, want argocd/podinfo", got)
+			}
+
+			wantList := tt.served.GroupVersion().WithKind(tt.served.Kind + "List")
+			want := []schema.GroupVersionKind{tt.served, wantList, tt.served}
+			if len(recorder.versions) != len(want) {
+				t.Fatalf("requests = %v, want %v", recorder.versions, want)
+			}
+			for i := range want {
+				if recorder.versions[i] != want[i] {
+					t.Errorf("request %d went through %v, want %v", i, recorder.versions[i], want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// FluxKubeconfigAnnotation points a cluster secret to the Flux kubeconfig secret
+	// generated from the same credentials, in the namespace/name format.
+	FluxKubeconfigAnnotation = "flamingo/flux-kubeconfig"
+
+	// FluxKubeconfigKey is the default key Flux reads the kubeconfig from.
+	FluxKubeconfigKey = "value"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+)
+
+// FluxKubeconfigSecretName returns the name of the Flux kubeconfig secret of the cluster.
+func FluxKubeconfigSecretName(name string) string {
+	return fmt.Sprintf("%s-kubeconfig", name)
+}
+
+// Kubeconfig builds a self-contained kubeconfig to reach the cluster from inside the
+// management cluster, using the same address and credentials as Argo CD.
+func (c *Cluster) Kubeconfig() (*clientcmdapi.Config, error) {
+	certData, keyData, caData, err := c.tlsData()
+	if err != nil {
+		return nil, err
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[c.Name] = &clientcmdapi.Cluster{
+		Server:                   c.ArgoCDAddress(),
+		InsecureSkipTLSVerify:    c.Config.TLSClientConfig.Insecure,
+		CertificateAuthorityData: caData,
+		TLSServerName:            c.Config.TLSClientConfig.ServerName,
+		ProxyURL:                 c.Config.ProxyURL,
+	}
+	config.AuthInfos[c.Name] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: certData,
+		ClientKeyData:         keyData,
+		Token:                 c.Config.BearerToken,
+		Username:              c.Config.Username,
+		Password:              c.Config.Password,
+		Exec:                  c.execConfig(),
+	}
+	config.Contexts[c.Name] = &clientcmdapi.Context{
+		Cluster:  c.Name,
+		AuthInfo: c.Name,
+	}
+	config.CurrentContext = c.Name
+
+	return config, nil
+}
+
+// FluxKubeconfigSecret converts the cluster into a secret usable in the
+// spec.kubeConfig.secretRef of Flux Kustomizations and HelmReleases.
+func (c *Cluster) FluxKubeconfigSecret(namespace string) (*corev1.Secret, error) {
+	config, err := c.Kubeconfig()
+	if err != nil {
+		return nil, err
+	}
+	value, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      FluxKubeconfigSecretName(c.Name),
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel:   "flamingo",
+				ClusterNameLabel: c.Name,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			FluxKubeconfigKey: string(value),
+		},
+	}, nil
+}
+
+// AddFluxKubeconfig creates or updates the Flux kubeconfig secret of the cluster in the given namespace.
+// The cluster must then be added to the registry with the FluxKubeconfigAnnotation set.
+// A secret with the same name not managed by Flamingo is never overwritten.
+func (r *ClusterRegistry) AddFluxKubeconfig(ctx context.Context, cluster *Cluster, namespace string) error {
+	secret, err := cluster.FluxKubeconfigSecret(namespace)
+	if err != nil {
+		return err
+	}
+
+	existing := &corev1.Secret{}
+	err = r.client.Get(ctx, client.ObjectKeyFromObject(secret), existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && existing.Labels[managedByLabel] != "flamingo" {
+		return fmt.Errorf("secret %s/%s already exists and is not managed by Flamingo", namespace, secret.Name)
+	}
+
+	return createOrUpdateSecret(ctx, r.client, secret, []string{FluxKubeconfigKey}, false)
+}
+
+// FindByFluxKubeconfig returns the cluster whose Flux kubeconfig secret is the given one,
+// or nil if no registered cluster uses it.
+func (r *ClusterRegistry) FindByFluxKubeconfig(ctx context.Context, namespace string, secretName string) (*Cluster, error) {
+	clusters, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := namespace + "/" + secretName
+	for i := range clusters {
+		if strings.TrimSpace(clusters[i].Annotations[FluxKubeconfigAnnotation]) == ref {
+			return &clusters[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFluxKubeconfigSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cluster *Cluster)
+		check  func(t *testing.T, config *clientcmdapi.Config)
+	}{
+		{
+			name: "bearer token",
+			check: func(t *testing.T, config *clientcmdapi.Config) {
+				cluster, authInfo := config.Clusters["dev-1"], config.AuthInfos["dev-1"]
+				if cluster.Server != "https://dev-1.example.com" || string(cluster.CertificateAuthorityData) != "ca" ||
+					cluster.TLSServerName != "dev-1" || cluster.ProxyURL != "http://proxy.example.com:3128" {
+					t.Errorf("cluster = %+v", cluster)
+				}
+				if authInfo.Token != "token" {
+					t.Errorf("token = %q, want token", authInfo.Token)
+				}
+				if config.CurrentContext != "dev-1" || config.Contexts["dev-1"].Cluster != "dev-1" || config.Contexts["dev-1"].AuthInfo != "dev-1" {
+					t.Errorf("current context = %s, contexts = %+v", config.CurrentContext, config.Contexts)
+				}
+			},
+		},
+		{
+			name:   "insecure",
+			modify: func(cluster *Cluster) { cluster.Config.TLSClientConfig.Insecure = true },
+			check: func(t *testing.T, config *clientcmdapi.Config) {
+				cluster := config.Clusters["dev-1"]
+				if !cluster.InsecureSkipTLSVerify || len(cluster.CertificateAuthorityData) > 0 {
+					t.Errorf("cluster = %+v, want insecure without CA", cluster)
+				}
+			},
+		},
+		{
+			name: "client certificate",
+			modify: func(cluster *Cluster) {
+				cluster.Config.BearerToken = ""
+				cluster.Config.TLSClientConfig.CertData = "Y2VydA=="
+				cluster.Config.TLSClientConfig.KeyData = "a2V5"
+			},
+			check: func(t *testing.T, config *clientcmdapi.Config) {
+				authInfo := config.AuthInfos["dev-1"]
+				if string(authInfo.ClientCertificateData) != "cert" || string(authInfo.ClientKeyData) != "key" || authInfo.Token != "" {
+					t.Errorf("auth info = %+v, want the client certificate", authInfo)
+				}
+			},
+		},
+		{
+			name: "exec provider",
+			modify: func(cluster *Cluster) {
+				cluster.Config.BearerToken = ""
+				cluster.Config.ExecProviderConfig = &ExecProviderConfig{
+					Command:    "kubelogin",
+					Args:       []string{"get-token"},
+					Env:        map[string]string{"B": "2", "A": "1"},
+					APIVersion: "client.authentication.k8s.io/v1beta1",
+				}
+			},
+			check: func(t *testing.T, config *clientcmdapi.Config) {
+				exec := config.AuthInfos["dev-1"].Exec
+				if exec == nil || exec.Command != "kubelogin" || !reflect.DeepEqual(exec.Args, []string{"get-token"}) {
+					t.Fatalf("exec = %+v", exec)
+				}
+				want := []clientcmdapi.ExecEnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}}
+				if !reflect.DeepEqual(exec.Env, want) {
+					t.Errorf("exec env = %v, want %v", exec.Env, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newTestCluster()
+			if tt.modify != nil {
+				tt.modify(cluster)
+			}
+			secret, err := cluster.FluxKubeconfigSecret("flux-system")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret.Namespace != "flux-system" || secret.Name != "dev-1-kubeconfig" {
+				t.Errorf("secret = %s/%s, want flux-system/dev-1-kubeconfig", secret.Namespace, secret.Name)
+			}
+			if secret.Labels[managedByLabel] != "flamingo" || secret.Labels[ClusterNameLabel] != "dev-1" {
+				t.Errorf("labels = %v", secret.Labels)
+			}
+
+			config, err := clientcmd.Load([]byte(secret.StringData[FluxKubeconfigKey]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, config)
+		})
+	}
+}
+
+func TestFluxKubeconfigSecretInvalidCertificate(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.Config.TLSClientConfig.CertData = "not base64"
+	if _, err := cluster.FluxKubeconfigSecret("flux-system"); err == nil || !strings.Contains(err.Error(), "invalid certData") {
+		t.Errorf("FluxKubeconfigSecret() error = %v, want invalid certData", err)
+	}
+}
+
+func TestAddFluxKubeconfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		wantErr  string
+	}{
+		{name: "new secret"},
+		{
+			name: "secret managed by flamingo",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "dev-1-kubeconfig", Labels: map[string]string{managedByLabel: "flamingo"}},
+				Data:       map[string][]byte{FluxKubeconfigKey: []byte("old"), "other": []byte("kept")},
+			},
+		},
+		{
+			name: "secret not managed by flamingo",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "flux-system", Name: "dev-1-kubeconfig"},
+				Data:       map[string][]byte{FluxKubeconfigKey: []byte("old")},
+			},
+			wantErr: "secret flux-system/dev-1-kubeconfig already exists and is not managed by Flamingo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(NewScheme())
+			if tt.existing != nil {
+				builder = builder.WithObjects(tt.existing)
+			}
+			c := builder.Build()
+			cluster := newTestCluster()
+
+			err := NewClusterRegistry(c, "argocd").AddFluxKubeconfig(context.Background(), cluster, "flux-system")
+			secret := &corev1.Secret{}
+			if getErr := c.Get(context.Background(), client.ObjectKey{Namespace: "flux-system", Name: "dev-1-kubeconfig"}, secret); getErr != nil {
+				t.Fatal(getErr)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("AddFluxKubeconfig() error = %v, want %s", err, tt.wantErr)
+				}
+				if string(secret.Data[FluxKubeconfigKey]) != "old" {
+					t.Errorf("secret not managed by Flamingo overwritten")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := clientcmd.Load(secret.Data[FluxKubeconfigKey])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.Clusters["dev-1"].Server; got != cluster.Server {
+				t.Errorf("server = %s, want %s", got, cluster.Server)
+			}
+			if tt.existing != nil && string(secret.Data["other"]) != "kept" {
+				t.Errorf("data = %v, unmanaged key dropped", secret.Data)
+			}
+		})
+	}
+}
+
+func TestFindByFluxKubeconfig(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.Annotations[FluxKubeconfigAnnotation] = "flux-system/dev-1-kubeconfig"
+	secret, err := cluster.Secret("argocd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestCluster()
+	other.Name = "dev-2"
+	otherSecret, err := other.Secret("argocd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(NewScheme()).WithObjects(secretData(secret), secretData(otherSecret)).Build()
+	registry := NewClusterRegistry(c, "argocd")
+
+	tests := []struct {
+		namespace string
+		name      string
+		want      string
+	}{
+		{namespace: "flux-system", name: "dev-1-kubeconfig", want: "dev-1"},
+		{namespace: "apps", name: "dev-1-kubeconfig"},
+		{namespace: "flux-system", name: "dev-2-kubeconfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.name, func(t *testing.T) {
+			got, err := registry.FindByFluxKubeconfig(context.Background(), tt.namespace, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil && tt.want != "") || (got != nil && got.Name != tt.want) {
+				t.Errorf("FindByFluxKubeconfig() = %+v, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -16,5 +16,9 @@ func KubeClient(rcg genericclioptions.RESTClientGetter, opts *runclient.Options)
 		return nil, err
 	}
 
-	return client.New(cfg, client.Options{Mapper: restMapper, Scheme: NewScheme()})
+	c, err := client.New(cfg, client.Options{Mapper: restMapper, Scheme: NewScheme()})
+	if err != nil {
+		return nil, err
+	}
+	return NewFluxClient(c), nil
 }